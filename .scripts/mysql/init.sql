@@ -20,7 +20,13 @@ create table local_msg_test.local_msgs
     send_times bigint           null,
     status     tinyint unsigned null,
     utime      bigint           null,
-    ctime      bigint           null
+    ctime      bigint           null,
+    -- 开启 fencing 之后补偿任务才会用到
+    fencing_token bigint not null default 0,
+    -- 管理后台记录谁重试了这条消息
+    retried_by varchar(64) not null default '',
+    -- 管理后台第一次修改消息内容的时候，保存原本的内容
+    original_data TEXT null
 );
 
 create index idx_local_msgs_key
@@ -29,6 +35,10 @@ create index idx_local_msgs_key
 create index utime_status
     on local_msg_test.local_msgs (status, utime);
 
+-- 积压监控和管理后台的统计用来查找等待最久的待发送消息
+create index ctime_status
+    on local_msg_test.local_msgs (status, ctime);
+
 -- 下面这些用来测试分库分表
 -- 分成两个库
 CREATE DATABASE IF NOT EXISTS `orders_db_00`;
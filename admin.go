@@ -2,16 +2,71 @@ package lmsg
 
 import (
 	"github.com/IBM/sarama"
+	"github.com/ecodeclub/ekit/bean/option"
 	service2 "github.com/meoying/local-msg-go/internal/admin/service"
 	"github.com/meoying/local-msg-go/internal/admin/web"
+	"gorm.io/gorm"
 )
 
 type AdminHandler = web.Handler
 
-func NewAdminHandler(svc *service2.LocalService) *AdminHandler {
-	return web.NewHandler(svc)
+type HealthHandler = web.HealthHandler
+
+// AdminRole 管理后台中的角色，每个业务可以不一样
+type AdminRole = web.Role
+
+const (
+	AdminRoleViewer   = web.RoleViewer
+	AdminRoleOperator = web.RoleOperator
+	AdminRoleAdmin    = web.RoleAdmin
+)
+
+type AdminPrincipal = web.Principal
+
+type AdminAuthenticator = web.Authenticator
+
+type AdminAuthenticatorFunc = web.AuthenticatorFunc
+
+// NewAdminHandler 不设置 WithAdminAuthenticator 的时候，所有人都可以执行所有操作
+func NewAdminHandler(svc *service2.LocalService, opts ...option.Option[AdminHandler]) *AdminHandler {
+	return web.NewHandler(svc, opts...)
+}
+
+// WithAdminAuthenticator 认证管理后台的请求，并且按照业务鉴权
+func WithAdminAuthenticator(auth AdminAuthenticator) option.Option[AdminHandler] {
+	return web.WithAuthenticator(auth)
+}
+
+// NewAdminSessionAuthenticator 使用 ginx 的 session，角色保存在 Claims.Data 中
+func NewAdminSessionAuthenticator() AdminAuthenticator {
+	return web.NewSessionAuthenticator()
+}
+
+// NewAdminJWTAuthenticator 使用 HS256 签名的 bearer token，key 不能为空，token 必须有过期时间
+func NewAdminJWTAuthenticator(key []byte) (AdminAuthenticator, error) {
+	return web.NewJWTAuthenticator(key)
+}
+
+// NewHealthHandler 存活探针和就绪探针，不需要和 AdminHandler 一起部署
+func NewHealthHandler(svc *service2.LocalService) *HealthHandler {
+	return web.NewHealthHandler(svc)
 }
 
 func NewAdminLocalService(producer sarama.SyncProducer) *service2.LocalService {
 	return service2.NewLocalService(producer)
 }
+
+type AuditSink = service2.AuditSink
+
+type AuditLog = service2.AuditLog
+
+// NewGormAuditSink 审计日志保存在 db 的 local_msg_audit_logs 表中，可以通过管理后台查询
+// 设置到 LocalService.AuditSink 上之后生效
+func NewGormAuditSink(db *gorm.DB) (*service2.GormAuditSink, error) {
+	sink := service2.NewGormAuditSink(db)
+	err := sink.InitTable()
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
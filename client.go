@@ -1 +1,63 @@
 package lmsg
+
+import (
+	"context"
+	"database/sql"
+	dlock "github.com/meoying/local-msg-go/internal/lock"
+	elock "github.com/meoying/local-msg-go/internal/lock/etcd"
+	glock "github.com/meoying/local-msg-go/internal/lock/gorm"
+	rlock "github.com/meoying/local-msg-go/internal/lock/redis"
+	"github.com/meoying/local-msg-go/internal/lock/redlock"
+	slock "github.com/meoying/local-msg-go/internal/lock/session"
+	"github.com/redis/go-redis/v9"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"gorm.io/gorm"
+	"time"
+)
+
+// LockClient 分布式锁的客户端，补偿任务通过它来抢占每一张表
+type LockClient = dlock.Client
+
+// Lock 分布式锁
+type Lock = dlock.Lock
+
+// AutoRefresh 看门狗，在后台每隔 interval 续约一次 l，直到 ctx 被取消
+// 确认失去了锁，或者连续 3 次续约失败的时候，会把错误发到返回的 channel 上，并且不再续约，
+// 这时候要立刻停止需要锁保护的任务。ctx 被取消的时候 channel 会被关闭。
+// interval 必须小于锁的过期时间的三分之一，保证连续失败 3 次之前锁都还没有过期
+func AutoRefresh(ctx context.Context, l Lock, interval time.Duration) <-chan error {
+	return dlock.AutoRefresh(ctx, l, interval)
+}
+
+// NewGormLockClient 基于关系型数据库的分布式锁，需要额外的 distributed_locks 表
+func NewGormLockClient(db *gorm.DB) LockClient {
+	return glock.NewClient(db)
+}
+
+// NewRedisLockClient 基于 Redis 的分布式锁
+func NewRedisLockClient(rdb redis.Cmdable) LockClient {
+	return rlock.NewClient(rdb)
+}
+
+// NewRedlockClient 基于多个相互独立的 Redis 实例的分布式锁，也就是 Redlock 算法
+// 一般来说是 3 个或者 5 个实例，超过半数的实例加锁成功才算加锁成功
+func NewRedlockClient(clients ...redis.Cmdable) LockClient {
+	return redlock.NewClient(clients)
+}
+
+// NewEtcdLockClient 基于 etcd 的分布式锁
+func NewEtcdLockClient(client *clientv3.Client) LockClient {
+	return elock.NewClient(client)
+}
+
+// NewMySQLLockClient 基于 MySQL GET_LOCK 的分布式锁，不需要额外的表
+// 每一个持有中的锁都会独占 db 中的一个连接
+func NewMySQLLockClient(db *sql.DB) LockClient {
+	return slock.NewClient(db, slock.MySQL)
+}
+
+// NewPostgresLockClient 基于 PostgreSQL advisory lock 的分布式锁，不需要额外的表
+// 每一个持有中的锁都会独占 db 中的一个连接
+func NewPostgresLockClient(db *sql.DB) LockClient {
+	return slock.NewClient(db, slock.PostgreSQL)
+}
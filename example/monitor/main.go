@@ -14,9 +14,11 @@ import (
 	redis2 "github.com/redis/go-redis/v9"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"time"
 )
 
 // 这个是模拟业务在非分库分表的情况下，引入了依赖之后，直接在本地启动了管理后台的例子
@@ -49,12 +51,10 @@ func main() {
 	// 在业务中使用的订单服务
 	order := noshardin_order.NewOrderService(db, msgSvc)
 	println(order)
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		// 启动补偿任务
-		msgSvc.StartAsyncTask(ctx)
-		//println(ctx == nil)
-	}()
+	// 启动补偿任务
+	if err := msgSvc.Start(context.Background()); err != nil {
+		panic(err)
+	}
 
 	go func() {
 		// 这个步骤是可选的。也就是你的业务可以只使用 msgSvc
@@ -66,8 +66,18 @@ func main() {
 		_ = adminSvc.Register("order", msgSvc)
 		// 额外注册一个作为默认的，这一步也可以忽略
 		_ = adminSvc.Register("", msgSvc)
+		// 记录重试、修改和删除的审计日志，可以在 /local_msg/audit/list 查询
+		auditSink, err := lmsg.NewGormAuditSink(db)
+		if err != nil {
+			panic(err)
+		}
+		adminSvc.AuditSink = auditSink
 		// 这里我没有使用默认的 GIN 的Session 机制，而是使用我自己设计的 Session 机制
 		session.SetDefaultProvider(redis.NewSessionProvider(rdb, "test_key"))
+		// 这里为了方便演示，没有开启认证。生产环境下应该开启，例如说使用 session，
+		// 并且在登录的时候往 Claims.Data["local_msg_roles"] 里面放上 "order:operator" 这种角色：
+		// hdl := lmsg.NewAdminHandler(adminSvc,
+		// 	lmsg.WithAdminAuthenticator(lmsg.NewAdminSessionAuthenticator()))
 		hdl := lmsg.NewAdminHandler(adminSvc)
 		server := gin.Default()
 		// 跨域
@@ -82,6 +92,8 @@ func main() {
 			},
 		}))
 		hdl.RegisterRoutes(server)
+		// 存活探针和就绪探针
+		lmsg.NewHealthHandler(adminSvc).RegisterRoutes(server)
 		// 启动
 		server.Run(":8080")
 	}()
@@ -90,8 +102,12 @@ func main() {
 	signal.Notify(signalChan, os.Interrupt, os.Kill)
 	// 收到了信号
 	<-signalChan
-	// 调用 Cancel 就会停止补偿任务
-	cancel()
+	// 停止补偿任务，最多等 10 秒让正在发送的消息发送完
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := msgSvc.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
 }
 
 func initPrometheus() {
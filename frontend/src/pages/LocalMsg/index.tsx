@@ -31,6 +31,10 @@ const statusOptions = [
     label: "失败",
     value: 2,
   },
+  {
+    label: "已放弃",
+    value: 5,
+  },
 ]
 
 const retryMsg = (biz: string, db: string, table: string, id: number) => {
@@ -102,6 +106,8 @@ const columns = [
           return "成功"
         case 2:
           return "失败"
+        case 5:
+          return "已放弃"
         default:
           return "未知状态"
       }
@@ -176,7 +182,7 @@ const Page: React.FC<Props> = (props) => {
     query.limit = params.pageSize
     query.status = query?.status || -1
     const res = await msgList(query.biz, query.db, query);
-    const data = res?.data?.data || []
+    const data = res?.data?.data?.msgs || []
 
     return {
       data: data,
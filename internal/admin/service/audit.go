@@ -0,0 +1,216 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ecodeclub/ekit/slice"
+	"github.com/meoying/local-msg-go/internal/dao"
+	"gorm.io/gorm"
+	"log/slog"
+	"time"
+)
+
+// AuditAction 管理后台对消息的修改
+type AuditAction string
+
+const (
+	AuditRetry       AuditAction = "retry"
+	AuditUpdate      AuditAction = "update"
+	AuditDelete      AuditAction = "delete"
+	AuditBulkReset   AuditAction = "bulk_" + AuditAction(BulkReset)
+	AuditBulkResend  AuditAction = "bulk_" + AuditAction(BulkResend)
+	AuditBulkAbandon AuditAction = "bulk_" + AuditAction(BulkAbandon)
+)
+
+// AuditStatusDeleted 消息被删除之后的 AfterStatus
+const AuditStatusDeleted int8 = -1
+
+// AuditLog 谁在什么时候修改了哪一条消息
+type AuditLog struct {
+	Id     int64
+	Actor  string
+	Biz    string
+	DB     string
+	Table  string
+	MsgId  int64
+	Action AuditAction
+	// BeforeStatus 和 AfterStatus 操作前后消息的状态
+	BeforeStatus int8
+	AfterStatus  int8
+	// Diff 消息内容中变化了的字段，例如 {"topic":{"before":"a","after":"b"}}，没有变化的时候为空
+	Diff  json.RawMessage
+	Ctime time.Time
+}
+
+type AuditQuery = dao.AuditQuery
+
+// AuditSink 保存审计日志，例如说保存到数据库，或者发送到公司的审计系统
+type AuditSink interface {
+	Record(ctx context.Context, logs []AuditLog) error
+}
+
+// AuditQuerier 查询审计日志，AuditSink 实现了这个接口的时候才能通过管理后台查询
+type AuditQuerier interface {
+	ListAudits(ctx context.Context, q AuditQuery) ([]AuditLog, error)
+}
+
+// ErrAuditNotQueryable 没有设置 AuditSink，或者它没有实现 AuditQuerier
+var ErrAuditNotQueryable = errors.New("审计日志不支持查询")
+
+// GormAuditSink 审计日志保存在 local_msg_audit_logs 表中
+type GormAuditSink struct {
+	dao *dao.AuditDAO
+}
+
+func NewGormAuditSink(db *gorm.DB) *GormAuditSink {
+	return &GormAuditSink{dao: dao.NewAuditDAO(db)}
+}
+
+// InitTable 初始化 local_msg_audit_logs 表
+func (s *GormAuditSink) InitTable() error {
+	return s.dao.InitTable()
+}
+
+func (s *GormAuditSink) Record(ctx context.Context, logs []AuditLog) error {
+	return s.dao.Insert(ctx, slice.Map(logs, func(idx int, src AuditLog) dao.AuditLog {
+		return dao.AuditLog{
+			Actor:        src.Actor,
+			Biz:          src.Biz,
+			MsgDB:        src.DB,
+			MsgTable:     src.Table,
+			MsgId:        src.MsgId,
+			Action:       string(src.Action),
+			BeforeStatus: src.BeforeStatus,
+			AfterStatus:  src.AfterStatus,
+			Diff:         src.Diff,
+			Ctime:        src.Ctime.UnixMilli(),
+		}
+	}))
+}
+
+func (s *GormAuditSink) ListAudits(ctx context.Context, q AuditQuery) ([]AuditLog, error) {
+	logs, err := s.dao.List(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return slice.Map(logs, func(idx int, src dao.AuditLog) AuditLog {
+		return AuditLog{
+			Id:           src.Id,
+			Actor:        src.Actor,
+			Biz:          src.Biz,
+			DB:           src.MsgDB,
+			Table:        src.MsgTable,
+			MsgId:        src.MsgId,
+			Action:       AuditAction(src.Action),
+			BeforeStatus: src.BeforeStatus,
+			AfterStatus:  src.AfterStatus,
+			Diff:         src.Diff,
+			Ctime:        time.UnixMilli(src.Ctime),
+		}
+	}), nil
+}
+
+// DefaultAuditLimit 查询审计日志的时候没有指定 Limit，一次返回多少条
+const DefaultAuditLimit = 10
+
+// ListAudits 查询审计日志，按照 id 降序。q.Limit 小于等于 0 的时候使用 DefaultAuditLimit
+func (svc *LocalService) ListAudits(ctx context.Context, q AuditQuery) ([]AuditLog, error) {
+	querier, ok := svc.AuditSink.(AuditQuerier)
+	if !ok {
+		return nil, ErrAuditNotQueryable
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultAuditLimit
+	}
+	return querier.ListAudits(ctx, q)
+}
+
+// audit 重新查询 before 中的消息，对比之后记录审计日志。查不到的消息认为已经被删除了
+// 消息已经被修改了，所以记录失败的时候只输出日志，不返回错误
+func (svc *LocalService) audit(ctx context.Context, actor, biz, db, table string,
+	action AuditAction, before []dao.LocalMsg) {
+	if svc.AuditSink == nil || len(before) == 0 {
+		return
+	}
+	ids := slice.Map(before, func(idx int, src dao.LocalMsg) int64 {
+		return src.Id
+	})
+	msgDAO, err := svc.getDAO(biz, db)
+	var afters []dao.LocalMsg
+	if err == nil {
+		afters, err = msgDAO.ListByIds(ctx, table, ids, nil)
+	}
+	if err != nil {
+		// 不能因此认为消息被删除了，只能沿用修改之前的
+		slog.Error("查询修改之后的消息失败，审计日志中修改之后的状态和内容不准确",
+			slog.String("action", string(action)), slog.Any("err", err))
+		afters = before
+	}
+	afterMap := make(map[int64]dao.LocalMsg, len(afters))
+	for _, m := range afters {
+		afterMap[m.Id] = m
+	}
+	now := time.Now()
+	logs := make([]AuditLog, 0, len(before))
+	for _, b := range before {
+		log := AuditLog{
+			Actor:        actor,
+			Biz:          biz,
+			DB:           db,
+			Table:        table,
+			MsgId:        b.Id,
+			Action:       action,
+			BeforeStatus: b.Status,
+			AfterStatus:  AuditStatusDeleted,
+			Ctime:        now,
+		}
+		var afterData []byte
+		if a, ok := afterMap[b.Id]; ok {
+			log.AfterStatus = a.Status
+			afterData = a.Data
+		}
+		log.Diff = payloadDiff(b.Data, afterData)
+		logs = append(logs, log)
+	}
+	if err = svc.AuditSink.Record(ctx, logs); err != nil {
+		slog.Error("记录审计日志失败",
+			slog.String("action", string(action)),
+			slog.String("actor", actor),
+			slog.Any("ids", ids),
+			slog.Any("err", err))
+	}
+}
+
+// payloadDiff 对比消息内容中的每一个字段，删除的时候 after 为 nil
+func payloadDiff(before, after []byte) json.RawMessage {
+	if bytes.Equal(before, after) {
+		return nil
+	}
+	var b, a map[string]json.RawMessage
+	_ = json.Unmarshal(before, &b)
+	_ = json.Unmarshal(after, &a)
+	keys := make(map[string]struct{}, len(b)+len(a))
+	for k := range b {
+		keys[k] = struct{}{}
+	}
+	for k := range a {
+		keys[k] = struct{}{}
+	}
+	type change struct {
+		Before json.RawMessage `json:"before,omitempty"`
+		After  json.RawMessage `json:"after,omitempty"`
+	}
+	diff := make(map[string]change)
+	for k := range keys {
+		if !bytes.Equal(b[k], a[k]) {
+			diff[k] = change{Before: b[k], After: a[k]}
+		}
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+	res, _ := json.Marshal(diff)
+	return res
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ecodeclub/ekit/slice"
+	"github.com/meoying/local-msg-go/internal/dao"
+	"golang.org/x/sync/errgroup"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBulkTooLarge 一次批量操作的消息数量超过了 LocalService.BulkLimit
+var ErrBulkTooLarge = errors.New("超过了单次批量操作的上限")
+
+// BulkAction 批量操作的类型
+type BulkAction string
+
+const (
+	// BulkReset 重置为待发送，并且清空发送次数，交给补偿任务重新发送
+	BulkReset BulkAction = "reset"
+	// BulkResend 立刻同步重新发送
+	BulkResend BulkAction = "resend"
+	// BulkAbandon 放弃，之后不会再发送
+	BulkAbandon BulkAction = "abandon"
+)
+
+// bulkStatuses 批量操作只会修改待发送和发送失败的消息
+var bulkStatuses = []int8{dao.MsgStatusInit, dao.MsgStatusFail}
+
+// BulkReq 批量操作
+type BulkReq struct {
+	Action BulkAction
+	// Ids 不为空的时候按照 id 操作，此时 Query 里面只有 Table 生效
+	Ids []int64
+	// Query 筛选条件，忽略 Offset，按照 id 升序选中消息
+	Query Query
+	// DryRun 只统计，不修改
+	DryRun bool
+	// Limit 这一次最多处理多少条，为 0 或者超过 LocalService.BulkLimit 的时候使用 BulkLimit
+	Limit int
+	// Operator 谁执行的，记录在审计日志中。resend 的时候还会记录在消息上，为空的时候不记录
+	Operator string
+}
+
+// BulkResult 批量操作的结果
+type BulkResult struct {
+	// Total 符合条件的消息总数，可以据此判断还需要调用几次
+	Total int64
+	// Matched 这一次选中的消息数量
+	Matched int
+	// Affected 实际修改的数量，resend 的时候是发送成功的数量
+	Affected int64
+	// Failed resend 的时候发送失败的数量
+	Failed int64
+}
+
+// Bulk 批量修改待发送和发送失败的消息，已经发送成功的消息不会被修改
+func (svc *LocalService) Bulk(ctx context.Context, biz, db string, req BulkReq) (BulkResult, error) {
+	limit := svc.BulkLimit
+	if req.Limit > 0 && req.Limit < limit {
+		limit = req.Limit
+	}
+	msgDAO, err := svc.getDAO(biz, db)
+	if err != nil {
+		return BulkResult{}, err
+	}
+	table := req.Query.Table
+	var (
+		res  BulkResult
+		msgs []dao.LocalMsg
+	)
+	if len(req.Ids) > 0 {
+		if len(req.Ids) > limit {
+			return BulkResult{}, fmt.Errorf("%w, 上限 %d", ErrBulkTooLarge, limit)
+		}
+		msgs, err = msgDAO.ListByIds(ctx, table, req.Ids, bulkStatuses)
+		res.Total = int64(len(msgs))
+	} else {
+		res.Total, err = msgDAO.CountByQuery(ctx, req.Query, bulkStatuses)
+		if err != nil {
+			return BulkResult{}, err
+		}
+		q := req.Query
+		q.Limit = limit
+		msgs, err = msgDAO.ListByQuery(ctx, q, bulkStatuses)
+	}
+	if err != nil {
+		return BulkResult{}, err
+	}
+	res.Matched = len(msgs)
+	if req.DryRun || len(msgs) == 0 {
+		return res, nil
+	}
+
+	ids := slice.Map(msgs, func(idx int, src dao.LocalMsg) int64 {
+		return src.Id
+	})
+	// resend 的时候会修改 msgs，所以先保存一份
+	before := slices.Clone(msgs)
+	now := time.Now().UnixMilli()
+	switch req.Action {
+	case BulkReset:
+		res.Affected, err = msgDAO.UpdateStatus(ctx, table, ids, bulkStatuses, map[string]any{
+			"status":     dao.MsgStatusInit,
+			"send_times": 0,
+			"utime":      now,
+		})
+	case BulkAbandon:
+		res.Affected, err = msgDAO.UpdateStatus(ctx, table, ids, bulkStatuses, map[string]any{
+			"status": dao.MsgStatusAbandoned,
+			"utime":  now,
+		})
+	case BulkResend:
+		res.Affected, res.Failed = svc.resend(ctx, biz, db, table, msgs, req.Operator)
+	default:
+		return BulkResult{}, fmt.Errorf("未知的批量操作 %s", req.Action)
+	}
+	// 选中的每一条消息都会记录，修改之后的状态以重新查询的结果为准
+	svc.audit(ctx, req.Operator, biz, db, table, "bulk_"+AuditAction(req.Action), before)
+	return res, err
+}
+
+// resend 同时最多有 BatchSize 条消息在发送
+func (svc *LocalService) resend(ctx context.Context, biz, db, table string,
+	msgs []dao.LocalMsg, operator string) (success, failed int64) {
+	s := svc.svcs[biz]
+	var (
+		eg        errgroup.Group
+		succCnt   atomic.Int64
+		failedCnt atomic.Int64
+	)
+	eg.SetLimit(max(s.BatchSize, 1))
+	for i := range msgs {
+		m := &msgs[i]
+		eg.Go(func() error {
+			if err := s.Resend(ctx, db, table, m, operator); err != nil {
+				failedCnt.Add(1)
+			} else {
+				succCnt.Add(1)
+			}
+			return nil
+		})
+	}
+	_ = eg.Wait()
+	return succCnt.Load(), failedCnt.Load()
+}
@@ -3,11 +3,15 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/IBM/sarama"
 	"github.com/ecodeclub/ekit/slice"
 	"github.com/meoying/local-msg-go/internal/dao"
 	"github.com/meoying/local-msg-go/internal/msg"
 	"github.com/meoying/local-msg-go/internal/service"
+	"gorm.io/gorm"
+	"slices"
 	"time"
 )
 
@@ -16,13 +20,30 @@ type LocalService struct {
 	svcs     map[string]*service.ShardingService
 	daos     map[string]map[string]*dao.MsgDAO
 	producer sarama.SyncProducer
+	// BulkLimit 一次批量操作最多处理多少条消息
+	BulkLimit int
+	// Concurrency 统计或者跨表查询的时候，同时最多查询多少张表
+	Concurrency int
+	// StatsTimeout 统计一张表最多花多少时间，超时的表会返回错误
+	StatsTimeout time.Duration
+	// StatsMaxCount 统计的时候每个数量最多统计到多少条，避免积压严重的时候扫描整张表
+	StatsMaxCount int
+	// AuditSink 记录管理后台对消息的修改，为 nil 的时候不记录
+	AuditSink AuditSink
+	// shardingInfos 把请求里面的分库分表信息解析成 ShardingFunc 的参数，key 是 biz
+	shardingInfos map[string]func(raw json.RawMessage) (any, error)
 }
 
 func NewLocalService(producer sarama.SyncProducer) *LocalService {
 	return &LocalService{
-		daos:     make(map[string]map[string]*dao.MsgDAO),
-		producer: producer,
-		svcs:     make(map[string]*service.ShardingService, 4),
+		daos:          make(map[string]map[string]*dao.MsgDAO),
+		producer:      producer,
+		svcs:          make(map[string]*service.ShardingService, 4),
+		BulkLimit:     1000,
+		Concurrency:   8,
+		StatsTimeout:  time.Second * 3,
+		StatsMaxCount: 10000,
+		shardingInfos: make(map[string]func(raw json.RawMessage) (any, error)),
 	}
 }
 
@@ -43,49 +64,201 @@ func (svc *LocalService) RegisterShardingSvc(biz string, s *service.ShardingServ
 	return nil
 }
 
+// Bizs 所有注册的业务
+func (svc *LocalService) Bizs() []string {
+	res := make([]string, 0, len(svc.svcs))
+	for biz := range svc.svcs {
+		res = append(res, biz)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// RegisterShardingInfo 注册 biz 的分库分表信息的解析方法，例如说把 JSON 中的买家 ID 解析成 int64，
+// 这样跨表查询的时候，给出了分库分表信息就只需要查询一张表
+func (svc *LocalService) RegisterShardingInfo(biz string, decode func(raw json.RawMessage) (any, error)) {
+	svc.shardingInfos[biz] = decode
+}
+
+// ErrNotRetryable 已经发送成功、正在迁移、已经迁移或者已经放弃的消息不能重试
+var ErrNotRetryable = errors.New("消息已经发送成功、正在迁移、已经迁移或者已经放弃，不能重试")
+
+// unretryableStatuses 发送成功的消息再发送一次就重复了，迁移的消息由目标表负责发送，放弃的消息不应该再发送
+var unretryableStatuses = []int8{dao.MsgStatusSuccess,
+	dao.MsgStatusMigrating, dao.MsgStatusMigrated, dao.MsgStatusAbandoned}
+
+// Retry 重新发送这条消息，并且更新它的发送次数和状态
+// operator 是谁重试的，为空的时候不记录
 func (svc *LocalService) Retry(ctx context.Context,
 	biz, db, table string,
-	id int64) error {
-	msgDAO := svc.getDAO(biz, db)
+	id int64, operator string) error {
+	msgDAO, err := svc.getDAO(biz, db)
+	if err != nil {
+		return err
+	}
 	localMsg, err := msgDAO.Get(ctx, table, id)
 	if err != nil {
 		return err
 	}
-	data := string(localMsg.Data)
-	var m msg.Msg
-	err = json.Unmarshal([]byte(data), &m)
+	if slices.Contains(unretryableStatuses, localMsg.Status) {
+		return ErrNotRetryable
+	}
+	// 发送的时候会修改 localMsg，所以先保存一份
+	before := localMsg
+	err = svc.svcs[biz].Resend(ctx, db, table, &localMsg, operator)
+	if err != nil {
+		// 重试失败的时候不记录审计日志，管理后台会直接返回错误
+		return err
+	}
+	svc.audit(ctx, operator, biz, db, table, AuditRetry, []dao.LocalMsg{before})
+	return nil
+}
+
+// ErrNotEditable 已经发送成功，或者正在扩容迁移的消息不能修改
+var ErrNotEditable = errors.New("只能修改没有发送成功的消息")
+
+// editableStatuses 可以修改的消息状态
+var editableStatuses = []int8{dao.MsgStatusInit, dao.MsgStatusFail, dao.MsgStatusAbandoned}
+
+// Get 返回一条消息，不存在的时候返回 gorm.ErrRecordNotFound
+func (svc *LocalService) Get(ctx context.Context, biz, db, table string, id int64) (LocalMsg, error) {
+	msgDAO, err := svc.getDAO(biz, db)
+	if err != nil {
+		return LocalMsg{}, err
+	}
+	res, err := msgDAO.Get(ctx, table, id)
+	if err != nil {
+		return LocalMsg{}, err
+	}
+	return newLocalMsg(res), nil
+}
+
+// Update 修改消息的内容，例如说修正格式错误的内容或者错误的 topic，之后可以通过 Retry 重新发送
+// 原本的内容会保存在 original_data 列上，AutoMigrate 会创建这一列，手动建表的时候参考 .scripts/mysql/init.sql
+// m 中没有 key 或者链路信息的时候，沿用原本的。operator 是谁修改的，记录在审计日志中
+func (svc *LocalService) Update(ctx context.Context, biz, db, table string, id int64,
+	m msg.Msg, operator string) error {
+	return svc.update(ctx, biz, db, table, id, m, -1, operator)
+}
+
+// UpdateAndRetry 修改消息的内容之后立刻重新发送
+// 修改的同时把状态重置为待发送，所以已经放弃的消息也可以修改之后重新发送
+func (svc *LocalService) UpdateAndRetry(ctx context.Context, biz, db, table string, id int64,
+	m msg.Msg, operator string) error {
+	err := svc.update(ctx, biz, db, table, id, m, dao.MsgStatusInit, operator)
+	if err != nil {
+		return err
+	}
+	return svc.Retry(ctx, biz, db, table, id, operator)
+}
+
+// update status 小于 0 的时候不修改消息的状态
+func (svc *LocalService) update(ctx context.Context, biz, db, table string, id int64,
+	m msg.Msg, status int8, operator string) error {
+	msgDAO, err := svc.getDAO(biz, db)
+	if err != nil {
+		return err
+	}
+	old, err := msgDAO.Get(ctx, table, id)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(editableStatuses, old.Status) {
+		return ErrNotEditable
+	}
+	if m.Topic == "" {
+		return errors.New("topic 不能为空")
+	}
+	if m.Key == "" {
+		m.Key = old.Key
+	}
+	if m.Trace == nil {
+		var oldMsg msg.Msg
+		_ = json.Unmarshal(old.Data, &oldMsg)
+		m.Trace = oldMsg.Trace
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	cnt, err := msgDAO.UpdateData(ctx, table, id, editableStatuses, m.Key, data, old.Data, status)
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		// 查询之后，补偿任务把它发送成功了
+		return ErrNotEditable
+	}
+	svc.audit(ctx, operator, biz, db, table, AuditUpdate, []dao.LocalMsg{old})
+	return nil
+}
+
+// Delete 删除消息，例如说测试的时候产生的垃圾消息。不存在的时候返回 gorm.ErrRecordNotFound
+// 删除之前的内容会记录在审计日志中
+func (svc *LocalService) Delete(ctx context.Context, biz, db, table string, id int64, operator string) error {
+	msgDAO, err := svc.getDAO(biz, db)
+	if err != nil {
+		return err
+	}
+	old, err := msgDAO.Get(ctx, table, id)
+	if err != nil {
+		return err
+	}
+	cnt, err := msgDAO.Delete(ctx, table, id)
 	if err != nil {
 		return err
 	}
-	return svc.svcs[biz].SendMsg(ctx, db, table, m)
+	if cnt == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	svc.audit(ctx, operator, biz, db, table, AuditDelete, []dao.LocalMsg{old})
+	return nil
 }
 
 // ListMsgs 返回未发送的消息
 func (svc *LocalService) ListMsgs(
 	ctx context.Context,
 	biz, db string, query Query) ([]LocalMsg, error) {
-	msgDAO := svc.getDAO(biz, db)
+	msgDAO, err := svc.getDAO(biz, db)
+	if err != nil {
+		return nil, err
+	}
 	res, err := msgDAO.List(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 	return slice.Map(res, func(idx int, src dao.LocalMsg) LocalMsg {
-		var m msg.Msg
-		_ = json.Unmarshal(src.Data, &m)
-		return LocalMsg{
-			Id:        src.Id,
-			Msg:       m,
-			Key:       src.Key,
-			Status:    src.Status,
-			SendTimes: src.SendTimes,
-			Ctime:     time.UnixMilli(src.Ctime),
-			Utime:     time.UnixMilli(src.Utime),
-		}
+		return newLocalMsg(src)
 	}), nil
 }
 
-func (svc *LocalService) getDAO(biz, db string) *dao.MsgDAO {
-	return svc.daos[biz][db]
+func newLocalMsg(src dao.LocalMsg) LocalMsg {
+	var m msg.Msg
+	_ = json.Unmarshal(src.Data, &m)
+	return LocalMsg{
+		Id:        src.Id,
+		Msg:       m,
+		Key:       src.Key,
+		Status:    src.Status,
+		SendTimes: src.SendTimes,
+		Ctime:     time.UnixMilli(src.Ctime),
+		Utime:     time.UnixMilli(src.Utime),
+
+		OriginalData: src.OriginalData,
+	}
+}
+
+// getDAO biz 或者 db 没有注册的时候返回错误
+func (svc *LocalService) getDAO(biz, db string) (*dao.MsgDAO, error) {
+	daos, ok := svc.daos[biz]
+	if !ok {
+		return nil, fmt.Errorf("没有注册的业务 %s", biz)
+	}
+	msgDAO, ok := daos[db]
+	if !ok {
+		return nil, fmt.Errorf("没有这个数据库 %s", db)
+	}
+	return msgDAO, nil
 }
 
 type LocalMsg struct {
@@ -96,4 +269,15 @@ type LocalMsg struct {
 	SendTimes int
 	Ctime     time.Time
 	Utime     time.Time
+	// OriginalData 第一次修改之前的内容，没有修改过的时候为 nil
+	OriginalData []byte
+}
+
+// Health 返回每个业务的补偿任务在当前节点上的健康状况
+func (svc *LocalService) Health() map[string]service.Health {
+	res := make(map[string]service.Health, len(svc.svcs))
+	for biz, s := range svc.svcs {
+		res[biz] = s.Health()
+	}
+	return res
 }
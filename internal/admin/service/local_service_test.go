@@ -2,17 +2,23 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/IBM/sarama"
 	"github.com/meoying/local-msg-go/internal/dao"
 	msg2 "github.com/meoying/local-msg-go/internal/msg"
 	"github.com/meoying/local-msg-go/internal/service"
 	"github.com/meoying/local-msg-go/internal/sharding"
 	"github.com/meoying/local-msg-go/internal/test"
+	"github.com/meoying/local-msg-go/internal/test/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"go.uber.org/mock/gomock"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"strings"
 	"testing"
 	"time"
 )
@@ -138,6 +144,33 @@ func (s *LocalServiceTestSuite) TestList() {
 				s.MockLocalMsg(3, 10086, nil),
 			},
 		},
+		{
+			name: "按照 id 翻页",
+			before: func(t *testing.T) {
+				msgs := []dao.LocalMsg{
+					s.MockDAOMsg(1, 123),
+					s.MockDAOMsg(2, 123),
+					s.MockDAOMsg(3, 123),
+					s.MockDAOMsg(4, 123),
+				}
+				err := s.db00.Table("local_msgs_tab_00").Create(&msgs).Error
+				require.NoError(s.T(), err)
+			},
+			biz: "test",
+			db:  "orders_db_00",
+			query: Query{
+				// 有 cursor 的时候忽略 offset
+				Offset: 100,
+				Cursor: 4,
+				Limit:  2,
+				Table:  "local_msgs_tab_00",
+				Status: -1,
+			},
+			wantRes: []LocalMsg{
+				s.MockLocalMsg(3, 123, nil),
+				s.MockLocalMsg(2, 123, nil),
+			},
+		},
 	}
 
 	svc := NewLocalService(nil)
@@ -156,6 +189,608 @@ func (s *LocalServiceTestSuite) TestList() {
 	}
 }
 
+func (s *LocalServiceTestSuite) TestBulk() {
+	table := "local_msgs_tab_00"
+	testCases := []struct {
+		name   string
+		req    BulkReq
+		before func(t *testing.T)
+		after  func(t *testing.T)
+
+		wantRes BulkResult
+		wantErr error
+	}{
+		{
+			name: "按照条件重置",
+			before: func(t *testing.T) {
+				s.createMsgs(t, table, dao.MsgStatusFail, 1, 2, 3)
+				s.createMsgs(t, table, dao.MsgStatusSuccess, 4)
+			},
+			req: BulkReq{
+				Action: BulkReset,
+				Query:  Query{Table: table, Status: -1},
+				Limit:  2,
+			},
+			after: func(t *testing.T) {
+				msgs := s.findMsgs(t, table)
+				for _, id := range []int64{1, 2} {
+					assert.Equal(t, dao.MsgStatusInit, msgs[id].Status)
+					assert.Equal(t, 0, msgs[id].SendTimes)
+				}
+				assert.Equal(t, dao.MsgStatusFail, msgs[3].Status)
+				assert.Equal(t, dao.MsgStatusSuccess, msgs[4].Status)
+			},
+			wantRes: BulkResult{Total: 3, Matched: 2, Affected: 2},
+		},
+		{
+			name: "dry run",
+			before: func(t *testing.T) {
+				s.createMsgs(t, table, dao.MsgStatusFail, 1, 2)
+				s.createMsgs(t, table, dao.MsgStatusSuccess, 3)
+			},
+			req: BulkReq{
+				Action: BulkAbandon,
+				Ids:    []int64{1, 2, 3},
+				Query:  Query{Table: table},
+				DryRun: true,
+			},
+			after: func(t *testing.T) {
+				msgs := s.findMsgs(t, table)
+				assert.Equal(t, dao.MsgStatusFail, msgs[1].Status)
+				assert.Equal(t, dao.MsgStatusFail, msgs[2].Status)
+			},
+			wantRes: BulkResult{Total: 2, Matched: 2},
+		},
+		{
+			name: "按照 id 放弃",
+			before: func(t *testing.T) {
+				s.createMsgs(t, table, dao.MsgStatusFail, 1, 2)
+				s.createMsgs(t, table, dao.MsgStatusSuccess, 3)
+			},
+			req: BulkReq{
+				Action: BulkAbandon,
+				Ids:    []int64{2, 3},
+				Query:  Query{Table: table},
+			},
+			after: func(t *testing.T) {
+				msgs := s.findMsgs(t, table)
+				assert.Equal(t, dao.MsgStatusFail, msgs[1].Status)
+				assert.Equal(t, dao.MsgStatusAbandoned, msgs[2].Status)
+				assert.Equal(t, dao.MsgStatusSuccess, msgs[3].Status)
+			},
+			wantRes: BulkResult{Total: 1, Matched: 1, Affected: 1},
+		},
+		{
+			name: "重新发送",
+			before: func(t *testing.T) {
+				s.createMsgs(t, table, dao.MsgStatusFail, 1, 2)
+			},
+			req: BulkReq{
+				Action: BulkResend,
+				Query:  Query{Table: table, Status: dao.MsgStatusFail},
+			},
+			after: func(t *testing.T) {
+				msgs := s.findMsgs(t, table)
+				assert.Equal(t, dao.MsgStatusSuccess, msgs[1].Status)
+				assert.Equal(t, 4, msgs[1].SendTimes)
+				assert.Equal(t, dao.MsgStatusFail, msgs[2].Status)
+			},
+			wantRes: BulkResult{Total: 2, Matched: 2, Affected: 1, Failed: 1},
+		},
+		{
+			name:   "超过上限",
+			before: func(t *testing.T) {},
+			req: BulkReq{
+				Action: BulkAbandon,
+				Ids:    []int64{1, 2, 3},
+				Query:  Query{Table: table},
+				Limit:  2,
+			},
+			after:   func(t *testing.T) {},
+			wantErr: ErrBulkTooLarge,
+		},
+	}
+
+	ctrl := gomock.NewController(s.T())
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	producer.EXPECT().SendMessage(gomock.Any()).DoAndReturn(func(pmsg *sarama.ProducerMessage) (int32, int64, error) {
+		if strings.HasSuffix(string(pmsg.Key.(sarama.StringEncoder)), "success") {
+			return 1, 1, nil
+		}
+		return 0, 0, errors.New("mock error")
+	}).AnyTimes()
+	svc := NewLocalService(producer)
+	err := svc.RegisterShardingSvc("test", service.NewShardingService(s.dbs, producer, nil, sharding.Sharding{}))
+	require.NoError(s.T(), err)
+	for _, tc := range testCases {
+		s.T().Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			tc.before(t)
+			res, err1 := svc.Bulk(ctx, "test", "orders_db_00", tc.req)
+			assert.ErrorIs(t, err1, tc.wantErr)
+			assert.Equal(t, tc.wantRes, res)
+			tc.after(t)
+		})
+		s.TearDownTest()
+	}
+}
+
+func (s *LocalServiceTestSuite) TestRetry() {
+	t := s.T()
+	table := "local_msgs_tab_00"
+	s.addColumn(t, table, "retried_by", "VARCHAR(64) NOT NULL DEFAULT ''")
+	s.createMsgs(t, table, dao.MsgStatusFail, 1, 2)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	producer.EXPECT().SendMessage(gomock.Any()).Return(int32(1), int64(1), nil)
+	producer.EXPECT().SendMessage(gomock.Any()).Return(int32(0), int64(0), errors.New("mock error"))
+	svc := NewLocalService(producer)
+	err := svc.RegisterShardingSvc("test", service.NewShardingService(s.dbs, producer, nil, sharding.Sharding{}, service.WithRetriedBy()))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 更新的是原本的那条消息，而不是插入一条新的
+	err = svc.Retry(ctx, "test", "orders_db_00", table, 1, "tom")
+	require.NoError(t, err)
+	err = svc.Retry(ctx, "test", "orders_db_00", table, 2, "")
+	require.Error(t, err)
+
+	msgs := s.findMsgs(t, table)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, dao.MsgStatusSuccess, msgs[1].Status)
+	assert.Equal(t, 4, msgs[1].SendTimes)
+	assert.Equal(t, dao.MsgStatusFail, msgs[2].Status)
+	assert.Equal(t, 4, msgs[2].SendTimes)
+
+	var retriedBy []string
+	err = s.db00.Table(table).Order("id ASC").Pluck("retried_by", &retriedBy).Error
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tom", ""}, retriedBy)
+
+	// 已经发送成功、迁移中、已经迁移和已经放弃的消息不会被发送
+	s.createMsgs(t, table, dao.MsgStatusMigrating, 3)
+	s.createMsgs(t, table, dao.MsgStatusMigrated, 4)
+	s.createMsgs(t, table, dao.MsgStatusAbandoned, 5)
+	for _, id := range []int64{1, 3, 4, 5} {
+		err = svc.Retry(ctx, "test", "orders_db_00", table, id, "tom")
+		assert.ErrorIs(t, err, ErrNotRetryable)
+	}
+}
+
+func (s *LocalServiceTestSuite) TestUpdate() {
+	table := "local_msgs_tab_00"
+	s.addColumn(s.T(), table, "original_data", "TEXT NULL")
+	testCases := []struct {
+		name   string
+		id     int64
+		msg    msg2.Msg
+		before func(t *testing.T)
+
+		wantErr error
+		// wantKey 为空的时候就是 msg.Key
+		wantKey      string
+		wantOriginal string
+	}{
+		{
+			name: "修改发送失败的消息",
+			id:   2,
+			msg:  msg2.Msg{Key: "2_fail", Topic: "order_paid", Content: "修正之后的内容"},
+			before: func(t *testing.T) {
+				s.createMsgs(t, table, dao.MsgStatusFail, 2)
+			},
+			wantOriginal: "这是内容",
+		},
+		{
+			name: "多次修改，保留最早的内容",
+			id:   2,
+			msg:  msg2.Msg{Key: "2_fail", Topic: "order_paid", Content: "修正之后的内容"},
+			before: func(t *testing.T) {
+				s.createMsgs(t, table, dao.MsgStatusFail, 2)
+				svc := s.newLocalService(t)
+				err := svc.Update(context.Background(), "test", "orders_db_00", table, 2,
+					msg2.Msg{Key: "2_fail", Topic: "order_created", Content: "第一次修改"}, "")
+				require.NoError(t, err)
+			},
+			wantOriginal: "这是内容",
+		},
+		{
+			name: "key 为空的时候沿用原本的",
+			id:   2,
+			msg:  msg2.Msg{Topic: "order_paid", Content: "修正之后的内容"},
+			before: func(t *testing.T) {
+				s.createMsgs(t, table, dao.MsgStatusFail, 2)
+			},
+			wantKey:      "2_fail",
+			wantOriginal: "这是内容",
+		},
+		{
+			name: "发送成功的消息不能修改",
+			id:   1,
+			msg:  msg2.Msg{Key: "1_success", Topic: "order_paid", Content: "修正之后的内容"},
+			before: func(t *testing.T) {
+				s.createMsgs(t, table, dao.MsgStatusSuccess, 1)
+			},
+			wantErr: ErrNotEditable,
+		},
+		{
+			name: "消息不存在",
+			id:   3,
+			msg:  msg2.Msg{Key: "3_success", Topic: "order_paid"},
+			before: func(t *testing.T) {
+			},
+			wantErr: gorm.ErrRecordNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		s.T().Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			tc.before(t)
+			svc := s.newLocalService(t)
+			err := svc.Update(ctx, "test", "orders_db_00", table, tc.id, tc.msg, "")
+			assert.ErrorIs(t, err, tc.wantErr)
+			if err != nil {
+				return
+			}
+			res, err := svc.Get(ctx, "test", "orders_db_00", table, tc.id)
+			require.NoError(t, err)
+			wantMsg := tc.msg
+			if tc.wantKey != "" {
+				wantMsg.Key = tc.wantKey
+			}
+			assert.Equal(t, wantMsg, res.Msg)
+			assert.Equal(t, wantMsg.Key, res.Key)
+			assert.Equal(t, dao.MsgStatusFail, res.Status)
+
+			var m msg2.Msg
+			require.NoError(t, json.Unmarshal(res.OriginalData, &m))
+			assert.Equal(t, tc.wantOriginal, m.Content)
+		})
+		s.TearDownTest()
+	}
+}
+
+func (s *LocalServiceTestSuite) TestUpdateAndRetry() {
+	t := s.T()
+	table := "local_msgs_tab_00"
+	s.addColumn(t, table, "original_data", "TEXT NULL")
+	s.createMsgs(t, table, dao.MsgStatusAbandoned, 1)
+	s.createMsgs(t, table, dao.MsgStatusSuccess, 2)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	producer.EXPECT().SendMessage(gomock.Any()).Return(int32(1), int64(1), nil)
+	svc := NewLocalService(producer)
+	err := svc.RegisterShardingSvc("test", service.NewShardingService(s.dbs, producer, nil, sharding.Sharding{}))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 已经放弃的消息修改之后也可以重新发送
+	err = svc.UpdateAndRetry(ctx, "test", "orders_db_00", table, 1,
+		msg2.Msg{Key: "1_abandoned", Topic: "order_paid", Content: "修正之后的内容"}, "tom")
+	require.NoError(t, err)
+	// 不能修改的消息，内容也不会被修改
+	err = svc.UpdateAndRetry(ctx, "test", "orders_db_00", table, 2,
+		msg2.Msg{Key: "2_success", Topic: "order_paid", Content: "修正之后的内容"}, "tom")
+	assert.ErrorIs(t, err, ErrNotEditable)
+
+	msgs := s.findMsgs(t, table)
+	assert.Equal(t, dao.MsgStatusSuccess, msgs[1].Status)
+	assert.Equal(t, 1, msgs[1].SendTimes)
+	var m msg2.Msg
+	require.NoError(t, json.Unmarshal(msgs[1].Data, &m))
+	assert.Equal(t, "修正之后的内容", m.Content)
+	assert.Equal(t, dao.MsgStatusSuccess, msgs[2].Status)
+	assert.Nil(t, msgs[2].OriginalData)
+}
+
+func (s *LocalServiceTestSuite) TestDelete() {
+	t := s.T()
+	table := "local_msgs_tab_00"
+	s.createMsgs(t, table, dao.MsgStatusFail, 1, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	svc := s.newLocalService(t)
+	err := svc.Delete(ctx, "test", "orders_db_00", table, 1, "")
+	require.NoError(t, err)
+	_, err = svc.Get(ctx, "test", "orders_db_00", table, 1)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	err = svc.Delete(ctx, "test", "orders_db_00", table, 1, "")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	assert.Len(t, s.findMsgs(t, table), 1)
+}
+
+func (s *LocalServiceTestSuite) TestAudit() {
+	t := s.T()
+	table := "local_msgs_tab_00"
+	s.addColumn(t, table, "retried_by", "VARCHAR(64) NOT NULL DEFAULT ''")
+	s.addColumn(t, table, "original_data", "TEXT NULL")
+	s.createMsgs(t, table, dao.MsgStatusFail, 1, 2, 3, 4, 5)
+	sink := NewGormAuditSink(s.db01)
+	require.NoError(t, sink.InitTable())
+	require.NoError(t, s.db01.Exec("TRUNCATE TABLE local_msg_audit_logs").Error)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	producer.EXPECT().SendMessage(gomock.Any()).Return(int32(1), int64(1), nil)
+	producer.EXPECT().SendMessage(gomock.Any()).Return(int32(0), int64(0), errors.New("mock error"))
+	svc := NewLocalService(producer)
+	err := svc.RegisterShardingSvc("test", service.NewShardingService(s.dbs, producer, nil, sharding.Sharding{}))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 没有设置 AuditSink 的时候不记录，也不能查询
+	require.NoError(t, svc.Delete(ctx, "test", "orders_db_00", table, 4, "tom"))
+	_, err = svc.ListAudits(ctx, AuditQuery{})
+	assert.ErrorIs(t, err, ErrAuditNotQueryable)
+
+	svc.AuditSink = sink
+	require.NoError(t, svc.Retry(ctx, "test", "orders_db_00", table, 1, "tom"))
+	require.NoError(t, svc.Update(ctx, "test", "orders_db_00", table, 2,
+		msg2.Msg{Key: "2_fail", Topic: "order_paid", Content: "这是内容"}, "jerry"))
+	_, err = svc.Bulk(ctx, "test", "orders_db_00", BulkReq{
+		Action:   BulkAbandon,
+		Ids:      []int64{3},
+		Query:    Query{Table: table},
+		Operator: "tom",
+	})
+	require.NoError(t, err)
+	require.NoError(t, svc.Delete(ctx, "test", "orders_db_00", table, 2, "jerry"))
+	// 重试失败的时候不记录
+	require.Error(t, svc.Retry(ctx, "test", "orders_db_00", table, 5, "tom"))
+
+	logs, err := svc.ListAudits(ctx, AuditQuery{Biz: "test"})
+	require.NoError(t, err)
+	require.Len(t, logs, 4)
+	for i := range logs {
+		assert.True(t, logs[i].Id > 0)
+		assert.True(t, logs[i].Ctime.UnixMilli() > 0)
+		assert.Equal(t, "orders_db_00", logs[i].DB)
+		assert.Equal(t, table, logs[i].Table)
+		logs[i].Id, logs[i].Ctime, logs[i].Biz, logs[i].DB, logs[i].Table = 0, time.Time{}, "", "", ""
+	}
+	assert.Equal(t, []AuditLog{
+		{
+			Actor: "jerry", MsgId: 2, Action: AuditDelete,
+			BeforeStatus: dao.MsgStatusFail, AfterStatus: AuditStatusDeleted,
+			Diff: json.RawMessage(`{"content":{"before":"这是内容"},"key":{"before":"2_fail"},"topic":{"before":"order_paid"}}`),
+		},
+		{
+			Actor: "tom", MsgId: 3, Action: AuditBulkAbandon,
+			BeforeStatus: dao.MsgStatusFail, AfterStatus: dao.MsgStatusAbandoned,
+		},
+		{
+			Actor: "jerry", MsgId: 2, Action: AuditUpdate,
+			BeforeStatus: dao.MsgStatusFail, AfterStatus: dao.MsgStatusFail,
+			Diff: json.RawMessage(`{"topic":{"before":"order_created","after":"order_paid"}}`),
+		},
+		{
+			Actor: "tom", MsgId: 1, Action: AuditRetry,
+			BeforeStatus: dao.MsgStatusFail, AfterStatus: dao.MsgStatusSuccess,
+		},
+	}, logs)
+
+	// 按照条件筛选，并且翻页
+	logs, err = svc.ListAudits(ctx, AuditQuery{Actor: "tom", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	assert.Equal(t, AuditBulkAbandon, logs[0].Action)
+	logs, err = svc.ListAudits(ctx, AuditQuery{Actor: "tom", Limit: 1, Cursor: logs[0].Id})
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	assert.Equal(t, AuditRetry, logs[0].Action)
+	logs, err = svc.ListAudits(ctx, AuditQuery{MsgId: 2, Action: string(AuditUpdate)})
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	assert.Equal(t, "jerry", logs[0].Actor)
+}
+
+func (s *LocalServiceTestSuite) TestStats() {
+	t := s.T()
+	s.createMsgs(t, "local_msgs_tab_00", dao.MsgStatusFail, 2, 4)
+	now := time.Now()
+	// 等待最久是按照创建时间算的，和最近有没有被处理过无关
+	pending := s.MockDAOMsg(1, now.Add(-time.Minute).UnixMilli())
+	pending.Utime = now.UnixMilli()
+	recent := s.MockDAOMsg(5, now.UnixMilli())
+	recent.Utime = 123
+	err := s.db00.Table("local_msgs_tab_00").Create([]dao.LocalMsg{pending, recent}).Error
+	require.NoError(t, err)
+	done := s.MockDAOMsg(3, 123)
+	done.Status = dao.MsgStatusSuccess
+	err = s.db01.Table("local_msgs_tab_01").Create(&done).Error
+	require.NoError(t, err)
+
+	svc := NewLocalService(nil)
+	err = svc.RegisterShardingSvc("test", service.NewShardingService(s.dbs, nil, nil, sharding.Sharding{
+		EffectiveTablesFunc: func() []sharding.Dst {
+			return []sharding.Dst{
+				{DB: "orders_db_01", Table: "local_msgs_tab_01"},
+				{DB: "orders_db_00", Table: "local_msgs_tab_00"},
+				{DB: "orders_db_00", Table: "local_msgs_tab_01"},
+				// 没有注册的数据库
+				{DB: "orders_db_02", Table: "local_msgs_tab_00"},
+			}
+		},
+	}))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res := svc.Stats(ctx)
+
+	require.Len(t, res.Tables, 4)
+	tab00 := res.Tables[0]
+	assert.Equal(t, sharding.Dst{DB: "orders_db_00", Table: "local_msgs_tab_00"}, tab00.Dst)
+	require.NoError(t, tab00.Err)
+	assert.Equal(t, map[int8]int64{dao.MsgStatusInit: 2, dao.MsgStatusFail: 2}, tab00.Status)
+	assert.Equal(t, map[int]int64{0: 2, 3: 2}, tab00.SendTimes)
+	assert.True(t, tab00.OldestPendingAge >= time.Minute && tab00.OldestPendingAge < time.Hour)
+
+	assert.Equal(t, sharding.Dst{DB: "orders_db_00", Table: "local_msgs_tab_01"}, res.Tables[1].Dst)
+	assert.Empty(t, res.Tables[1].Status)
+	assert.Zero(t, res.Tables[1].OldestPendingAge)
+
+	tab01 := res.Tables[2]
+	assert.Equal(t, map[int8]int64{dao.MsgStatusSuccess: 1}, tab01.Status)
+	assert.Empty(t, tab01.SendTimes)
+
+	assert.Equal(t, "orders_db_02", res.Tables[3].Dst.DB)
+	assert.Error(t, res.Tables[3].Err)
+
+	assert.Equal(t, map[int8]int64{
+		dao.MsgStatusInit:    2,
+		dao.MsgStatusFail:    2,
+		dao.MsgStatusSuccess: 1,
+	}, res.Status)
+	assert.False(t, tab00.Truncated)
+
+	// 达到了上限就不再统计
+	svc.StatsMaxCount = 1
+	res = svc.Stats(ctx, "test")
+	tab00 = res.Tables[0]
+	require.NoError(t, tab00.Err)
+	assert.True(t, tab00.Truncated)
+	assert.Equal(t, map[int8]int64{dao.MsgStatusInit: 1, dao.MsgStatusFail: 1}, tab00.Status)
+	assert.False(t, res.Tables[1].Truncated)
+}
+
+func (s *LocalServiceTestSuite) TestSearch() {
+	t := s.T()
+	// 每张表插入 3 条，ctime 交错，还有 ctime 相同的
+	ctimes := map[sharding.Dst][]int64{
+		{DB: "orders_db_00", Table: "local_msgs_tab_00"}: {100, 400, 700},
+		{DB: "orders_db_00", Table: "local_msgs_tab_01"}: {200, 500, 800},
+		{DB: "orders_db_01", Table: "local_msgs_tab_00"}: {300, 600, 800},
+	}
+	for dst, cs := range ctimes {
+		for i, ctime := range cs {
+			m := s.MockDAOMsg(int64(i+1), ctime)
+			err := s.dbs[dst.DB].Table(dst.Table).Create(&m).Error
+			require.NoError(t, err)
+		}
+	}
+	rules := sharding.Sharding{
+		ShardingFunc: func(info any) sharding.Dst {
+			buyer := info.(int64)
+			return sharding.Dst{
+				DB:    fmt.Sprintf("orders_db_%02d", buyer%4/2),
+				Table: fmt.Sprintf("local_msgs_tab_%02d", buyer%4%2),
+			}
+		},
+		EffectiveTablesFunc: func() []sharding.Dst {
+			return []sharding.Dst{
+				{DB: "orders_db_00", Table: "local_msgs_tab_00"},
+				{DB: "orders_db_00", Table: "local_msgs_tab_01"},
+				{DB: "orders_db_01", Table: "local_msgs_tab_00"},
+				{DB: "orders_db_01", Table: "local_msgs_tab_01"},
+			}
+		},
+	}
+	svc := NewLocalService(nil)
+	err := svc.RegisterShardingSvc("test", service.NewShardingService(s.dbs, nil, nil, rules))
+	require.NoError(t, err)
+	svc.RegisterShardingInfo("test", func(raw json.RawMessage) (any, error) {
+		var buyer int64
+		err := json.Unmarshal(raw, &buyer)
+		return buyer, err
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 所有的表，每页 4 条
+	var got []int64
+	req := SearchReq{Query: Query{Status: -1, Limit: 4}}
+	pages := 0
+	for {
+		res, err := svc.Search(ctx, "test", req)
+		require.NoError(t, err)
+		pages++
+		for _, m := range res.Msgs {
+			got = append(got, m.Ctime.UnixMilli())
+		}
+		if !res.HasMore {
+			break
+		}
+		req.Cursor = res.Cursor
+	}
+	assert.Equal(t, []int64{800, 800, 700, 600, 500, 400, 300, 200, 100}, got)
+	assert.Equal(t, 3, pages)
+
+	// 通过分库分表信息，只查询 orders_db_00.local_msgs_tab_01
+	res, err := svc.Search(ctx, "test", SearchReq{
+		Query:        Query{Status: -1, Limit: 10},
+		ShardingInfo: json.RawMessage("5"),
+	})
+	require.NoError(t, err)
+	assert.False(t, res.HasMore)
+	require.Len(t, res.Msgs, 3)
+	for _, m := range res.Msgs {
+		assert.Equal(t, sharding.Dst{DB: "orders_db_00", Table: "local_msgs_tab_01"}, m.Dst)
+	}
+
+	// 按照 key 查找
+	res, err = svc.Search(ctx, "test", SearchReq{Query: Query{Status: -1, Key: "2_fail", Limit: 10}})
+	require.NoError(t, err)
+	assert.Len(t, res.Msgs, 3)
+
+	// cursor 不能指向别的表
+	cursor, err := encodeCursor([]shardCursor{{DB: "orders_db_00", Table: "orders_tab_00"}})
+	require.NoError(t, err)
+	_, err = svc.Search(ctx, "test", SearchReq{Cursor: cursor})
+	assert.Error(t, err)
+}
+
+func (s *LocalServiceTestSuite) newLocalService(t *testing.T) *LocalService {
+	svc := NewLocalService(nil)
+	err := svc.RegisterShardingSvc("test", service.NewShardingService(s.dbs, nil, nil, sharding.Sharding{}))
+	require.NoError(t, err)
+	return svc
+}
+
+// addColumn 老的表可能没有管理后台用到的列
+func (s *LocalServiceTestSuite) addColumn(t *testing.T, table, column, typ string) {
+	if s.db00.Migrator().HasColumn(table, column) {
+		return
+	}
+	err := s.db00.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + typ).Error
+	require.NoError(t, err)
+}
+
+// createMsgs 在 orders_db_00 中插入状态为 status 的消息，发送失败的消息已经发送过 3 次
+func (s *LocalServiceTestSuite) createMsgs(t *testing.T, table string, status int8, ids ...int64) {
+	msgs := make([]dao.LocalMsg, 0, len(ids))
+	for _, id := range ids {
+		msg := s.MockDAOMsg(id, 123)
+		msg.Status = status
+		if status == dao.MsgStatusFail {
+			msg.SendTimes = 3
+		}
+		msgs = append(msgs, msg)
+	}
+	err := s.db00.Table(table).Create(&msgs).Error
+	require.NoError(t, err)
+}
+
+func (s *LocalServiceTestSuite) findMsgs(t *testing.T, table string) map[int64]dao.LocalMsg {
+	var msgs []dao.LocalMsg
+	err := s.db00.Table(table).Find(&msgs).Error
+	require.NoError(t, err)
+	res := make(map[int64]dao.LocalMsg, len(msgs))
+	for _, msg := range msgs {
+		res[msg.Id] = msg
+	}
+	return res
+}
+
 func (s *LocalServiceTestSuite) MockLocalMsg(
 	id int64,
 	utime int64, cb func(msg *LocalMsg)) LocalMsg {
@@ -188,3 +823,37 @@ func (s *LocalServiceTestSuite) MockLocalMsg(
 func TestLocalService(t *testing.T) {
 	suite.Run(t, new(LocalServiceTestSuite))
 }
+
+// TestLocalService_NotRegistered 业务或者数据库没有注册的时候返回错误，而不是 panic
+func TestLocalService_NotRegistered(t *testing.T) {
+	svc := NewLocalService(nil)
+	err := svc.RegisterShardingSvc("test", service.NewShardingService(map[string]*gorm.DB{},
+		nil, nil, sharding.Sharding{}))
+	require.NoError(t, err)
+	ctx := context.Background()
+	testCases := []struct {
+		name    string
+		biz     string
+		db      string
+		wantErr string
+	}{
+		{name: "没有注册的业务", biz: "order", db: "orders_db_00", wantErr: "没有注册的业务 order"},
+		{name: "没有这个数据库", biz: "test", db: "orders_db_00", wantErr: "没有这个数据库 orders_db_00"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := svc.Get(ctx, tc.biz, tc.db, "local_msgs", 1)
+			assert.EqualError(t, err, tc.wantErr)
+			_, err = svc.ListMsgs(ctx, tc.biz, tc.db, Query{Table: "local_msgs"})
+			assert.EqualError(t, err, tc.wantErr)
+			err = svc.Retry(ctx, tc.biz, tc.db, "local_msgs", 1, "tom")
+			assert.EqualError(t, err, tc.wantErr)
+			err = svc.Update(ctx, tc.biz, tc.db, "local_msgs", 1, msg2.Msg{Topic: "order_paid"}, "tom")
+			assert.EqualError(t, err, tc.wantErr)
+			err = svc.Delete(ctx, tc.biz, tc.db, "local_msgs", 1, "tom")
+			assert.EqualError(t, err, tc.wantErr)
+			_, err = svc.Bulk(ctx, tc.biz, tc.db, BulkReq{Action: BulkResend, Ids: []int64{1}})
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
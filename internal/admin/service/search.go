@@ -0,0 +1,192 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/meoying/local-msg-go/internal/dao"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"golang.org/x/sync/errgroup"
+	"slices"
+)
+
+// SearchReq 跨表查询
+type SearchReq struct {
+	// Query 筛选条件，忽略 Table 和 Offset，Limit 是每一页的大小
+	Query Query
+	// ShardingInfo 不为空的时候，通过 RegisterShardingInfo 注册的方法解析之后，只查询对应的表
+	ShardingInfo json.RawMessage
+	// Cursor 上一页返回的 Cursor，第一页为空
+	Cursor string
+}
+
+// SearchResult 按照 ctime, id 降序合并之后的结果
+type SearchResult struct {
+	Msgs []ShardMsg
+	// Cursor 用于查询下一页
+	Cursor string
+	// HasMore 是否还有下一页
+	HasMore bool
+}
+
+// ShardMsg 带上了消息所在的表
+type ShardMsg struct {
+	Dst sharding.Dst
+	LocalMsg
+}
+
+// shardCursor 某张表已经返回到了哪里
+type shardCursor struct {
+	DB    string        `json:"db,omitempty"`
+	Table string        `json:"table"`
+	Pos   *dao.Position `json:"pos,omitempty"`
+	// Done 这张表已经没有更多的消息了
+	Done bool `json:"done,omitempty"`
+}
+
+// Search 跨表查询，不知道消息在哪张表的时候使用
+// 没有分库分表信息的时候，会同时查询所有的表，每张表都取一页，然后按照 ctime, id 降序合并
+// Cursor 里面记录了每张表各自的位置，所以翻页的开销和翻到第几页无关
+func (svc *LocalService) Search(ctx context.Context, biz string, req SearchReq) (SearchResult, error) {
+	s, ok := svc.svcs[biz]
+	if !ok {
+		return SearchResult{}, fmt.Errorf("没有注册的业务 %s", biz)
+	}
+	cursors, err := svc.shardCursors(biz, s.Sharding, req)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	limit := req.Query.Limit
+	if limit <= 0 {
+		limit = 10
+	}
+
+	// 每张表都取一页，合并之后只有前 limit 条会返回
+	pages := make([][]dao.LocalMsg, len(cursors))
+	var eg errgroup.Group
+	eg.SetLimit(max(svc.Concurrency, 1))
+	for i := range cursors {
+		c := cursors[i]
+		if c.Done {
+			continue
+		}
+		eg.Go(func() error {
+			msgDAO, err := svc.getDAO(biz, c.DB)
+			if err != nil {
+				return err
+			}
+			q := req.Query
+			q.Table = c.Table
+			q.Limit = limit
+			page, err := msgDAO.ListByCtime(ctx, q, c.Pos)
+			if err != nil {
+				return fmt.Errorf("查询 %s.%s 失败 %w", c.DB, c.Table, err)
+			}
+			pages[i] = page
+			return nil
+		})
+	}
+	if err = eg.Wait(); err != nil {
+		return SearchResult{}, err
+	}
+
+	type shardMsg struct {
+		shard int
+		msg   ShardMsg
+	}
+	var merged []shardMsg
+	for i, page := range pages {
+		for _, m := range page {
+			merged = append(merged, shardMsg{shard: i, msg: ShardMsg{
+				Dst:      sharding.Dst{DB: cursors[i].DB, Table: cursors[i].Table},
+				LocalMsg: newLocalMsg(m),
+			}})
+		}
+	}
+	slices.SortFunc(merged, func(a, b shardMsg) int {
+		return cmp.Or(b.msg.Ctime.Compare(a.msg.Ctime), cmp.Compare(b.msg.Id, a.msg.Id),
+			cmp.Compare(a.shard, b.shard))
+	})
+	merged = merged[:min(limit, len(merged))]
+
+	res := SearchResult{Msgs: make([]ShardMsg, 0, len(merged))}
+	// 每张表返回了多少条，位置更新为返回的最后一条
+	taken := make([]int, len(cursors))
+	for _, m := range merged {
+		taken[m.shard]++
+		cursors[m.shard].Pos = &dao.Position{Ctime: m.msg.Ctime.UnixMilli(), Id: m.msg.Id}
+		res.Msgs = append(res.Msgs, m.msg)
+	}
+	for i := range cursors {
+		// 这张表取到的不足一页，并且全部都返回了，那就没有更多了
+		if !cursors[i].Done && len(pages[i]) < limit && taken[i] == len(pages[i]) {
+			cursors[i].Done = true
+		}
+		res.HasMore = res.HasMore || !cursors[i].Done
+	}
+	if res.HasMore {
+		res.Cursor, err = encodeCursor(cursors)
+	}
+	return res, err
+}
+
+// shardCursors 确定要查询哪些表，以及每张表从哪里开始
+func (svc *LocalService) shardCursors(biz string, rules sharding.Sharding, req SearchReq) ([]shardCursor, error) {
+	if req.Cursor != "" {
+		cursors, err := decodeCursor(req.Cursor)
+		if err != nil || rules.EffectiveTablesFunc == nil {
+			return cursors, err
+		}
+		// cursor 是前端传过来的，只能查询这个业务的表
+		dsts := rules.EffectiveTablesFunc()
+		for _, c := range cursors {
+			if !slices.Contains(dsts, sharding.Dst{DB: c.DB, Table: c.Table}) {
+				return nil, fmt.Errorf("cursor 中的表 %s.%s 不属于业务 %s", c.DB, c.Table, biz)
+			}
+		}
+		return cursors, nil
+	}
+	if len(req.ShardingInfo) > 0 {
+		decode, ok := svc.shardingInfos[biz]
+		if !ok {
+			return nil, fmt.Errorf("业务 %s 没有注册分库分表信息的解析方法", biz)
+		}
+		info, err := decode(req.ShardingInfo)
+		if err != nil {
+			return nil, fmt.Errorf("解析分库分表信息失败 %w", err)
+		}
+		dst := rules.ShardingFunc(info)
+		return []shardCursor{{DB: dst.DB, Table: dst.Table}}, nil
+	}
+	if rules.EffectiveTablesFunc == nil {
+		return nil, fmt.Errorf("业务 %s 没有分库分表规则", biz)
+	}
+	dsts := rules.EffectiveTablesFunc()
+	cursors := make([]shardCursor, 0, len(dsts))
+	for _, dst := range dsts {
+		cursors = append(cursors, shardCursor{DB: dst.DB, Table: dst.Table})
+	}
+	return cursors, nil
+}
+
+func encodeCursor(cursors []shardCursor) (string, error) {
+	data, err := json.Marshal(cursors)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string) ([]shardCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("cursor 格式错误 %w", err)
+	}
+	var res []shardCursor
+	if err = json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("cursor 格式错误 %w", err)
+	}
+	return res, nil
+}
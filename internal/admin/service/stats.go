@@ -0,0 +1,149 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"github.com/meoying/local-msg-go/internal/dao"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"golang.org/x/sync/errgroup"
+	"gorm.io/gorm"
+	"slices"
+	"time"
+)
+
+// TableStats 某张表的统计结果
+type TableStats struct {
+	Biz string
+	Dst sharding.Dst
+	// Status 每个状态的消息数量，最多统计到 LocalService.StatsMaxCount
+	Status map[int8]int64
+	// SendTimes 没有发送成功的消息，按照发送次数的分布，一共最多统计 LocalService.StatsMaxCount 条
+	SendTimes map[int]int64
+	// Truncated 有数量达到了 LocalService.StatsMaxCount，实际的数量可能更多
+	Truncated bool
+	// OldestPendingAge 最久没有被处理的待发送消息从创建到现在过了多久，没有待发送消息的时候为 0
+	OldestPendingAge time.Duration
+	// Err 统计这张表出错的时候不为 nil，其余字段都没有意义
+	Err error
+}
+
+// Stats 所有业务的统计结果
+type Stats struct {
+	// Tables 按照 biz、DB、表名排序
+	Tables []TableStats
+	// Status 所有表加起来每个状态的消息数量，不包括出错的表
+	Status map[int8]int64
+}
+
+// Stats 统计 bizs 的所有表，bizs 为空的时候统计所有注册的业务
+// 同时最多统计 Concurrency 张表，每张表最多统计 StatsTimeout。某张表出错不影响别的表
+func (svc *LocalService) Stats(ctx context.Context, bizs ...string) Stats {
+	if len(bizs) == 0 {
+		for biz := range svc.svcs {
+			bizs = append(bizs, biz)
+		}
+	}
+	var tables []TableStats
+	for _, biz := range bizs {
+		s, ok := svc.svcs[biz]
+		if !ok || s.Sharding.EffectiveTablesFunc == nil {
+			continue
+		}
+		for _, dst := range s.Sharding.EffectiveTablesFunc() {
+			tables = append(tables, TableStats{Biz: biz, Dst: dst})
+		}
+	}
+	var eg errgroup.Group
+	eg.SetLimit(max(svc.Concurrency, 1))
+	for i := range tables {
+		ts := &tables[i]
+		eg.Go(func() error {
+			svc.tableStats(ctx, ts)
+			return nil
+		})
+	}
+	_ = eg.Wait()
+
+	slices.SortFunc(tables, func(a, b TableStats) int {
+		return cmp.Or(cmp.Compare(a.Biz, b.Biz),
+			cmp.Compare(a.Dst.DB, b.Dst.DB),
+			cmp.Compare(a.Dst.Table, b.Dst.Table))
+	})
+	res := Stats{Tables: tables, Status: make(map[int8]int64)}
+	for _, ts := range tables {
+		if ts.Err != nil {
+			continue
+		}
+		for status, cnt := range ts.Status {
+			res.Status[status] += cnt
+		}
+	}
+	return res
+}
+
+// statsStatuses 统计的所有状态，unsentStatuses 是没有发送成功的状态
+var (
+	statsStatuses = []int8{dao.MsgStatusInit, dao.MsgStatusSuccess, dao.MsgStatusFail,
+		dao.MsgStatusMigrating, dao.MsgStatusMigrated, dao.MsgStatusAbandoned}
+	unsentStatuses = []int8{dao.MsgStatusInit, dao.MsgStatusFail,
+		dao.MsgStatusMigrating, dao.MsgStatusMigrated, dao.MsgStatusAbandoned}
+)
+
+func (svc *LocalService) tableStats(ctx context.Context, ts *TableStats) {
+	msgDAO, err := svc.getDAO(ts.Biz, ts.Dst.DB)
+	if err != nil {
+		ts.Err = err
+		return
+	}
+	if svc.StatsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, svc.StatsTimeout)
+		defer cancel()
+	}
+	maxCount := max(svc.StatsMaxCount, 1)
+	// 所有的查询都成功之后才写回 ts，出错的表只有 Err，不会被计入总数
+	status := make(map[int8]int64, len(statsStatuses))
+	truncated := false
+	for _, st := range statsStatuses {
+		// 每个状态单独统计，可以走 status 上的索引，并且只扫描 maxCount 条
+		cnt, err := msgDAO.Count(ctx, ts.Dst.Table, st, maxCount)
+		if err != nil {
+			ts.Err = err
+			return
+		}
+		if cnt > 0 {
+			status[st] = cnt
+		}
+		if cnt >= int64(maxCount) {
+			truncated = true
+		}
+	}
+	cnts, err := msgDAO.CountBySendTimes(ctx, ts.Dst.Table, unsentStatuses, maxCount)
+	if err != nil {
+		ts.Err = err
+		return
+	}
+	sendTimes := make(map[int]int64, len(cnts))
+	var total int64
+	for _, c := range cnts {
+		sendTimes[c.SendTimes] = c.Cnt
+		total += c.Cnt
+	}
+	if total >= int64(maxCount) {
+		truncated = true
+	}
+	var age time.Duration
+	oldest, err := msgDAO.OldestPending(ctx, ts.Dst.Table)
+	switch {
+	case err == nil:
+		age = time.Since(time.UnixMilli(oldest.Ctime))
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		ts.Err = err
+		return
+	}
+	ts.Status = status
+	ts.SendTimes = sendTimes
+	ts.Truncated = truncated
+	ts.OldestPendingAge = age
+}
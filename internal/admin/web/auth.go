@@ -0,0 +1,238 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ecodeclub/ekit/bean/option"
+	"github.com/ecodeclub/ginx"
+	"github.com/ecodeclub/ginx/gctx"
+	"github.com/ecodeclub/ginx/session"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Role 用户在某个业务下的角色，高级别的角色拥有低级别角色的所有权限
+type Role int8
+
+const (
+	RoleNone Role = iota
+	// RoleViewer 可以查询消息和统计
+	RoleViewer
+	// RoleOperator 还可以重试和批量操作
+	RoleOperator
+	// RoleAdmin 还可以修改和删除消息
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleNone:     "none",
+	RoleViewer:   "viewer",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return "Role(" + strconv.Itoa(int(r)) + ")"
+}
+
+// ParseRole 解析 viewer、operator、admin
+func ParseRole(name string) (Role, error) {
+	for r, n := range roleNames {
+		if n == name {
+			return r, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("未知的角色 %s", name)
+}
+
+// ParseRoles 解析 "order:admin,payment:viewer" 这种格式，biz 为 AllBiz 的时候表示所有业务
+func ParseRoles(s string) (map[string]Role, error) {
+	res := make(map[string]Role)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		biz, name, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("角色格式错误 %s", item)
+		}
+		r, err := ParseRole(name)
+		if err != nil {
+			return nil, err
+		}
+		res[biz] = r
+	}
+	return res, nil
+}
+
+// AllBiz 作为 Principal.Roles 的 key 的时候，表示所有业务
+const AllBiz = "*"
+
+// Principal 认证之后的用户
+type Principal struct {
+	// Name 操作人，重试消息的时候会记录下来
+	Name string
+	// Roles 每个业务下的角色，key 是 biz
+	Roles map[string]Role
+}
+
+// Role 在 biz 下的角色，取 biz 和 AllBiz 中较高的那个
+func (p Principal) Role(biz string) Role {
+	return max(p.Roles[biz], p.Roles[AllBiz])
+}
+
+// Authenticator 认证请求，失败的时候返回 401
+type Authenticator interface {
+	Authenticate(ctx *gin.Context) (Principal, error)
+}
+
+// AuthenticatorFunc 接入自己的登录体系，例如说从公司的 SSO 里面拿到用户和角色
+type AuthenticatorFunc func(ctx *gin.Context) (Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx *gin.Context) (Principal, error) {
+	return f(ctx)
+}
+
+// SessionRolesKey 角色保存在 session.Claims.Data 的这个 key 上，格式参考 ParseRoles
+const SessionRolesKey = "local_msg_roles"
+
+// NewSessionAuthenticator 使用 ginx 的 session，需要先调用 session.SetDefaultProvider
+// 操作人是 uid，角色从 Claims.Data[SessionRolesKey] 中解析
+func NewSessionAuthenticator() Authenticator {
+	return AuthenticatorFunc(func(ctx *gin.Context) (Principal, error) {
+		sess, err := session.Get(&gctx.Context{Context: ctx})
+		if err != nil {
+			return Principal{}, err
+		}
+		claims := sess.Claims()
+		roles, err := ParseRoles(claims.Data[SessionRolesKey])
+		if err != nil {
+			return Principal{}, err
+		}
+		return Principal{Name: strconv.FormatInt(claims.Uid, 10), Roles: roles}, nil
+	})
+}
+
+// JWTClaims bearer token 中的内容，操作人是 sub
+type JWTClaims struct {
+	jwt.RegisteredClaims
+	// Roles key 是 biz，value 是角色的名字
+	Roles map[string]string `json:"roles"`
+}
+
+// NewJWTAuthenticator 从 Authorization: Bearer <token> 中解析使用 key 签名的 HS256 JWT
+// key 不能为空，否则任何人都可以伪造 token。没有过期时间的 token 会被拒绝
+func NewJWTAuthenticator(key []byte) (Authenticator, error) {
+	if len(key) == 0 {
+		return nil, errors.New("JWT 的密钥不能为空")
+	}
+	return AuthenticatorFunc(func(ctx *gin.Context) (Principal, error) {
+		token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			return Principal{}, errors.New("没有 bearer token")
+		}
+		var claims JWTClaims
+		_, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
+			return key, nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		if err != nil {
+			return Principal{}, err
+		}
+		// 没有过期时间的 token 泄露之后就一直有效
+		if claims.ExpiresAt == nil {
+			return Principal{}, errors.New("token 没有过期时间")
+		}
+		p := Principal{Name: claims.Subject, Roles: make(map[string]Role, len(claims.Roles))}
+		for biz, name := range claims.Roles {
+			p.Roles[biz], err = ParseRole(name)
+			if err != nil {
+				return Principal{}, err
+			}
+		}
+		return p, nil
+	}), nil
+}
+
+// WithAuthenticator 不设置的时候不做任何认证和鉴权，所有人都可以执行所有操作
+func WithAuthenticator(auth Authenticator) option.Option[Handler] {
+	return func(h *Handler) {
+		h.auth = auth
+	}
+}
+
+// principalKey 认证之后的 Principal 放在 gin.Context 的这个 key 上
+const principalKey = "local_msg_principal"
+
+// authenticate 认证请求，并且把用户的名字作为操作人
+func (handler *Handler) authenticate(ctx *gin.Context) {
+	if handler.auth == nil {
+		return
+	}
+	p, err := handler.auth.Authenticate(ctx)
+	if err != nil {
+		slog.Debug("认证失败", slog.Any("err", err))
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	ctx.Set(principalKey, p)
+	ctx.Set(OperatorKey, p.Name)
+}
+
+func principal(ctx *ginx.Context) (Principal, bool) {
+	val, ok := ctx.Get(principalKey)
+	if !ok {
+		return Principal{}, false
+	}
+	p, ok := val.(Principal)
+	return p, ok
+}
+
+// check 检查用户在 biz 下至少是 role，没有权限的时候返回 403
+func (handler *Handler) check(ctx *ginx.Context, biz string, role Role) error {
+	if handler.auth == nil {
+		return nil
+	}
+	p, ok := principal(ctx)
+	if !ok {
+		return ginx.ErrUnauthorized
+	}
+	if p.Role(biz) < role {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return fmt.Errorf("%w, %s 在业务 %s 下不是 %s", ginx.ErrNoResponse, p.Name, biz, role)
+	}
+	return nil
+}
+
+// viewableBizs 过滤出用户可以查看的业务，bizs 为空的时候返回所有可以查看的业务
+func (handler *Handler) viewableBizs(ctx *ginx.Context, bizs []string) ([]string, error) {
+	if handler.auth == nil {
+		return bizs, nil
+	}
+	if len(bizs) > 0 {
+		for _, biz := range bizs {
+			if err := handler.check(ctx, biz, RoleViewer); err != nil {
+				return nil, err
+			}
+		}
+		return bizs, nil
+	}
+	p, ok := principal(ctx)
+	if !ok {
+		return nil, ginx.ErrUnauthorized
+	}
+	var res []string
+	for _, biz := range handler.svc.Bizs() {
+		if p.Role(biz) >= RoleViewer {
+			res = append(res, biz)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,286 @@
+package web
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	service2 "github.com/meoying/local-msg-go/internal/admin/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRoles(t *testing.T) {
+	testCases := []struct {
+		name    string
+		s       string
+		want    map[string]Role
+		wantErr bool
+	}{
+		{
+			name: "空",
+			want: map[string]Role{},
+		},
+		{
+			name: "多个业务",
+			s:    "order:admin, payment:viewer,*:operator",
+			want: map[string]Role{"order": RoleAdmin, "payment": RoleViewer, AllBiz: RoleOperator},
+		},
+		{
+			name:    "没有冒号",
+			s:       "order",
+			wantErr: true,
+		},
+		{
+			name:    "未知的角色",
+			s:       "order:root",
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			roles, err := ParseRoles(tc.s)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, roles)
+		})
+	}
+}
+
+func TestPrincipal_Role(t *testing.T) {
+	p := Principal{Roles: map[string]Role{"order": RoleAdmin, AllBiz: RoleViewer}}
+	assert.Equal(t, RoleAdmin, p.Role("order"))
+	assert.Equal(t, RoleViewer, p.Role("payment"))
+	assert.Equal(t, RoleNone, Principal{}.Role("order"))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key := []byte("local_msg_key")
+	sign := func(t *testing.T, method jwt.SigningMethod, key any, claims JWTClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		require.NoError(t, err)
+		return token
+	}
+	valid := JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "tom",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+		Roles: map[string]string{"order": "operator"},
+	}
+	testCases := []struct {
+		name    string
+		header  string
+		want    Principal
+		wantErr bool
+	}{
+		{
+			name:   "成功",
+			header: "Bearer " + sign(t, jwt.SigningMethodHS256, key, valid),
+			want:   Principal{Name: "tom", Roles: map[string]Role{"order": RoleOperator}},
+		},
+		{
+			name:    "没有 token",
+			wantErr: true,
+		},
+		{
+			name:    "签名不对",
+			header:  "Bearer " + sign(t, jwt.SigningMethodHS256, []byte("other"), valid),
+			wantErr: true,
+		},
+		{
+			name:    "不是 HS256",
+			header:  "Bearer " + sign(t, jwt.SigningMethodHS512, key, valid),
+			wantErr: true,
+		},
+		{
+			name: "过期",
+			header: "Bearer " + sign(t, jwt.SigningMethodHS256, key, JWTClaims{
+				RegisteredClaims: jwt.RegisteredClaims{
+					Subject:   "tom",
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+				},
+			}),
+			wantErr: true,
+		},
+		{
+			name: "没有过期时间",
+			header: "Bearer " + sign(t, jwt.SigningMethodHS256, key, JWTClaims{
+				RegisteredClaims: jwt.RegisteredClaims{Subject: "tom"},
+				Roles:            map[string]string{"order": "operator"},
+			}),
+			wantErr: true,
+		},
+		{
+			name: "未知的角色",
+			header: "Bearer " + sign(t, jwt.SigningMethodHS256, key, JWTClaims{
+				RegisteredClaims: jwt.RegisteredClaims{
+					Subject:   "tom",
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+				},
+				Roles: map[string]string{"order": "root"},
+			}),
+			wantErr: true,
+		},
+	}
+	_, err := NewJWTAuthenticator(nil)
+	assert.Error(t, err)
+	_, err = NewJWTAuthenticator([]byte{})
+	assert.Error(t, err)
+	auth, err := NewJWTAuthenticator(key)
+	require.NoError(t, err)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.Header.Set("Authorization", tc.header)
+			ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+			ctx.Request = req
+			p, err := auth.Authenticate(ctx)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, p)
+		})
+	}
+}
+
+// TestHandler_Auth 只验证认证和鉴权，被拒绝的请求不会走到 LocalService
+func TestHandler_Auth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	users := map[string]Principal{
+		"viewer":   {Name: "viewer", Roles: map[string]Role{"order": RoleViewer}},
+		"operator": {Name: "operator", Roles: map[string]Role{"order": RoleOperator}},
+		"admin":    {Name: "admin", Roles: map[string]Role{"order": RoleAdmin}},
+		"other":    {Name: "other", Roles: map[string]Role{"payment": RoleAdmin}},
+		// 注册为空字符串的业务，例如 adminSvc.Register("", msgSvc)
+		"default": {Name: "default", Roles: map[string]Role{"": RoleAdmin}},
+	}
+	hdl := NewHandler(service2.NewLocalService(nil), WithAuthenticator(
+		AuthenticatorFunc(func(ctx *gin.Context) (Principal, error) {
+			p, ok := users[ctx.GetHeader("X-User")]
+			if !ok {
+				return Principal{}, errors.New("未登录")
+			}
+			return p, nil
+		})))
+	server := gin.New()
+	hdl.RegisterRoutes(server)
+
+	testCases := []struct {
+		name     string
+		user     string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{
+			name:     "未登录",
+			path:     "/local_msg/list",
+			body:     `{"biz":"order"}`,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "别的业务不能查询",
+			user:     "other",
+			path:     "/local_msg/list",
+			body:     `{"biz":"order"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "viewer 不能重试",
+			user:     "viewer",
+			path:     "/local_msg/retry",
+			body:     `{"biz":"order","table":"local_msgs","id":1}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "viewer 不能批量操作",
+			user:     "viewer",
+			path:     "/local_msg/bulk/reset",
+			body:     `{"biz":"order","ids":[1]}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "operator 不能修改",
+			user:     "operator",
+			path:     "/local_msg/update",
+			body:     `{"biz":"order","table":"local_msgs","id":1}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "operator 不能删除",
+			user:     "operator",
+			path:     "/local_msg/delete",
+			body:     `{"biz":"order","table":"local_msgs","id":1}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "别的业务的管理员不能重试",
+			user:     "other",
+			path:     "/local_msg/retry",
+			body:     `{"biz":"order","table":"local_msgs","id":1}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "不能查询所有业务的审计日志",
+			user:     "viewer",
+			path:     "/local_msg/audit/list",
+			body:     `{}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "空字符串业务的权限不能查询所有业务的审计日志",
+			user:     "default",
+			path:     "/local_msg/audit/list",
+			body:     `{}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "不能查询别的业务的审计日志",
+			user:     "other",
+			path:     "/local_msg/audit/list",
+			body:     `{"biz":"order"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "不能统计别的业务",
+			user:     "viewer",
+			path:     "/local_msg/stats",
+			body:     `{"bizs":["order","payment"]}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "统计自己的业务",
+			user:     "viewer",
+			path:     "/local_msg/stats",
+			body:     `{"bizs":["order"]}`,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "统计所有可以查看的业务",
+			user:     "viewer",
+			path:     "/local_msg/stats",
+			body:     `{}`,
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-User", tc.user)
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, req)
+			assert.Equal(t, tc.wantCode, recorder.Code)
+		})
+	}
+}
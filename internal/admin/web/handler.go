@@ -1,46 +1,224 @@
 package web
 
 import (
+	"github.com/ecodeclub/ekit/bean/option"
 	"github.com/ecodeclub/ekit/slice"
 	"github.com/ecodeclub/ginx"
 	"github.com/gin-gonic/gin"
 	service2 "github.com/meoying/local-msg-go/internal/admin/service"
+	"log/slog"
 )
 
+// OperatorKey 登录校验之类的中间件把操作人放到 gin.Context 的这个 key 上，
+// 重试消息的时候会记录下来。设置了 Authenticator 的时候，使用 Principal.Name
+const OperatorKey = "local_msg_operator"
+
 type Handler struct {
-	svc *service2.LocalService
+	svc  *service2.LocalService
+	auth Authenticator
 }
 
-func NewHandler(svc *service2.LocalService) *Handler {
+func NewHandler(svc *service2.LocalService, opts ...option.Option[Handler]) *Handler {
 	handler := &Handler{
 		svc: svc,
 	}
+	option.Apply(handler, opts...)
 	return handler
 }
 
+// RegisterRoutes 查询和审计日志需要 RoleViewer，重试和批量操作需要 RoleOperator，修改和删除需要 RoleAdmin
 func (handler *Handler) RegisterRoutes(server *gin.Engine) {
-	server.POST("/local_msg/list", ginx.B(handler.List))
-	server.POST("/local_msg/retry", ginx.B(handler.Retry))
+	if handler.auth == nil {
+		slog.Warn("管理后台没有设置 Authenticator，所有人都可以重试、修改和删除消息")
+	}
+	g := server.Group("/local_msg", handler.authenticate)
+	g.POST("/list", ginx.B(handler.List))
+	g.POST("/retry", ginx.B(handler.Retry))
+	g.POST("/detail", ginx.B(handler.Detail))
+	g.POST("/update", ginx.B(handler.Update))
+	g.POST("/delete", ginx.B(handler.Delete))
+	g.POST("/stats", ginx.B(handler.Stats))
+	g.POST("/search", ginx.B(handler.Search))
+	g.POST("/bulk/reset", ginx.B(handler.bulk(service2.BulkReset)))
+	g.POST("/bulk/resend", ginx.B(handler.bulk(service2.BulkResend)))
+	g.POST("/bulk/abandon", ginx.B(handler.bulk(service2.BulkAbandon)))
+	g.POST("/audit/list", ginx.B(handler.ListAudits))
 }
 
 // List 请求，在分库分表的情况下，默认是从名字为空字符串的 DB 中取数据
+// 翻页的时候，带上上一页返回的 cursor，比 offset 快
 func (handler *Handler) List(ctx *ginx.Context, req ListReq) (ginx.Result, error) {
+	if err := handler.check(ctx, req.Biz, RoleViewer); err != nil {
+		return ginx.Result{}, err
+	}
 	// 查找数据
 	res, err := handler.svc.ListMsgs(ctx, req.Biz, req.DB, req.Query)
 	if err != nil {
 		return ginx.Result{}, err
 	}
-	return ginx.Result{
-		Data: slice.Map(res, func(idx int, src service2.LocalMsg) LocalMsg {
+	data := ListResult{
+		Msgs: slice.Map(res, func(idx int, src service2.LocalMsg) LocalMsg {
 			return newLocalMsg(req.Biz, req.DB, req.Query.Table, src)
 		}),
+	}
+	// 取满了一页，就认为还有下一页
+	if len(res) > 0 && len(res) == req.Query.Limit {
+		data.Cursor = res[len(res)-1].Id
+		data.HasMore = true
+	}
+	return ginx.Result{
+		Data: data,
 	}, nil
 }
 
 func (handler *Handler) Retry(ctx *ginx.Context, req RetryReq) (ginx.Result, error) {
-	err := handler.svc.Retry(ctx, req.Biz, req.DB, req.Table, req.Id)
+	if err := handler.check(ctx, req.Biz, RoleOperator); err != nil {
+		return ginx.Result{}, err
+	}
+	err := handler.svc.Retry(ctx, req.Biz, req.DB, req.Table, req.Id, ctx.GetString(OperatorKey))
+	if err != nil {
+		return ginx.Result{}, err
+	}
+	return ginx.Result{}, nil
+}
+
+func (handler *Handler) Detail(ctx *ginx.Context, req DetailReq) (ginx.Result, error) {
+	if err := handler.check(ctx, req.Biz, RoleViewer); err != nil {
+		return ginx.Result{}, err
+	}
+	res, err := handler.svc.Get(ctx, req.Biz, req.DB, req.Table, req.Id)
+	if err != nil {
+		return ginx.Result{}, err
+	}
+	return ginx.Result{
+		Data: newLocalMsg(req.Biz, req.DB, req.Table, res),
+	}, nil
+}
+
+// Update 修改消息内容，Resend 为 true 的时候修改之后立刻重新发送
+func (handler *Handler) Update(ctx *ginx.Context, req UpdateReq) (ginx.Result, error) {
+	if err := handler.check(ctx, req.Biz, RoleAdmin); err != nil {
+		return ginx.Result{}, err
+	}
+	var err error
+	if req.Resend {
+		err = handler.svc.UpdateAndRetry(ctx, req.Biz, req.DB, req.Table, req.Id, req.Msg, ctx.GetString(OperatorKey))
+	} else {
+		err = handler.svc.Update(ctx, req.Biz, req.DB, req.Table, req.Id, req.Msg, ctx.GetString(OperatorKey))
+	}
+	if err != nil {
+		return ginx.Result{}, err
+	}
+	return ginx.Result{}, nil
+}
+
+func (handler *Handler) Delete(ctx *ginx.Context, req DeleteReq) (ginx.Result, error) {
+	if err := handler.check(ctx, req.Biz, RoleAdmin); err != nil {
+		return ginx.Result{}, err
+	}
+	err := handler.svc.Delete(ctx, req.Biz, req.DB, req.Table, req.Id, ctx.GetString(OperatorKey))
 	if err != nil {
 		return ginx.Result{}, err
 	}
 	return ginx.Result{}, nil
 }
+
+// Search 跨表查询，不知道消息在哪张表的时候使用。翻页的时候带上上一页返回的 cursor
+func (handler *Handler) Search(ctx *ginx.Context, req SearchReq) (ginx.Result, error) {
+	if err := handler.check(ctx, req.Biz, RoleViewer); err != nil {
+		return ginx.Result{}, err
+	}
+	res, err := handler.svc.Search(ctx, req.Biz, service2.SearchReq{
+		Query:        req.Query,
+		ShardingInfo: req.ShardingInfo,
+		Cursor:       req.Cursor,
+	})
+	if err != nil {
+		return ginx.Result{}, err
+	}
+	return ginx.Result{
+		Data: SearchResult{
+			Msgs: slice.Map(res.Msgs, func(idx int, src service2.ShardMsg) LocalMsg {
+				return newLocalMsg(req.Biz, src.Dst.DB, src.Dst.Table, src.LocalMsg)
+			}),
+			Cursor:  res.Cursor,
+			HasMore: res.HasMore,
+		},
+	}, nil
+}
+
+// Stats 统计每个业务的每一张表，Bizs 为空的时候统计所有可以查看的业务
+func (handler *Handler) Stats(ctx *ginx.Context, req StatsReq) (ginx.Result, error) {
+	bizs, err := handler.viewableBizs(ctx, req.Bizs)
+	if err != nil {
+		return ginx.Result{}, err
+	}
+	stats := service2.Stats{Status: map[int8]int64{}}
+	// 设置了 Authenticator 之后，没有可以查看的业务就不统计，而不是统计所有业务
+	if handler.auth == nil || len(bizs) > 0 {
+		stats = handler.svc.Stats(ctx, bizs...)
+	}
+	return ginx.Result{
+		Data: newStats(stats),
+	}, nil
+}
+
+// ListAudits 查询审计日志，biz 为空的时候查询所有业务，此时需要所有业务的 RoleViewer
+func (handler *Handler) ListAudits(ctx *ginx.Context, req AuditQuery) (ginx.Result, error) {
+	// biz 为空的时候查询的是所有业务，需要 AllBiz 的权限，不能当作注册为空字符串的业务
+	biz := req.Biz
+	if biz == "" {
+		biz = AllBiz
+	}
+	if err := handler.check(ctx, biz, RoleViewer); err != nil {
+		return ginx.Result{}, err
+	}
+	// 和 service 使用同一个默认值，否则没有指定 limit 的时候判断不出来还有没有下一页
+	if req.Limit <= 0 {
+		req.Limit = service2.DefaultAuditLimit
+	}
+	logs, err := handler.svc.ListAudits(ctx, req)
+	if err != nil {
+		return ginx.Result{}, err
+	}
+	data := AuditListResult{
+		Logs: slice.Map(logs, func(idx int, src service2.AuditLog) AuditLog {
+			return newAuditLog(src)
+		}),
+	}
+	if len(logs) > 0 && len(logs) == req.Limit {
+		data.Cursor = logs[len(logs)-1].Id
+		data.HasMore = true
+	}
+	return ginx.Result{
+		Data: data,
+	}, nil
+}
+
+// bulk 批量操作，dryRun 的时候只返回数量
+func (handler *Handler) bulk(action service2.BulkAction) func(ctx *ginx.Context, req BulkReq) (ginx.Result, error) {
+	return func(ctx *ginx.Context, req BulkReq) (ginx.Result, error) {
+		if err := handler.check(ctx, req.Biz, RoleOperator); err != nil {
+			return ginx.Result{}, err
+		}
+		res, err := handler.svc.Bulk(ctx, req.Biz, req.DB, service2.BulkReq{
+			Action:   action,
+			Ids:      req.Ids,
+			Query:    req.Query,
+			DryRun:   req.DryRun,
+			Limit:    req.Limit,
+			Operator: ctx.GetString(OperatorKey),
+		})
+		if err != nil {
+			return ginx.Result{}, err
+		}
+		return ginx.Result{
+			Data: BulkResult{
+				Total:    res.Total,
+				Matched:  res.Matched,
+				Affected: res.Affected,
+				Failed:   res.Failed,
+			},
+		}, nil
+	}
+}
@@ -0,0 +1,89 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	service2 "github.com/meoying/local-msg-go/internal/admin/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler_ListAudits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	svc := service2.NewLocalService(nil)
+	// 一共 25 条审计日志，id 从 1 到 25
+	svc.AuditSink = fakeAuditSink{total: 25}
+	server := gin.New()
+	NewHandler(svc).RegisterRoutes(server)
+
+	testCases := []struct {
+		name string
+		body string
+
+		wantCnt     int
+		wantCursor  int64
+		wantHasMore bool
+	}{
+		{
+			name:        "没有指定 limit",
+			body:        `{}`,
+			wantCnt:     service2.DefaultAuditLimit,
+			wantCursor:  16,
+			wantHasMore: true,
+		},
+		{
+			name:        "指定 limit",
+			body:        `{"limit":20}`,
+			wantCnt:     20,
+			wantCursor:  6,
+			wantHasMore: true,
+		},
+		{
+			name:    "最后一页",
+			body:    `{"cursor":6}`,
+			wantCnt: 5,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/local_msg/audit/list", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, req)
+			require.Equal(t, http.StatusOK, recorder.Code)
+			var res struct {
+				Data AuditListResult `json:"data"`
+			}
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &res))
+			assert.Len(t, res.Data.Logs, tc.wantCnt)
+			assert.Equal(t, tc.wantCursor, res.Data.Cursor)
+			assert.Equal(t, tc.wantHasMore, res.Data.HasMore)
+		})
+	}
+}
+
+// fakeAuditSink 假装有 total 条审计日志
+type fakeAuditSink struct {
+	total int64
+}
+
+func (f fakeAuditSink) Record(ctx context.Context, logs []service2.AuditLog) error {
+	return nil
+}
+
+func (f fakeAuditSink) ListAudits(ctx context.Context, q AuditQuery) ([]service2.AuditLog, error) {
+	id := f.total
+	if q.Cursor > 0 {
+		id = q.Cursor - 1
+	}
+	res := make([]service2.AuditLog, 0, q.Limit)
+	for ; id > 0 && len(res) < q.Limit; id-- {
+		res = append(res, service2.AuditLog{Id: id})
+	}
+	return res, nil
+}
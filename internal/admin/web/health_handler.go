@@ -0,0 +1,59 @@
+package web
+
+import (
+	"github.com/gin-gonic/gin"
+	service2 "github.com/meoying/local-msg-go/internal/admin/service"
+	"github.com/meoying/local-msg-go/internal/service"
+	"net/http"
+)
+
+// HealthHandler 用于存活探针和就绪探针，一般不需要登录，所以和 Handler 分开
+type HealthHandler struct {
+	svc *service2.LocalService
+}
+
+func NewHealthHandler(svc *service2.LocalService) *HealthHandler {
+	return &HealthHandler{
+		svc: svc,
+	}
+}
+
+func (handler *HealthHandler) RegisterRoutes(server gin.IRoutes) {
+	server.GET("/local_msg/health", handler.Detail)
+	server.GET("/local_msg/health/live", handler.Live)
+	server.GET("/local_msg/health/ready", handler.Ready)
+}
+
+// Live 存活探针，有补偿任务卡住了就返回 503
+func (handler *HealthHandler) Live(ctx *gin.Context) {
+	handler.probe(ctx, service.Health.Live)
+}
+
+// Ready 就绪探针，补偿任务没有开启，或者正在关闭的时候返回 503
+func (handler *HealthHandler) Ready(ctx *gin.Context) {
+	handler.probe(ctx, service.Health.Ready)
+}
+
+// Detail 返回每一张表的补偿任务的详细情况，状态码和存活探针一致
+func (handler *HealthHandler) Detail(ctx *gin.Context) {
+	healths := handler.svc.Health()
+	res := make(map[string]Health, len(healths))
+	code := http.StatusOK
+	for biz, h := range healths {
+		if !h.Live() {
+			code = http.StatusServiceUnavailable
+		}
+		res[biz] = newHealth(h)
+	}
+	ctx.JSON(code, res)
+}
+
+func (handler *HealthHandler) probe(ctx *gin.Context, ok func(h service.Health) bool) {
+	for biz, h := range handler.svc.Health() {
+		if !ok(h) {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"biz": biz, "health": newHealth(h)})
+			return
+		}
+	}
+	ctx.String(http.StatusOK, "ok")
+}
@@ -1,8 +1,12 @@
 package web
 
 import (
+	"encoding/json"
+	"github.com/ecodeclub/ekit/slice"
 	"github.com/meoying/local-msg-go/internal/admin/service"
 	"github.com/meoying/local-msg-go/internal/msg"
+	service2 "github.com/meoying/local-msg-go/internal/service"
+	"time"
 )
 
 type LocalMsg struct {
@@ -17,6 +21,8 @@ type LocalMsg struct {
 	SendTimes int     `json:"sendTimes,omitempty"`
 	Ctime     int64   `json:"ctime,omitempty"`
 	Utime     int64   `json:"utime,omitempty"`
+	// OriginalData 第一次修改之前的内容，可能不是合法的 JSON，所以使用字符串
+	OriginalData string `json:"originalData,omitempty"`
 }
 
 func newLocalMsg(biz, db, table string, msg service.LocalMsg) LocalMsg {
@@ -31,6 +37,8 @@ func newLocalMsg(biz, db, table string, msg service.LocalMsg) LocalMsg {
 		SendTimes: msg.SendTimes,
 		Ctime:     msg.Ctime.UnixMilli(),
 		Utime:     msg.Utime.UnixMilli(),
+
+		OriginalData: string(msg.OriginalData),
 	}
 }
 
@@ -42,6 +50,13 @@ type ListReq struct {
 	Query Query  `json:"query"`
 }
 
+type ListResult struct {
+	Msgs []LocalMsg `json:"msgs"`
+	// Cursor 作为下一页的 query.cursor
+	Cursor  int64 `json:"cursor,omitempty"`
+	HasMore bool  `json:"hasMore"`
+}
+
 type RetryReq struct {
 	Biz   string `json:"biz"`
 	DB    string `json:"db"`
@@ -49,4 +64,181 @@ type RetryReq struct {
 	Id    int64  `json:"id"`
 }
 
+// DetailReq 通过 id 定位一条消息
+type DetailReq = RetryReq
+
+type DeleteReq = RetryReq
+
+type UpdateReq struct {
+	Biz   string  `json:"biz"`
+	DB    string  `json:"db"`
+	Table string  `json:"table"`
+	Id    int64   `json:"id"`
+	Msg   msg.Msg `json:"msg"`
+	// Resend 修改之后立刻重新发送
+	Resend bool `json:"resend,omitempty"`
+}
+
+// BulkReq Ids 不为空的时候按照 id 操作，此时 Query 里面只需要 Table
+type BulkReq struct {
+	Biz    string  `json:"biz"`
+	DB     string  `json:"db"`
+	Ids    []int64 `json:"ids,omitempty"`
+	Query  Query   `json:"query"`
+	DryRun bool    `json:"dryRun,omitempty"`
+	Limit  int     `json:"limit,omitempty"`
+}
+
+type BulkResult struct {
+	Total    int64 `json:"total"`
+	Matched  int   `json:"matched"`
+	Affected int64 `json:"affected"`
+	Failed   int64 `json:"failed"`
+}
+
 type Query = service.Query
+
+// SearchReq 跨表查询，Query 里面的 Table 和 Offset 不生效
+type SearchReq struct {
+	Biz   string `json:"biz"`
+	Query Query  `json:"query"`
+	// ShardingInfo 分库分表信息，需要业务方通过 LocalService.RegisterShardingInfo 注册解析方法
+	ShardingInfo json.RawMessage `json:"shardingInfo,omitempty"`
+	Cursor       string          `json:"cursor,omitempty"`
+}
+
+type SearchResult struct {
+	Msgs    []LocalMsg `json:"msgs"`
+	Cursor  string     `json:"cursor,omitempty"`
+	HasMore bool       `json:"hasMore"`
+}
+
+type StatsReq struct {
+	Bizs []string `json:"bizs,omitempty"`
+}
+
+type Stats struct {
+	Tables []TableStats   `json:"tables"`
+	Status map[int8]int64 `json:"status"`
+}
+
+type TableStats struct {
+	Biz   string `json:"biz,omitempty"`
+	DB    string `json:"db,omitempty"`
+	Table string `json:"table,omitempty"`
+
+	Status    map[int8]int64 `json:"status,omitempty"`
+	SendTimes map[int]int64  `json:"sendTimes,omitempty"`
+	// Truncated 有数量达到了统计的上限，实际的数量可能更多
+	Truncated bool `json:"truncated,omitempty"`
+	// OldestPendingAge 毫秒
+	OldestPendingAge int64  `json:"oldestPendingAge,omitempty"`
+	Err              string `json:"err,omitempty"`
+}
+
+func newStats(s service.Stats) Stats {
+	return Stats{
+		Status: s.Status,
+		Tables: slice.Map(s.Tables, func(idx int, src service.TableStats) TableStats {
+			res := TableStats{
+				Biz:              src.Biz,
+				DB:               src.Dst.DB,
+				Table:            src.Dst.Table,
+				Status:           src.Status,
+				SendTimes:        src.SendTimes,
+				Truncated:        src.Truncated,
+				OldestPendingAge: src.OldestPendingAge.Milliseconds(),
+			}
+			if src.Err != nil {
+				res.Err = src.Err.Error()
+			}
+			return res
+		}),
+	}
+}
+
+type Health struct {
+	Ready bool         `json:"ready"`
+	Live  bool         `json:"live"`
+	Tasks []TaskHealth `json:"tasks"`
+}
+
+type TaskHealth struct {
+	DB    string `json:"db,omitempty"`
+	Table string `json:"table,omitempty"`
+
+	Owned           bool   `json:"owned"`
+	LastLoopTime    int64  `json:"lastLoopTime,omitempty"`
+	LastSuccessTime int64  `json:"lastSuccessTime,omitempty"`
+	ErrCnt          int    `json:"errCnt,omitempty"`
+	LastErr         string `json:"lastErr,omitempty"`
+	LastErrTime     int64  `json:"lastErrTime,omitempty"`
+	Stalled         bool   `json:"stalled"`
+}
+
+func newHealth(h service2.Health) Health {
+	return Health{
+		Ready: h.Ready(),
+		Live:  h.Live(),
+		Tasks: slice.Map(h.Tasks, func(idx int, src service2.TaskHealth) TaskHealth {
+			return TaskHealth{
+				DB:              src.Dst.DB,
+				Table:           src.Dst.Table,
+				Owned:           src.Owned,
+				LastLoopTime:    unixMilli(src.LastLoopTime),
+				LastSuccessTime: unixMilli(src.LastSuccessTime),
+				ErrCnt:          src.ErrCnt,
+				LastErr:         src.LastErr,
+				LastErrTime:     unixMilli(src.LastErrTime),
+				Stalled:         src.Stalled,
+			}
+		}),
+	}
+}
+
+// unixMilli 零值返回 0，而不是一个负数
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+type AuditQuery = service.AuditQuery
+
+type AuditListResult struct {
+	Logs []AuditLog `json:"logs"`
+	// Cursor 作为下一页的 cursor
+	Cursor  int64 `json:"cursor,omitempty"`
+	HasMore bool  `json:"hasMore"`
+}
+
+type AuditLog struct {
+	Id           int64           `json:"id"`
+	Actor        string          `json:"actor,omitempty"`
+	Biz          string          `json:"biz,omitempty"`
+	DB           string          `json:"db,omitempty"`
+	Table        string          `json:"table,omitempty"`
+	MsgId        int64           `json:"msgId"`
+	Action       string          `json:"action"`
+	BeforeStatus int8            `json:"beforeStatus"`
+	AfterStatus  int8            `json:"afterStatus"`
+	Diff         json.RawMessage `json:"diff,omitempty"`
+	Ctime        int64           `json:"ctime"`
+}
+
+func newAuditLog(src service.AuditLog) AuditLog {
+	return AuditLog{
+		Id:           src.Id,
+		Actor:        src.Actor,
+		Biz:          src.Biz,
+		DB:           src.DB,
+		Table:        src.Table,
+		MsgId:        src.MsgId,
+		Action:       string(src.Action),
+		BeforeStatus: src.BeforeStatus,
+		AfterStatus:  src.AfterStatus,
+		Diff:         src.Diff,
+		Ctime:        src.Ctime.UnixMilli(),
+	}
+}
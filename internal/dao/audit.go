@@ -0,0 +1,96 @@
+package dao
+
+import (
+	"context"
+	"gorm.io/gorm"
+)
+
+// AuditLog 管理后台修改消息的审计日志
+type AuditLog struct {
+	Id    int64  `gorm:"primaryKey,autoIncrement"`
+	Actor string `gorm:"type:VARCHAR(64);index"`
+	// Biz, MsgDB, MsgTable 和 MsgId 确定了是哪一条消息
+	Biz      string `gorm:"type:VARCHAR(64);index:biz_msg"`
+	MsgDB    string `gorm:"type:VARCHAR(64);index:biz_msg"`
+	MsgTable string `gorm:"type:VARCHAR(64);index:biz_msg"`
+	MsgId    int64  `gorm:"index:biz_msg"`
+	Action   string `gorm:"type:VARCHAR(32)"`
+	// BeforeStatus 和 AfterStatus 操作前后消息的状态
+	BeforeStatus int8
+	AfterStatus  int8
+	// Diff 消息内容的变化，JSON 格式
+	Diff  []byte `gorm:"type:TEXT"`
+	Ctime int64  `gorm:"index"`
+}
+
+func (AuditLog) TableName() string {
+	return "local_msg_audit_logs"
+}
+
+// AuditQuery 审计日志的筛选条件，为零值的条件不生效
+type AuditQuery struct {
+	Biz    string `json:"biz,omitempty"`
+	DB     string `json:"db,omitempty"`
+	Table  string `json:"table,omitempty"`
+	MsgId  int64  `json:"msgId,omitempty"`
+	Actor  string `json:"actor,omitempty"`
+	Action string `json:"action,omitempty"`
+
+	StartTime int64 `json:"startTime,omitempty"`
+	EndTime   int64 `json:"endTime,omitempty"`
+	// Cursor 上一页最后一条日志的 id
+	Cursor int64 `json:"cursor,omitempty"`
+	Limit  int   `json:"limit,omitempty"`
+}
+
+type AuditDAO struct {
+	db *gorm.DB
+}
+
+func NewAuditDAO(db *gorm.DB) *AuditDAO {
+	return &AuditDAO{db: db}
+}
+
+// InitTable 初始化 local_msg_audit_logs 表
+func (dao *AuditDAO) InitTable() error {
+	return dao.db.AutoMigrate(&AuditLog{})
+}
+
+func (dao *AuditDAO) Insert(ctx context.Context, logs []AuditLog) error {
+	return dao.db.WithContext(ctx).CreateInBatches(logs, 100).Error
+}
+
+// List 按照 id 降序返回，q.Cursor 不为 0 的时候从它之后开始
+func (dao *AuditDAO) List(ctx context.Context, q AuditQuery) ([]AuditLog, error) {
+	db := dao.db.WithContext(ctx).Limit(q.Limit).Order("id DESC")
+	if q.Cursor > 0 {
+		db = db.Where("id < ?", q.Cursor)
+	}
+	if q.Biz != "" {
+		db = db.Where("biz = ?", q.Biz)
+	}
+	if q.DB != "" {
+		db = db.Where("msg_db = ?", q.DB)
+	}
+	if q.Table != "" {
+		db = db.Where("msg_table = ?", q.Table)
+	}
+	if q.MsgId > 0 {
+		db = db.Where("msg_id = ?", q.MsgId)
+	}
+	if q.Actor != "" {
+		db = db.Where("actor = ?", q.Actor)
+	}
+	if q.Action != "" {
+		db = db.Where("action = ?", q.Action)
+	}
+	if q.StartTime > 0 {
+		db = db.Where("ctime >= ?", q.StartTime)
+	}
+	if q.EndTime > 0 {
+		db = db.Where("ctime <= ?", q.EndTime)
+	}
+	var res []AuditLog
+	err := db.Find(&res).Error
+	return res, err
+}
@@ -20,28 +20,141 @@ func (dao *MsgDAO) Get(ctx context.Context, table string, id int64) (LocalMsg, e
 	return res, err
 }
 
+// List 按照 id 降序返回符合条件的消息
+// q.Cursor 不为 0 的时候使用 id 翻页，忽略 Offset，这样翻页的开销和翻到第几页无关
 func (dao *MsgDAO) List(ctx context.Context, q Query) ([]LocalMsg, error) {
 	var res []LocalMsg
 	db := dao.db.WithContext(ctx).
-		Offset(q.Offset).
 		Limit(q.Limit).
 		Table(q.Table).Order("id DESC")
-	if q.Status >= 0 {
-		db = db.Where("status=?", q.Status)
+	if q.Cursor > 0 {
+		db = db.Where("id < ?", q.Cursor)
+	} else {
+		db = db.Offset(q.Offset)
 	}
-	if q.Key != "" {
-		db = db.Where("`key` = ?", q.Key)
+	err := q.where(db).Find(&res).Error
+	return res, err
+}
+
+// UpdateData 修改 status 在 statuses 中的消息的内容，返回被更新的数量
+// status 小于 0 的时候不修改状态，否则在同一个 UPDATE 中把状态修改为 status
+// 第一次修改的时候，original 会保存在 original_data 列上，之后再修改也不会覆盖。
+// 不能写成 COALESCE(original_data, data)，因为 MySQL 从左到右执行赋值，此时 data 已经是新的内容了
+func (dao *MsgDAO) UpdateData(ctx context.Context, table string, id int64,
+	statuses []int8, key string, data, original []byte, status int8) (int64, error) {
+	fields := map[string]any{
+		"original_data": gorm.Expr("COALESCE(original_data, ?)", original),
+		"key":           key,
+		"data":          data,
+		"utime":         time.Now().UnixMilli(),
+	}
+	if status >= 0 {
+		fields["status"] = status
 	}
+	res := dao.db.WithContext(ctx).Table(table).
+		Where("id = ? AND status IN ?", id, statuses).
+		Updates(fields)
+	return res.RowsAffected, res.Error
+}
 
-	if q.StartTime > 0 {
-		db = db.Where("`ctime` >= ?", q.StartTime)
+func (dao *MsgDAO) Delete(ctx context.Context, table string, id int64) (int64, error) {
+	res := dao.db.WithContext(ctx).Table(table).
+		Where("id = ?", id).Delete(&LocalMsg{})
+	return res.RowsAffected, res.Error
+}
+
+// Position 按照 ctime, id 降序排列的时候，某条消息的位置
+type Position struct {
+	Ctime int64 `json:"ctime"`
+	Id    int64 `json:"id"`
+}
+
+// ListByCtime 按照 ctime, id 降序返回符合条件的消息，忽略 Offset
+// after 不为 nil 的时候，只返回排在它后面的消息，这样翻页的开销和翻到第几页无关
+func (dao *MsgDAO) ListByCtime(ctx context.Context, q Query, after *Position) ([]LocalMsg, error) {
+	var res []LocalMsg
+	db := q.where(dao.db.WithContext(ctx).Table(q.Table))
+	if after != nil {
+		db = db.Where("ctime < ? OR (ctime = ? AND id < ?)", after.Ctime, after.Ctime, after.Id)
 	}
+	err := db.Order("ctime DESC, id DESC").Limit(q.Limit).Find(&res).Error
+	return res, err
+}
 
-	if q.EndTime > 0 {
-		db = db.Where("`ctime` <= ?", q.EndTime)
+// SendTimesCount 某个发送次数的消息数量
+type SendTimesCount struct {
+	SendTimes int
+	Cnt       int64
+}
+
+// CountBySendTimes 统计 status 在 statuses 中的消息按照发送次数的分布，
+// 最多统计 limit 条，避免积压严重的时候扫描整张表
+func (dao *MsgDAO) CountBySendTimes(ctx context.Context, table string,
+	statuses []int8, limit int) ([]SendTimesCount, error) {
+	var res []SendTimesCount
+	sub := dao.db.WithContext(ctx).Table(table).
+		Select("send_times").Where("status IN ?", statuses).Limit(limit)
+	err := dao.db.WithContext(ctx).Table("(?) AS t", sub).
+		Select("send_times, COUNT(*) AS cnt").
+		Group("send_times").Scan(&res).Error
+	return res, err
+}
+
+// CountByQuery 统计符合条件，并且 status 在 statuses 中的消息数量，忽略 Offset 和 Limit
+func (dao *MsgDAO) CountByQuery(ctx context.Context, q Query, statuses []int8) (int64, error) {
+	var res int64
+	err := q.where(dao.db.WithContext(ctx).Table(q.Table)).
+		Where("status IN ?", statuses).Count(&res).Error
+	return res, err
+}
+
+// ListByQuery 返回符合条件，并且 status 在 statuses 中的消息，结果按照 id 升序，忽略 Offset
+func (dao *MsgDAO) ListByQuery(ctx context.Context, q Query, statuses []int8) ([]LocalMsg, error) {
+	var res []LocalMsg
+	err := q.where(dao.db.WithContext(ctx).Table(q.Table)).
+		Where("status IN ?", statuses).
+		Order("id ASC").Limit(q.Limit).Find(&res).Error
+	return res, err
+}
+
+// ListByIds 按照 id 查找，只返回 status 在 statuses 中的消息，statuses 为空的时候不限制状态，结果按照 id 升序
+func (dao *MsgDAO) ListByIds(ctx context.Context, table string, ids []int64, statuses []int8) ([]LocalMsg, error) {
+	var res []LocalMsg
+	db := dao.db.WithContext(ctx).Table(table).Where("id IN ?", ids)
+	if len(statuses) > 0 {
+		db = db.Where("status IN ?", statuses)
 	}
+	err := db.Order("id ASC").Find(&res).Error
+	return res, err
+}
+
+// UpdateStatus 将 ids 中 status 依旧在 statuses 中的消息更新为 fields，返回被更新的数量
+// 查询和更新之间，消息的状态可能已经被补偿任务修改了，所以更新的时候要再次校验
+func (dao *MsgDAO) UpdateStatus(ctx context.Context, table string, ids []int64,
+	statuses []int8, fields map[string]any) (int64, error) {
+	res := dao.db.WithContext(ctx).Table(table).
+		Where("id IN ? AND status IN ?", ids, statuses).
+		Updates(fields)
+	return res.RowsAffected, res.Error
+}
 
-	err := db.Find(&res).Error
+// Count 统计某个状态的消息数量，最多统计到 limit 条，
+// 避免积压严重的时候扫描太多数据
+func (dao *MsgDAO) Count(ctx context.Context, table string, status int8, limit int) (int64, error) {
+	var res int64
+	sub := dao.db.WithContext(ctx).Table(table).
+		Select("id").Where("status=?", status).Limit(limit)
+	err := dao.db.WithContext(ctx).Table("(?) AS t", sub).Count(&res).Error
+	return res, err
+}
+
+// OldestPending 返回 ctime 最早的待发送消息，也就是创建之后等待最久的消息，
+// 可以走 status, ctime 联合索引。没有待发送消息的时候返回 gorm.ErrRecordNotFound
+func (dao *MsgDAO) OldestPending(ctx context.Context, table string) (LocalMsg, error) {
+	var res LocalMsg
+	err := dao.db.WithContext(ctx).Table(table).
+		Where("status=?", MsgStatusInit).
+		Order("ctime ASC").Limit(1).Take(&res).Error
 	return res, err
 }
 
@@ -54,8 +167,10 @@ func NewMsgDAO(db *gorm.DB) *MsgDAO {
 type Query struct {
 	Table  string `json:"table,omitempty"`
 	Offset int    `json:"offset,omitempty"`
-	Limit  int    `json:"limit,omitempty"`
-	Status int8   `json:"status,omitempty"`
+	// Cursor 上一页最后一条消息的 id，只有 List 会使用，不为 0 的时候忽略 Offset
+	Cursor int64 `json:"cursor,omitempty"`
+	Limit  int   `json:"limit,omitempty"`
+	Status int8  `json:"status,omitempty"`
 	// Key 是精准查询
 	Key string `json:"key,omitempty"`
 
@@ -63,6 +178,24 @@ type Query struct {
 	EndTime   int64 `json:"endTime,omitempty"`
 }
 
+func (q Query) where(db *gorm.DB) *gorm.DB {
+	if q.Status >= 0 {
+		db = db.Where("status=?", q.Status)
+	}
+	if q.Key != "" {
+		db = db.Where("`key` = ?", q.Key)
+	}
+
+	if q.StartTime > 0 {
+		db = db.Where("`ctime` >= ?", q.StartTime)
+	}
+
+	if q.EndTime > 0 {
+		db = db.Where("`ctime` <= ?", q.EndTime)
+	}
+	return db
+}
+
 type LocalMsg struct {
 	Id int64 `gorm:"primaryKey,autoIncrement"`
 
@@ -74,10 +207,15 @@ type LocalMsg struct {
 
 	// 在更新时间和 status 上创建联合索引，
 	// 保证在 WHERE 过滤数据的时候，不需要回表
-	Status int8 `gorm:"index:utime_status"`
+	// status, ctime 联合索引用于查找等待最久的待发送消息
+	Status int8 `gorm:"index:utime_status;index:ctime_status"`
 	// 更新时间
 	Utime int64 `gorm:"index:utime_status"`
-	Ctime int64
+	Ctime int64 `gorm:"index:ctime_status"`
+
+	// OriginalData 管理后台第一次修改消息内容之前的内容，只会通过 UpdateData 写入
+	// 设置为只读，这样 AutoMigrate 会创建这一列，但是保存消息的时候不会用到它，老的表也可以正常保存消息
+	OriginalData []byte `gorm:"->;type:TEXT"`
 }
 
 func (l LocalMsg) TableName() string {
@@ -88,4 +226,10 @@ const (
 	MsgStatusInit int8 = iota
 	MsgStatusSuccess
 	MsgStatusFail
+	// MsgStatusMigrating 扩容迁移中，消息已经被迁移工具抢占，补偿任务不会再发送
+	MsgStatusMigrating
+	// MsgStatusMigrated 已经迁移到了新规则下的目标表，由目标表负责发送
+	MsgStatusMigrated
+	// MsgStatusAbandoned 通过管理后台放弃的消息，不会再发送
+	MsgStatusAbandoned
 )
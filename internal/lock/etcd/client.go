@@ -0,0 +1,20 @@
+package elock
+
+import (
+	"context"
+	dlock "github.com/meoying/local-msg-go/internal/lock"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"time"
+)
+
+type Client struct {
+	client *clientv3.Client
+}
+
+func NewClient(client *clientv3.Client) *Client {
+	return &Client{client: client}
+}
+
+func (c *Client) NewLock(ctx context.Context, key string, expiration time.Duration) (dlock.Lock, error) {
+	return NewLock(c.client, key, expiration), nil
+}
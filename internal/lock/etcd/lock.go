@@ -0,0 +1,170 @@
+package elock
+
+import (
+	"context"
+	"errors"
+	"github.com/ecodeclub/ekit/bean/option"
+	"github.com/ecodeclub/ekit/retry"
+	"github.com/google/uuid"
+	"github.com/meoying/local-msg-go/internal/lock/errs"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"time"
+)
+
+// Lock 基于 etcd 的实现
+// 整体思路是创建一个租约，而后在 key 不存在的时候，带着租约写入 key，写入成功就是加锁成功
+// 续约就是续租约，租约过期 etcd 会自动删除 key，也就相当于释放了锁
+// 加锁成功时候 key 的 revision 在整个 etcd 集群中是单调递增的，所以可以用来识别锁的不同持有者
+type Lock struct {
+	client     *clientv3.Client
+	key        string
+	value      string
+	valuer     func() string
+	expiration time.Duration
+
+	leaseID clientv3.LeaseID
+	// 加锁成功之后 key 的 revision
+	revision int64
+
+	// 加锁的时候的单一一次超时
+	lockTimeout time.Duration
+	// 重试策略
+	lockRetry retry.Strategy
+}
+
+// NewLock 创建一个分布式锁
+// 注意 etcd 的租约是以秒为单位的，所以 expiration 不足一秒的部分会被忽略
+func NewLock(client *clientv3.Client, key string,
+	expiration time.Duration, opts ...option.Option[Lock]) *Lock {
+	strategy, _ := retry.NewExponentialBackoffRetryStrategy(time.Millisecond*100, time.Second, 10)
+	l := &Lock{
+		client: client,
+		// etcd 的写操作需要经过 raft 达成共识，比 Redis 慢一些
+		lockTimeout: time.Millisecond * 500,
+		valuer: func() string {
+			return uuid.New().String()
+		},
+		key:        key,
+		expiration: expiration,
+		lockRetry:  strategy,
+		leaseID:    clientv3.NoLease,
+	}
+	option.Apply(l, opts...)
+	l.value = l.valuer()
+	return l
+}
+
+// Lock 会尝试加锁。当加锁失败的时候，会尝试重试。
+// 最终加锁失败的时候，会撤销创建的租约，而不是等它自然过期
+func (l *Lock) Lock(ctx context.Context) error {
+	err := retry.Retry(ctx, l.lockRetry, func() error {
+		lctx, cancel := context.WithTimeout(ctx, l.lockTimeout)
+		defer cancel()
+		return l.tryLock(lctx)
+	})
+	if err != nil && l.leaseID != clientv3.NoLease {
+		// ctx 可能已经被取消了，所以用一个新的
+		rctx, cancel := context.WithTimeout(context.Background(), l.lockTimeout)
+		defer cancel()
+		if _, rerr := l.client.Revoke(rctx, l.leaseID); rerr != nil &&
+			!errors.Is(rerr, rpctypes.ErrLeaseNotFound) {
+			err = errors.Join(err, rerr)
+		}
+		l.leaseID = clientv3.NoLease
+	}
+	return err
+}
+
+func (l *Lock) tryLock(ctx context.Context) error {
+	// 重试的时候复用上一次创建的租约
+	if l.leaseID == clientv3.NoLease {
+		ttl := int64(l.expiration.Seconds())
+		if ttl < 1 {
+			ttl = 1
+		}
+		lease, err := l.client.Grant(ctx, ttl)
+		if err != nil {
+			return err
+		}
+		l.leaseID = lease.ID
+	}
+	resp, err := l.client.Txn(ctx).
+		// CreateRevision 为 0 就是 key 不存在
+		If(clientv3.Compare(clientv3.CreateRevision(l.key), "=", 0)).
+		Then(clientv3.OpPut(l.key, l.value, clientv3.WithLease(l.leaseID))).
+		Else(clientv3.OpGet(l.key)).
+		Commit()
+	if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		// 重试的间隔太长，租约已经过期了，下一次重新创建
+		l.leaseID = clientv3.NoLease
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if resp.Succeeded {
+		l.revision = resp.Header.Revision
+		return nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	if len(kvs) > 0 && string(kvs[0].Value) == l.value {
+		// 自己之前加锁成功了，比如说因为超时之类的导致没收到成功响应
+		l.revision = kvs[0].ModRevision
+		return nil
+	}
+	return errs.ErrLocked
+}
+
+// FencingToken 就是加锁成功时候 key 的 revision
+func (l *Lock) FencingToken() int64 {
+	return l.revision
+}
+
+// Refresh 续约租约。
+// 除了租约本身要还在，key 也必须依旧是加锁时候写入的那个，否则就认为锁已经不在自己手里了
+func (l *Lock) Refresh(ctx context.Context) error {
+	if l.revision == 0 {
+		return errs.ErrLockNotHold
+	}
+	_, err := l.client.KeepAliveOnce(ctx, l.leaseID)
+	if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		return errs.ErrLockNotHold
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := l.client.Get(ctx, l.key)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 || resp.Kvs[0].ModRevision != l.revision {
+		return errs.ErrLockNotHold
+	}
+	return nil
+}
+
+// Unlock 删除 key 并且撤销租约。它并不会重试，如果失败了那就是失败了，等租约自然过期
+func (l *Lock) Unlock(ctx context.Context) error {
+	if l.revision == 0 {
+		return errs.ErrLockNotHold
+	}
+	resp, err := l.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(l.key), "=", l.revision)).
+		Then(clientv3.OpDelete(l.key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	// 不管 key 还在不在，租约都没有用了。租约已经过期的话就不需要撤销了
+	_, err = l.client.Revoke(ctx, l.leaseID)
+	if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		err = nil
+	}
+	l.leaseID = clientv3.NoLease
+	l.revision = 0
+	if !resp.Succeeded {
+		return errs.ErrLockNotHold
+	}
+	return err
+}
@@ -0,0 +1,256 @@
+package elock
+
+import (
+	"context"
+	"github.com/ecodeclub/ekit/retry"
+	"github.com/meoying/local-msg-go/internal/lock/errs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// LockTestSuite 使用进程内启动的 etcd，不依赖外部服务
+type LockTestSuite struct {
+	suite.Suite
+	server *embed.Etcd
+	client *clientv3.Client
+}
+
+func (s *LockTestSuite) SetupSuite() {
+	cfg := embed.NewConfig()
+	cfg.Dir = s.T().TempDir()
+	cfg.LogLevel = "error"
+	// 端口 0 表示由系统随机分配
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	server, err := embed.StartEtcd(cfg)
+	require.NoError(s.T(), err)
+	s.server = server
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(time.Second * 10):
+		server.Close()
+		s.T().Fatal("启动 etcd 超时")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{server.Clients[0].Addr().String()},
+		DialTimeout: time.Second * 3,
+	})
+	require.NoError(s.T(), err)
+	s.client = client
+}
+
+func (s *LockTestSuite) TearDownSuite() {
+	_ = s.client.Close()
+	s.server.Close()
+}
+
+func (s *LockTestSuite) TearDownTest() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	_, err := s.client.Delete(ctx, "", clientv3.WithFromKey())
+	require.NoError(s.T(), err)
+}
+
+func TestLock(t *testing.T) {
+	suite.Run(t, &LockTestSuite{})
+}
+
+func (s *LockTestSuite) TestLock() {
+	testCases := []struct {
+		name string
+		key  string
+
+		before func(t *testing.T)
+		after  func(t *testing.T, l *Lock)
+
+		wantErr error
+	}{
+		{
+			name:   "加锁成功",
+			key:    "locked-key",
+			before: func(t *testing.T) {},
+			after: func(t *testing.T, l *Lock) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				defer cancel()
+				resp, err := s.client.Get(ctx, "locked-key")
+				require.NoError(t, err)
+				require.Len(t, resp.Kvs, 1)
+				assert.Equal(t, l.value, string(resp.Kvs[0].Value))
+				assert.Equal(t, l.revision, resp.Kvs[0].ModRevision)
+				assert.Equal(t, int64(l.leaseID), resp.Kvs[0].Lease)
+			},
+		},
+		{
+			name: "加锁失败，锁被人持有",
+			key:  "failed-key",
+			before: func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				defer cancel()
+				_, err := s.client.Put(ctx, "failed-key", "123")
+				require.NoError(t, err)
+			},
+			after: func(t *testing.T, l *Lock) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				defer cancel()
+				resp, err := s.client.Get(ctx, "failed-key")
+				require.NoError(t, err)
+				require.Len(t, resp.Kvs, 1)
+				assert.Equal(t, "123", string(resp.Kvs[0].Value))
+				// 加锁失败之后租约被撤销了
+				assert.Equal(t, clientv3.NoLease, l.leaseID)
+			},
+			wantErr: errs.ErrLocked,
+		},
+	}
+
+	for _, tc := range testCases {
+		s.T().Run(tc.name, func(t *testing.T) {
+			tc.before(t)
+			strategy, _ := retry.NewFixedIntervalRetryStrategy(time.Millisecond*100, 3)
+			l := NewLock(s.client, tc.key, time.Minute, WithLockRetryStrategy(strategy))
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			err := l.Lock(ctx)
+			assert.ErrorIs(t, err, tc.wantErr)
+			tc.after(t, l)
+		})
+	}
+}
+
+func (s *LockTestSuite) TestRefresh() {
+	testCases := []struct {
+		name   string
+		before func(t *testing.T) *Lock
+
+		wantErr error
+	}{
+		{
+			name: "续约成功",
+			before: func(t *testing.T) *Lock {
+				return s.lock(t, "refresh-key1", time.Second*5)
+			},
+		},
+		{
+			name: "续约失败，租约已经过期",
+			before: func(t *testing.T) *Lock {
+				l := s.lock(t, "refresh-key2", time.Second)
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				defer cancel()
+				_, err := s.client.Revoke(ctx, l.leaseID)
+				require.NoError(t, err)
+				return l
+			},
+			wantErr: errs.ErrLockNotHold,
+		},
+		{
+			name: "续约失败，key 被人篡改",
+			before: func(t *testing.T) *Lock {
+				l := s.lock(t, "refresh-key3", time.Second*5)
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				defer cancel()
+				_, err := s.client.Put(ctx, "refresh-key3", "123")
+				require.NoError(t, err)
+				return l
+			},
+			wantErr: errs.ErrLockNotHold,
+		},
+		{
+			name: "续约失败，没有加锁",
+			before: func(t *testing.T) *Lock {
+				return NewLock(s.client, "refresh-key4", time.Second*5)
+			},
+			wantErr: errs.ErrLockNotHold,
+		},
+	}
+
+	for _, tc := range testCases {
+		s.T().Run(tc.name, func(t *testing.T) {
+			l := tc.before(t)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+			err := l.Refresh(ctx)
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
+
+func (s *LockTestSuite) TestUnlock() {
+	testCases := []struct {
+		name   string
+		before func(t *testing.T) *Lock
+		after  func(t *testing.T)
+
+		wantErr error
+	}{
+		{
+			name: "解锁成功",
+			before: func(t *testing.T) *Lock {
+				return s.lock(t, "unlock-key1", time.Minute)
+			},
+			after: func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				defer cancel()
+				resp, err := s.client.Get(ctx, "unlock-key1")
+				require.NoError(t, err)
+				assert.Len(t, resp.Kvs, 0)
+			},
+		},
+		{
+			name: "解锁失败，锁已经被别人拿走",
+			before: func(t *testing.T) *Lock {
+				l := s.lock(t, "unlock-key2", time.Minute)
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				defer cancel()
+				_, err := s.client.Put(ctx, "unlock-key2", "123")
+				require.NoError(t, err)
+				return l
+			},
+			after: func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				defer cancel()
+				resp, err := s.client.Get(ctx, "unlock-key2")
+				require.NoError(t, err)
+				require.Len(t, resp.Kvs, 1)
+				assert.Equal(t, "123", string(resp.Kvs[0].Value))
+			},
+			wantErr: errs.ErrLockNotHold,
+		},
+		{
+			name: "解锁失败，没有加锁",
+			before: func(t *testing.T) *Lock {
+				return NewLock(s.client, "unlock-key3", time.Minute)
+			},
+			after:   func(t *testing.T) {},
+			wantErr: errs.ErrLockNotHold,
+		},
+	}
+
+	for _, tc := range testCases {
+		s.T().Run(tc.name, func(t *testing.T) {
+			l := tc.before(t)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+			err := l.Unlock(ctx)
+			assert.ErrorIs(t, err, tc.wantErr)
+			tc.after(t)
+		})
+	}
+}
+
+func (s *LockTestSuite) lock(t *testing.T, key string, expiration time.Duration) *Lock {
+	l := NewLock(s.client, key, expiration)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	err := l.Lock(ctx)
+	require.NoError(t, err)
+	return l
+}
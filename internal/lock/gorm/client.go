@@ -19,6 +19,8 @@ func (c *Client) NewLock(ctx context.Context, key string, expiration time.Durati
 	return NewLock(c.db, key, expiration), nil
 }
 
+// InitTable 创建或者升级 distributed_locks 表。老的表上没有 key 的唯一索引，
+// 升级的时候有重复的 key 会失败，参考 README 中的升级说明
 func (c *Client) InitTable() error {
 	return c.db.AutoMigrate(&DistributedLock{})
 }
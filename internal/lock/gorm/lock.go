@@ -31,6 +31,9 @@ type Lock struct {
 	tableName string
 
 	mode string
+
+	// 加锁成功之后的版本号，用作 fencing token
+	version int64
 }
 
 // NewLock 创建一个分布式锁，使用 ModeInsertFirst
@@ -111,7 +114,7 @@ func (l *Lock) lockByCASFirst(ctx context.Context) error {
 func (l *Lock) insertLock(ctx context.Context) error {
 	now := time.Now().UnixMilli()
 	db := l.db.WithContext(ctx)
-	return db.Create(&DistributedLock{
+	err := db.Create(&DistributedLock{
 		Key:        l.key,
 		Value:      l.value,
 		Status:     StatusLocked,
@@ -120,6 +123,10 @@ func (l *Lock) insertLock(ctx context.Context) error {
 		Utime:      now,
 		Ctime:      now,
 	}).Error
+	if err == nil {
+		l.version = 1
+	}
+	return err
 }
 
 // 使用 CAS 机制来抢锁
@@ -137,6 +144,7 @@ func (l *Lock) casLock(ctx context.Context) error {
 	if lock.Status == StatusLocked && lock.Value == l.value {
 		// 自己之前加锁成功了。比如说因为超时之类的导致第一次加锁成功了但是没收到成功响应
 		// 那么重试的时候，就会直接成功
+		l.version = lock.Version
 		return nil
 	}
 	// 还在被人拿着
@@ -162,6 +170,7 @@ func (l *Lock) casLock(ctx context.Context) error {
 	}
 	// 加锁成功
 	if res.RowsAffected > 0 {
+		l.version = lock.Version + 1
 		return nil
 	}
 	// 刚刚被人抢走
@@ -182,12 +191,18 @@ func (l *Lock) Unlock(ctx context.Context) error {
 	if res.Error != nil {
 		return res.Error
 	}
+	l.version = 0
 	if res.RowsAffected > 0 {
 		return nil
 	}
 	return errs.ErrLockNotHold
 }
 
+// FencingToken 就是加锁成功时候的版本号，每一次加锁成功版本号都会 +1
+func (l *Lock) FencingToken() int64 {
+	return l.version
+}
+
 func (l *Lock) Refresh(ctx context.Context) error {
 	now := time.Now().UnixMilli()
 	res := l.db.WithContext(ctx).Model(&DistributedLock{}).
@@ -210,10 +225,10 @@ func (l *Lock) Refresh(ctx context.Context) error {
 // 注意这里我们不需要一个 expiration 字段
 type DistributedLock struct {
 	Id int64 `gorm:"primaryKey,autoIncrement"`
-	// 唯一索引
-	Key string `gorm:"unique,type=VARCHAR(256)"`
+	// 唯一索引，ModeInsertFirst 依赖它保证只有一个节点能插入成功
+	Key string `gorm:"type:VARCHAR(256);uniqueIndex"`
 	// 用固定长度的 CHAR 稍微有点性能提升
-	Value string `gorm:"type=CHAR(64)"`
+	Value string `gorm:"type:CHAR(64)"`
 
 	Status uint8
 
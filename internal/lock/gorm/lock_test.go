@@ -405,6 +405,27 @@ func (s *LockTestSuite) TestRefresh() {
 	}
 }
 
+func (s *LockTestSuite) TestFencingToken() {
+	t := s.T()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	l1 := NewLock(s.db, "fencing_key", time.Minute)
+	assert.Equal(t, int64(0), l1.FencingToken())
+	err := l1.Lock(ctx)
+	require.NoError(t, err)
+	token1 := l1.FencingToken()
+	assert.True(t, token1 > 0)
+	err = l1.Unlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), l1.FencingToken())
+
+	// 后一次加锁拿到的令牌更大
+	l2 := NewLock(s.db, "fencing_key", time.Minute)
+	err = l2.Lock(ctx)
+	require.NoError(t, err)
+	assert.True(t, l2.FencingToken() > token1)
+}
+
 func TestLockTestSuite(t *testing.T) {
 	suite.Run(t, new(LockTestSuite))
 }
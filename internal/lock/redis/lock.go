@@ -35,6 +35,9 @@ type Lock struct {
 	lockTimeout time.Duration
 	// 重试策略
 	lockRetry retry.Strategy
+
+	// 加锁成功之后拿到的 fencing token
+	token int64
 }
 
 // NewLock 创建一个分布式锁
@@ -68,23 +71,35 @@ func (l *Lock) Lock(ctx context.Context) error {
 		defer cancel()
 		res, err := l.client.Eval(lctx,
 			luaLock,
-			[]string{l.key}, l.value, l.expiration).Result()
+			[]string{l.key, l.fencingKey()}, l.value, l.expiration.Milliseconds()).Int64()
 		// 加锁失败。虽然从理论上来说，此时加锁有可能是因为一些不可挽回的错误造成的
 		// 但是我们这里没有区分处理
 		if err != nil {
 			return err
 		}
-		if res == "OK" {
+		if res > 0 {
+			l.token = res
 			return nil
 		}
 		return errs.ErrLocked
 	})
 }
 
+// FencingToken 每一次加锁成功，都会递增 Redis 上的一个计数器
+// 注意，如果 Redis 丢失了这个计数器，那么令牌就会从头开始
+func (l *Lock) FencingToken() int64 {
+	return l.token
+}
+
+// fencingKey 使用 hash tag，确保在 Redis Cluster 下和锁的 key 落在同一个 slot
+func (l *Lock) fencingKey() string {
+	return "{" + l.key + "}:fencing"
+}
+
 // Refresh 延长过期时间。
 func (l *Lock) Refresh(ctx context.Context) error {
 	res, err := l.client.Eval(ctx, luaRefresh,
-		[]string{l.key}, l.value, l.expiration.Seconds()).Int64()
+		[]string{l.key}, l.value, l.expiration.Milliseconds()).Int64()
 	if err != nil {
 		return err
 	}
@@ -97,6 +112,7 @@ func (l *Lock) Refresh(ctx context.Context) error {
 // Unlock 并不会重试。如果失败了那就是失败了，等它自然过期
 func (l *Lock) Unlock(ctx context.Context) error {
 	res, err := l.client.Eval(ctx, luaUnlock, []string{l.key}, l.value).Int64()
+	l.token = 0
 	if errors.Is(err, redis.Nil) {
 		return errs.ErrLockNotHold
 	}
@@ -78,6 +78,10 @@ func (s *LockTestSuite) TestLock() {
 			expiration: time.Minute,
 			before:     func() {},
 			after: func() {
+				ttl, err := rdb.TTL(context.Background(), "locked-key").Result()
+				require.NoError(t, err)
+				// 过期时间是以毫秒为单位设置的
+				assert.True(t, ttl > time.Second*50 && ttl <= time.Minute)
 				res, err := rdb.Del(context.Background(), "locked-key").Result()
 				require.NoError(t, err)
 				require.Equal(t, int64(1), res)
@@ -126,6 +130,33 @@ func (s *LockTestSuite) TestLock() {
 	}
 }
 
+func (s *LockTestSuite) TestFencingToken() {
+	t := s.T()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	l1 := NewLock(s.rdb, "fencing-key", time.Minute)
+	defer func() {
+		_, err := s.rdb.Del(ctx, "fencing-key", l1.fencingKey()).Result()
+		require.NoError(t, err)
+	}()
+	assert.Equal(t, int64(0), l1.FencingToken())
+	err := l1.Lock(ctx)
+	require.NoError(t, err)
+	token1 := l1.FencingToken()
+	assert.True(t, token1 > 0)
+	err = l1.Unlock(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), l1.FencingToken())
+
+	// 后一次加锁拿到的令牌更大
+	l2 := NewLock(s.rdb, "fencing-key", time.Minute)
+	err = l2.Lock(ctx)
+	require.NoError(t, err)
+	assert.True(t, l2.FencingToken() > token1)
+	err = l2.Unlock(ctx)
+	require.NoError(t, err)
+}
+
 func (s *LockTestSuite) TestRefresh() {
 	t := s.T()
 	rdb := s.rdb
@@ -1,6 +1,6 @@
 if redis.call("get", KEYS[1]) == ARGV[1]
 then
-    return redis.call("expire", KEYS[1], ARGV[2])
+    return redis.call("pexpire", KEYS[1], ARGV[2])
 else
     return 0
 end
\ No newline at end of file
@@ -0,0 +1,23 @@
+package redlock
+
+import (
+	"context"
+	"github.com/ecodeclub/ekit/bean/option"
+	dlock "github.com/meoying/local-msg-go/internal/lock"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+type Client struct {
+	clients []redis.Cmdable
+	opts    []option.Option[Lock]
+}
+
+// NewClient clients 是相互独立的 Redis 实例，而不是同一个集群的不同节点
+func NewClient(clients []redis.Cmdable, opts ...option.Option[Lock]) *Client {
+	return &Client{clients: clients, opts: opts}
+}
+
+func (c *Client) NewLock(ctx context.Context, key string, expiration time.Duration) (dlock.Lock, error) {
+	return NewLock(c.clients, key, expiration, c.opts...), nil
+}
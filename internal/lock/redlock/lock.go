@@ -0,0 +1,170 @@
+package redlock
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"github.com/ecodeclub/ekit/bean/option"
+	"github.com/ecodeclub/ekit/retry"
+	"github.com/google/uuid"
+	"github.com/meoying/local-msg-go/internal/lock/errs"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"time"
+)
+
+var (
+	//go:embed lua/unlock.lua
+	luaUnlock string
+	//go:embed lua/refresh.lua
+	luaRefresh string
+	//go:embed lua/lock.lua
+	luaLock string
+)
+
+// Lock 基于多个相互独立的 Redis 实例的分布式锁，也就是 Redis 官方提出的 Redlock 算法
+// 单一 Redis 实例（包括主从）在主从切换的时候，可能会把同一把锁交给两个节点；
+// 而 Redlock 要求在超过半数的实例上加锁成功，只要不是超过半数的实例同时出问题，锁就是安全的
+//
+// 加锁的时候还需要扣除加锁本身的耗时，以及各个实例之间的时钟漂移，剩余的有效时间大于 0 才算加锁成功
+type Lock struct {
+	clients    []redis.Cmdable
+	key        string
+	value      string
+	valuer     func() string
+	expiration time.Duration
+
+	// 访问单一一个 Redis 实例的超时时间，它应该远小于 expiration
+	// 否则某个实例卡住的时候，加锁耗时太长，锁的有效时间就不剩多少了
+	nodeTimeout time.Duration
+	// 时钟漂移系数，时钟漂移就是 expiration * driftFactor
+	driftFactor float64
+	// 重试策略
+	lockRetry retry.Strategy
+}
+
+// NewLock 创建一个分布式锁，clients 是相互独立的 Redis 实例，一般来说是奇数个
+// 默认情况下采用指数退避的算法来重试。
+func NewLock(clients []redis.Cmdable, key string,
+	expiration time.Duration, opts ...option.Option[Lock]) *Lock {
+	strategy, _ := retry.NewExponentialBackoffRetryStrategy(time.Millisecond*100, time.Second, 10)
+	l := &Lock{
+		clients:     clients,
+		nodeTimeout: time.Millisecond * 50,
+		driftFactor: 0.01,
+		valuer: func() string {
+			return uuid.New().String()
+		},
+		key:        key,
+		expiration: expiration,
+		lockRetry:  strategy,
+	}
+	option.Apply(l, opts...)
+	l.value = l.valuer()
+	return l
+}
+
+// Lock 会尝试加锁。当加锁失败的时候，会尝试重试。
+// 每一次加锁失败之后，都会尝试释放掉在部分实例上加成功的锁，避免别人要等到这部分锁过期
+// 只有超过半数的实例有响应的时候，加锁失败才是 errs.ErrLocked，否则返回这些实例的错误
+func (l *Lock) Lock(ctx context.Context) error {
+	return retry.Retry(ctx, l.lockRetry, func() error {
+		start := time.Now()
+		res := l.eval(ctx, luaLock, l.expiration.Milliseconds())
+		if res.ok >= l.majority() && l.validity(start) > 0 {
+			return nil
+		}
+		l.eval(context.WithoutCancel(ctx), luaUnlock)
+		if len(l.clients)-len(res.errs) < l.majority() {
+			// 没办法确定锁是不是被人持有，多半是实例出了问题
+			return errors.Join(res.errs...)
+		}
+		return errs.ErrLocked
+	})
+}
+
+// Refresh 在超过半数的实例上续约成功，并且扣除耗时和时钟漂移之后依旧有剩余时间，才算续约成功
+// 如果超过半数的实例都明确告知锁已经不在自己手里了，那么返回 errs.ErrLockNotHold
+// 否则说明是部分实例出了问题，返回这些实例的错误，调用者可以稍后再试
+func (l *Lock) Refresh(ctx context.Context) error {
+	start := time.Now()
+	res := l.eval(ctx, luaRefresh, l.expiration.Milliseconds())
+	switch {
+	case res.ok >= l.majority():
+		if l.validity(start) > 0 {
+			return nil
+		}
+		// 续约耗时太长，锁可能已经过期了
+		return errs.ErrLockNotHold
+	case res.ok+len(res.errs) >= l.majority():
+		// 出错的实例上锁可能还在，也可能不在，没办法确定
+		return errors.Join(res.errs...)
+	default:
+		return errs.ErrLockNotHold
+	}
+}
+
+// FencingToken Redlock 各个实例是相互独立的，没办法给出一个单调递增的令牌，所以不支持
+func (l *Lock) FencingToken() int64 {
+	return 0
+}
+
+// Unlock 会在所有的实例上释放锁，包括那些加锁的时候没有响应的实例。它并不会重试
+func (l *Lock) Unlock(ctx context.Context) error {
+	res := l.eval(ctx, luaUnlock)
+	if res.ok >= l.majority() {
+		return nil
+	}
+	if len(res.errs) > 0 {
+		return errors.Join(res.errs...)
+	}
+	return errs.ErrLockNotHold
+}
+
+// evalResult 在所有实例上执行脚本的结果
+type evalResult struct {
+	// 脚本返回 1 的实例数量
+	ok int
+	// 出错的实例的错误
+	errs []error
+}
+
+// eval 并发地在所有的实例上执行脚本
+func (l *Lock) eval(ctx context.Context, script string, args ...any) evalResult {
+	args = append([]any{l.value}, args...)
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+		res   evalResult
+	)
+	for _, client := range l.clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nodeCtx, cancel := context.WithTimeout(ctx, l.nodeTimeout)
+			defer cancel()
+			val, err := client.Eval(nodeCtx, script, []string{l.key}, args...).Int64()
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch {
+			case err != nil:
+				res.errs = append(res.errs, err)
+			case val == 1:
+				res.ok++
+			}
+		}()
+	}
+	wg.Wait()
+	return res
+}
+
+// validity 扣除从 start 开始的耗时和时钟漂移之后，锁剩余的有效时间
+func (l *Lock) validity(start time.Time) time.Duration {
+	// 额外的 2ms 是 Redis 本身过期时间的精度
+	drift := time.Duration(float64(l.expiration)*l.driftFactor) + time.Millisecond*2
+	return l.expiration - time.Since(start) - drift
+}
+
+func (l *Lock) majority() int {
+	return len(l.clients)/2 + 1
+}
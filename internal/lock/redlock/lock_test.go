@@ -0,0 +1,272 @@
+package redlock
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ecodeclub/ekit/retry"
+	"github.com/meoying/local-msg-go/internal/lock/errs"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+// LockTestSuite 使用 5 个 miniredis 来模拟相互独立的 Redis 实例
+type LockTestSuite struct {
+	suite.Suite
+	servers []*miniredis.Miniredis
+	clients []redis.Cmdable
+}
+
+func TestLock(t *testing.T) {
+	suite.Run(t, &LockTestSuite{})
+}
+
+func (s *LockTestSuite) SetupTest() {
+	s.servers = make([]*miniredis.Miniredis, 0, 5)
+	s.clients = make([]redis.Cmdable, 0, 5)
+	for i := 0; i < 5; i++ {
+		server := miniredis.RunT(s.T())
+		s.servers = append(s.servers, server)
+		s.clients = append(s.clients, redis.NewClient(&redis.Options{
+			Addr: server.Addr(),
+			// 实例宕机的时候，不要重试
+			MaxRetries: -1,
+		}))
+	}
+}
+
+func (s *LockTestSuite) TestLock() {
+	testCases := []struct {
+		name       string
+		expiration time.Duration
+		before     func(t *testing.T)
+		after      func(t *testing.T, l *Lock)
+
+		wantErr error
+		// wantNodeErr 返回的是实例的错误，而不是 errs.ErrLocked
+		wantNodeErr bool
+	}{
+		{
+			name:       "加锁成功",
+			expiration: time.Minute,
+			before:     func(t *testing.T) {},
+			after: func(t *testing.T, l *Lock) {
+				for _, server := range s.servers {
+					val, err := server.Get("lock-key")
+					require.NoError(t, err)
+					assert.Equal(t, l.value, val)
+					assert.Equal(t, time.Minute, server.TTL("lock-key"))
+				}
+			},
+		},
+		{
+			name:       "加锁成功，少数实例宕机",
+			expiration: time.Minute,
+			before: func(t *testing.T) {
+				s.servers[0].Close()
+				s.servers[1].Close()
+			},
+			after: func(t *testing.T, l *Lock) {
+				for _, server := range s.servers[2:] {
+					val, err := server.Get("lock-key")
+					require.NoError(t, err)
+					assert.Equal(t, l.value, val)
+				}
+			},
+		},
+		{
+			name:       "加锁失败，多数实例宕机",
+			expiration: time.Minute,
+			before: func(t *testing.T) {
+				s.servers[0].Close()
+				s.servers[1].Close()
+				s.servers[2].Close()
+			},
+			after: func(t *testing.T, l *Lock) {
+				// 加成功的部分也要释放掉
+				for _, server := range s.servers[3:] {
+					assert.False(t, server.Exists("lock-key"))
+				}
+			},
+			wantNodeErr: true,
+		},
+		{
+			name:       "加锁失败，多数实例上锁被人持有",
+			expiration: time.Minute,
+			before: func(t *testing.T) {
+				for _, server := range s.servers[:3] {
+					err := server.Set("lock-key", "123")
+					require.NoError(t, err)
+				}
+			},
+			after: func(t *testing.T, l *Lock) {
+				for _, server := range s.servers[:3] {
+					val, err := server.Get("lock-key")
+					require.NoError(t, err)
+					assert.Equal(t, "123", val)
+				}
+				for _, server := range s.servers[3:] {
+					assert.False(t, server.Exists("lock-key"))
+				}
+			},
+			wantErr: errs.ErrLocked,
+		},
+		{
+			name: "加锁失败，扣除时钟漂移之后没有剩余时间",
+			// 时钟漂移就至少有 2ms
+			expiration: time.Millisecond * 2,
+			before:     func(t *testing.T) {},
+			after: func(t *testing.T, l *Lock) {
+				for _, server := range s.servers {
+					assert.False(t, server.Exists("lock-key"))
+				}
+			},
+			wantErr: errs.ErrLocked,
+		},
+	}
+
+	for _, tc := range testCases {
+		s.T().Run(tc.name, func(t *testing.T) {
+			s.SetupTest()
+			tc.before(t)
+			strategy, _ := retry.NewFixedIntervalRetryStrategy(time.Millisecond*10, 2)
+			l := NewLock(s.clients, "lock-key", tc.expiration, WithLockRetryStrategy(strategy))
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+			err := l.Lock(ctx)
+			if tc.wantNodeErr {
+				assert.Error(t, err)
+				assert.NotErrorIs(t, err, errs.ErrLocked)
+			} else {
+				assert.ErrorIs(t, err, tc.wantErr)
+			}
+			tc.after(t, l)
+		})
+	}
+}
+
+func (s *LockTestSuite) TestRefresh() {
+	testCases := []struct {
+		name   string
+		before func(t *testing.T, l *Lock)
+
+		wantErr error
+		// 没办法确定锁还在不在，这个时候返回的是 Redis 的错误，而不是 errs.ErrLockNotHold
+		wantUncertain bool
+	}{
+		{
+			name: "续约成功",
+			before: func(t *testing.T, l *Lock) {
+				for _, server := range s.servers {
+					server.FastForward(time.Second * 30)
+				}
+			},
+		},
+		{
+			name: "续约成功，少数实例上锁被人篡改",
+			before: func(t *testing.T, l *Lock) {
+				for _, server := range s.servers[:2] {
+					err := server.Set("lock-key", "123")
+					require.NoError(t, err)
+				}
+			},
+		},
+		{
+			name: "续约失败，多数实例上锁已经过期",
+			before: func(t *testing.T, l *Lock) {
+				for _, server := range s.servers[:3] {
+					server.FastForward(time.Minute)
+				}
+			},
+			wantErr: errs.ErrLockNotHold,
+		},
+		{
+			name: "续约失败，多数实例宕机，没办法确定锁还在不在",
+			before: func(t *testing.T, l *Lock) {
+				for _, server := range s.servers[:3] {
+					server.Close()
+				}
+			},
+			wantUncertain: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		s.T().Run(tc.name, func(t *testing.T) {
+			s.SetupTest()
+			l := s.lock(t)
+			tc.before(t, l)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+			err := l.Refresh(ctx)
+			if tc.wantUncertain {
+				require.Error(t, err)
+				assert.NotErrorIs(t, err, errs.ErrLockNotHold)
+				return
+			}
+			assert.ErrorIs(t, err, tc.wantErr)
+			if err == nil {
+				for _, server := range s.servers[2:] {
+					assert.Equal(t, time.Minute, server.TTL("lock-key"))
+				}
+			}
+		})
+	}
+}
+
+func (s *LockTestSuite) TestUnlock() {
+	testCases := []struct {
+		name   string
+		before func(t *testing.T) *Lock
+
+		wantErr error
+	}{
+		{
+			name: "解锁成功",
+			before: func(t *testing.T) *Lock {
+				return s.lock(t)
+			},
+		},
+		{
+			name: "解锁成功，少数实例宕机",
+			before: func(t *testing.T) *Lock {
+				l := s.lock(t)
+				s.servers[0].Close()
+				return l
+			},
+		},
+		{
+			name: "解锁失败，没有加锁",
+			before: func(t *testing.T) *Lock {
+				return NewLock(s.clients, "lock-key", time.Minute)
+			},
+			wantErr: errs.ErrLockNotHold,
+		},
+	}
+
+	for _, tc := range testCases {
+		s.T().Run(tc.name, func(t *testing.T) {
+			s.SetupTest()
+			l := tc.before(t)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+			err := l.Unlock(ctx)
+			assert.ErrorIs(t, err, tc.wantErr)
+			for _, server := range s.servers[1:] {
+				assert.False(t, server.Exists("lock-key"))
+			}
+		})
+	}
+}
+
+func (s *LockTestSuite) lock(t *testing.T) *Lock {
+	l := NewLock(s.clients, "lock-key", time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	err := l.Lock(ctx)
+	require.NoError(t, err)
+	return l
+}
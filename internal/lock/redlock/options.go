@@ -0,0 +1,27 @@
+package redlock
+
+import (
+	"github.com/ecodeclub/ekit/bean/option"
+	"github.com/ecodeclub/ekit/retry"
+	"time"
+)
+
+// WithNodeTimeout 指定访问单一一个 Redis 实例的超时时间
+func WithNodeTimeout(timeout time.Duration) option.Option[Lock] {
+	return func(t *Lock) {
+		t.nodeTimeout = timeout
+	}
+}
+
+// WithDriftFactor 指定时钟漂移系数，默认是 0.01
+func WithDriftFactor(factor float64) option.Option[Lock] {
+	return func(t *Lock) {
+		t.driftFactor = factor
+	}
+}
+
+func WithLockRetryStrategy(strategy retry.Strategy) option.Option[Lock] {
+	return func(t *Lock) {
+		t.lockRetry = strategy
+	}
+}
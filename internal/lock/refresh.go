@@ -0,0 +1,56 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"github.com/meoying/local-msg-go/internal/lock/errs"
+	"time"
+)
+
+// maxRefreshFailures 连续续约失败多少次之后，就认为已经失去了锁
+const maxRefreshFailures = 3
+
+// AutoRefresh 在后台每隔 interval 续约一次，直到 ctx 被取消。每一次续约的超时时间也是 interval
+//
+// 一旦确认锁已经不在自己手里了，或者连续续约失败了 3 次，就会把错误发到返回的 channel 上，并且不再续约。
+// 使用者应该监听这个 channel，一旦收到错误就立刻停止需要锁保护的任务。
+// ctx 被取消的时候，channel 会被关闭。
+//
+// 注意 interval 要远小于锁的过期时间，保证连续失败 3 次之前锁都还没有过期
+func AutoRefresh(ctx context.Context, l Lock, interval time.Duration) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		failures := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			refreshCtx, cancel := context.WithTimeout(ctx, interval)
+			err := l.Refresh(refreshCtx)
+			cancel()
+			switch {
+			case err == nil:
+				failures = 0
+			case ctx.Err() != nil:
+				// 是使用者自己取消的
+				return
+			case errors.Is(err, errs.ErrLockNotHold):
+				ch <- err
+				return
+			default:
+				// 可能是偶发性的网络问题，下一次再试试
+				failures++
+				if failures >= maxRefreshFailures {
+					ch <- err
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
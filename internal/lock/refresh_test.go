@@ -0,0 +1,98 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"github.com/meoying/local-msg-go/internal/lock/errs"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAutoRefresh(t *testing.T) {
+	mockErr := errors.New("mock error")
+	testCases := []struct {
+		name string
+		// 每一次 Refresh 的结果，用完了之后都是成功
+		results []error
+
+		wantErr error
+		// 期望 Refresh 被调用的次数
+		wantCnt int
+	}{
+		{
+			name:    "一直续约成功，直到被取消",
+			results: nil,
+		},
+		{
+			name:    "失去了锁",
+			results: []error{nil, errs.ErrLockNotHold},
+			wantErr: errs.ErrLockNotHold,
+			wantCnt: 2,
+		},
+		{
+			name:    "连续失败",
+			results: []error{mockErr, mockErr, mockErr},
+			wantErr: mockErr,
+			wantCnt: 3,
+		},
+		{
+			name:    "偶发失败",
+			results: []error{mockErr, mockErr, nil, mockErr, mockErr},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &mockLock{results: tc.results}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+			defer cancel()
+			err, ok := <-AutoRefresh(ctx, l, time.Millisecond*10)
+			if tc.wantErr == nil {
+				// 到期之后 channel 被关闭
+				assert.False(t, ok)
+				assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+				assert.True(t, l.count() > len(tc.results))
+				return
+			}
+			assert.True(t, ok)
+			assert.ErrorIs(t, err, tc.wantErr)
+			assert.Equal(t, tc.wantCnt, l.count())
+		})
+	}
+}
+
+type mockLock struct {
+	mutex   sync.Mutex
+	results []error
+	cnt     int
+}
+
+func (m *mockLock) count() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.cnt
+}
+
+func (m *mockLock) Refresh(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.cnt++
+	if m.cnt <= len(m.results) {
+		return m.results[m.cnt-1]
+	}
+	return nil
+}
+
+func (m *mockLock) Lock(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockLock) Unlock(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockLock) FencingToken() int64 {
+	return 0
+}
@@ -0,0 +1,24 @@
+package slock
+
+import (
+	"context"
+	"database/sql"
+	dlock "github.com/meoying/local-msg-go/internal/lock"
+	"time"
+)
+
+type Client struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewClient 创建基于会话锁的客户端
+// 每一个持有中的锁都会独占一个连接，所以要确保 db 的连接池足够大
+func NewClient(db *sql.DB, dialect Dialect) *Client {
+	return &Client{db: db, dialect: dialect}
+}
+
+// NewLock 会话锁没有过期时间，所以 expiration 会被忽略
+func (c *Client) NewLock(ctx context.Context, key string, expiration time.Duration) (dlock.Lock, error) {
+	return NewLock(c.db, c.dialect, key), nil
+}
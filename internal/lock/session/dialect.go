@@ -0,0 +1,87 @@
+package slock
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"hash/fnv"
+)
+
+var (
+	// MySQL 使用 GET_LOCK 和 RELEASE_LOCK
+	MySQL Dialect = mysqlDialect{}
+	// PostgreSQL 使用 pg_try_advisory_lock 和 pg_advisory_unlock
+	PostgreSQL Dialect = postgresDialect{}
+)
+
+// Dialect 屏蔽不同数据库的会话锁的差异
+type Dialect interface {
+	// lock 不阻塞地尝试加锁，锁被别人持有的时候返回 false
+	lock(ctx context.Context, conn *sql.Conn, key string) (bool, error)
+	// holding 锁是否依旧被当前会话持有
+	holding(ctx context.Context, conn *sql.Conn, key string) (bool, error)
+	// unlock 释放锁，锁不是当前会话持有的时候返回 false
+	unlock(ctx context.Context, conn *sql.Conn, key string) (bool, error)
+}
+
+type mysqlDialect struct{}
+
+func (m mysqlDialect) lock(ctx context.Context, conn *sql.Conn, key string) (bool, error) {
+	// 超时时间为 0 就是不阻塞。返回 1 是加锁成功，0 是锁被人持有，NULL 是出错了
+	var res sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", m.name(key)).Scan(&res)
+	return res.Valid && res.Int64 == 1, err
+}
+
+func (m mysqlDialect) holding(ctx context.Context, conn *sql.Conn, key string) (bool, error) {
+	var res sql.NullBool
+	err := conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?) = CONNECTION_ID()", m.name(key)).Scan(&res)
+	return res.Valid && res.Bool, err
+}
+
+func (m mysqlDialect) unlock(ctx context.Context, conn *sql.Conn, key string) (bool, error) {
+	// 返回 1 是释放成功，0 是锁被别人持有，NULL 是锁不存在
+	var res sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", m.name(key)).Scan(&res)
+	return res.Valid && res.Int64 == 1, err
+}
+
+// name MySQL 要求锁的名字不能超过 64 个字符，超过了就用摘要
+func (m mysqlDialect) name(key string) string {
+	if len(key) <= 64 {
+		return key
+	}
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type postgresDialect struct{}
+
+func (p postgresDialect) lock(ctx context.Context, conn *sql.Conn, key string) (bool, error) {
+	var res bool
+	err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", p.id(key)).Scan(&res)
+	return res, err
+}
+
+func (p postgresDialect) holding(ctx context.Context, conn *sql.Conn, key string) (bool, error) {
+	// bigint 的 advisory lock 在 pg_locks 里面被拆成了两个部分，classid 是高 32 位，objid 是低 32 位
+	var res bool
+	err := conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_locks
+WHERE locktype = 'advisory' AND pid = pg_backend_pid() AND granted AND objsubid = 1
+AND ((classid::bigint << 32) | objid::bigint) = $1)`, p.id(key)).Scan(&res)
+	return res, err
+}
+
+func (p postgresDialect) unlock(ctx context.Context, conn *sql.Conn, key string) (bool, error) {
+	var res bool
+	err := conn.QueryRowContext(ctx, "SELECT pg_advisory_unlock($1)", p.id(key)).Scan(&res)
+	return res, err
+}
+
+// id advisory lock 只接受整数，所以用 key 的哈希值
+func (p postgresDialect) id(key string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return int64(h.Sum64())
+}
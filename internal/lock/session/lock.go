@@ -0,0 +1,132 @@
+package slock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/ecodeclub/ekit/bean/option"
+	"github.com/ecodeclub/ekit/retry"
+	"github.com/meoying/local-msg-go/internal/lock/errs"
+	"time"
+)
+
+// Lock 基于数据库会话锁的实现，也就是 MySQL 的 GET_LOCK 和 PostgreSQL 的 advisory lock
+// 和 glock 不同，它不需要额外的表，也不需要轮询 CAS，锁是由数据库本身维护的
+//
+// 会话锁是和连接绑定的，所以加锁的时候会从连接池里面拿出一个连接独占，直到 Unlock
+// 会话锁也没有过期时间，只要连接还在锁就在；连接断开，数据库就会自动释放锁
+type Lock struct {
+	db      *sql.DB
+	dialect Dialect
+	key     string
+
+	// 加锁成功之后独占的连接
+	conn *sql.Conn
+
+	// 加锁的时候的单一一次超时
+	lockTimeout time.Duration
+	// 重试策略
+	lockRetry retry.Strategy
+}
+
+// NewLock 创建一个分布式锁，dialect 是 MySQL 或者 PostgreSQL
+func NewLock(db *sql.DB, dialect Dialect, key string, opts ...option.Option[Lock]) *Lock {
+	strategy, _ := retry.NewExponentialBackoffRetryStrategy(time.Millisecond*100, time.Second, 10)
+	l := &Lock{
+		db:          db,
+		dialect:     dialect,
+		key:         key,
+		lockTimeout: time.Millisecond * 500,
+		lockRetry:   strategy,
+	}
+	option.Apply(l, opts...)
+	return l
+}
+
+// Lock 会尝试加锁。当加锁失败的时候，会尝试重试。
+// 最终加锁失败的话，会把连接还回去
+func (l *Lock) Lock(ctx context.Context) error {
+	err := retry.Retry(ctx, l.lockRetry, func() error {
+		lctx, cancel := context.WithTimeout(ctx, l.lockTimeout)
+		defer cancel()
+		return l.tryLock(lctx)
+	})
+	if err != nil && l.conn != nil {
+		_ = l.conn.Close()
+		l.conn = nil
+	}
+	return err
+}
+
+func (l *Lock) tryLock(ctx context.Context) error {
+	// 重试的时候复用同一个连接
+	if l.conn == nil {
+		conn, err := l.db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		l.conn = conn
+	}
+	ok, err := l.dialect.lock(ctx, l.conn, l.key)
+	if err != nil {
+		// 不确定加锁到底成功了没有，直接丢弃这个连接，数据库会释放可能加上的锁
+		l.discardConn()
+		return err
+	}
+	if !ok {
+		return errs.ErrLocked
+	}
+	return nil
+}
+
+// Refresh 会话锁没有过期时间，所以这里只是检测连接还活着，并且锁依旧被这个连接持有
+// 任何错误都意味着没办法确认锁还在自己手里，这时候会丢弃连接，并且返回 errs.ErrLockNotHold
+func (l *Lock) Refresh(ctx context.Context) error {
+	if l.conn == nil {
+		return errs.ErrLockNotHold
+	}
+	ok, err := l.dialect.holding(ctx, l.conn, l.key)
+	if err != nil {
+		l.discardConn()
+		return fmt.Errorf("%w，会话已经断开 %w", errs.ErrLockNotHold, err)
+	}
+	if !ok {
+		l.discardConn()
+		return errs.ErrLockNotHold
+	}
+	return nil
+}
+
+// FencingToken 会话锁没有可以用作令牌的单调递增的值，所以不支持
+func (l *Lock) FencingToken() int64 {
+	return 0
+}
+
+// Unlock 释放锁，并且把连接还给连接池。它并不会重试
+func (l *Lock) Unlock(ctx context.Context) error {
+	if l.conn == nil {
+		return errs.ErrLockNotHold
+	}
+	ok, err := l.dialect.unlock(ctx, l.conn, l.key)
+	if err != nil {
+		// 释放失败的连接不能还回连接池，否则别人拿到这个连接的时候也就拿到了锁
+		l.discardConn()
+		return err
+	}
+	_ = l.conn.Close()
+	l.conn = nil
+	if !ok {
+		return errs.ErrLockNotHold
+	}
+	return nil
+}
+
+// discardConn 关闭底层的连接，而不是还给连接池
+func (l *Lock) discardConn() {
+	_ = l.conn.Raw(func(driverConn any) error {
+		return driver.ErrBadConn
+	})
+	_ = l.conn.Close()
+	l.conn = nil
+}
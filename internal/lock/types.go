@@ -16,4 +16,9 @@ type Lock interface {
 
 	// Refresh 续约，延长过期时间
 	Refresh(ctx context.Context) error
+
+	// FencingToken 加锁成功之后拿到的令牌，同一个 key 后一次加锁拿到的令牌一定比前一次的大
+	// 在写数据的时候带上令牌，就可以拒绝掉已经失去锁，但是自己还不知道的持有者的写操作
+	// 返回 0 说明没有加锁成功，或者这个实现不支持
+	FencingToken() int64
 }
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"sync"
+	"time"
+)
+
+// OTel 使用 OpenTelemetry 的 metric API 上报指标
+// 积压情况用的是异步的 Gauge，采集的时候才会读取最近一次的统计结果
+type OTel struct {
+	taskExecDuration metric.Float64Histogram
+	sendTotal        metric.Int64Counter
+	sendDelay        metric.Float64Histogram
+
+	mu       sync.RWMutex
+	backlogs map[backlogKey]Backlog
+}
+
+type backlogKey struct {
+	db    string
+	table string
+}
+
+// NewOTel 使用 meter 创建指标，例如 otel.Meter("localmsg")
+func NewOTel(meter metric.Meter) (*OTel, error) {
+	o := &OTel{
+		backlogs: make(map[backlogKey]Backlog),
+	}
+	var err error
+	o.taskExecDuration, err = meter.Float64Histogram("local_msg.async_task.exec_duration",
+		metric.WithDescription("补偿任务执行时间"), metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	o.sendTotal, err = meter.Int64Counter("local_msg.send",
+		metric.WithDescription("发送消息的结果"))
+	if err != nil {
+		return nil, err
+	}
+	o.sendDelay, err = meter.Float64Histogram("local_msg.send.delay",
+		metric.WithDescription("消息从创建到发送成功的时间"), metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	pending, err := meter.Int64ObservableGauge("local_msg.pending_msgs",
+		metric.WithDescription("待发送的消息数量，超过统计上限的时候就是统计上限"))
+	if err != nil {
+		return nil, err
+	}
+	failed, err := meter.Int64ObservableGauge("local_msg.failed_msgs",
+		metric.WithDescription("发送失败，不会再重试的消息数量，超过统计上限的时候就是统计上限"))
+	if err != nil {
+		return nil, err
+	}
+	oldestAge, err := meter.Float64ObservableGauge("local_msg.oldest_pending_age",
+		metric.WithDescription("最久没有被处理的待发送消息，从创建到现在过了多久"), metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter.RegisterCallback(func(ctx context.Context, observer metric.Observer) error {
+		o.mu.RLock()
+		defer o.mu.RUnlock()
+		for key, backlog := range o.backlogs {
+			attrs := metric.WithAttributes(attribute.String("db", key.db), attribute.String("table", key.table))
+			observer.ObserveInt64(pending, backlog.Pending, attrs)
+			observer.ObserveInt64(failed, backlog.Failed, attrs)
+			observer.ObserveFloat64(oldestAge, backlog.OldestAge.Seconds(), attrs)
+		}
+		return nil
+	}, pending, failed, oldestAge)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *OTel) ObserveTaskExec(table string, success bool, duration time.Duration) {
+	o.taskExecDuration.Record(context.Background(), duration.Seconds(), metric.WithAttributes(
+		attribute.String("table", table),
+		attribute.Bool("success", success),
+	))
+}
+
+func (o *OTel) ObserveSend(topic, table, path, result string, delay time.Duration) {
+	o.sendTotal.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("topic", topic),
+		attribute.String("table", table),
+		attribute.String("path", path),
+		attribute.String("result", result),
+	))
+	if result == ResultSuccess {
+		o.sendDelay.Record(context.Background(), delay.Seconds(), metric.WithAttributes(
+			attribute.String("topic", topic),
+			attribute.String("table", table),
+			attribute.String("path", path),
+		))
+	}
+}
+
+func (o *OTel) SetBacklog(db, table string, backlog Backlog) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.backlogs[backlogKey{db: db, table: table}] = backlog
+}
+
+func (o *OTel) DeleteBacklog(db, table string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.backlogs, backlogKey{db: db, table: table})
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"testing"
+	"time"
+)
+
+func TestOTel(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	o, err := NewOTel(provider.Meter("localmsg"))
+	require.NoError(t, err)
+
+	o.ObserveTaskExec("local_msgs", false, time.Second)
+	o.ObserveSend("order_created", "local_msgs", PathCompensation, ResultSuccess, time.Second)
+	o.ObserveSend("order_created", "local_msgs", PathCompensation, ResultRetryable, 0)
+	o.SetBacklog("db", "local_msgs", Backlog{Pending: 3, Failed: 1, OldestAge: time.Minute})
+
+	ms := collect(t, reader)
+	exec := ms["local_msg.async_task.exec_duration"].(metricdata.Histogram[float64])
+	require.Len(t, exec.DataPoints, 1)
+	assert.Equal(t, uint64(1), exec.DataPoints[0].Count)
+	success, _ := exec.DataPoints[0].Attributes.Value("success")
+	assert.Equal(t, attribute.BoolValue(false), success)
+
+	sends := ms["local_msg.send"].(metricdata.Sum[int64])
+	assert.Len(t, sends.DataPoints, 2)
+	delay := ms["local_msg.send.delay"].(metricdata.Histogram[float64])
+	require.Len(t, delay.DataPoints, 1)
+	assert.Equal(t, uint64(1), delay.DataPoints[0].Count)
+
+	pending := ms["local_msg.pending_msgs"].(metricdata.Gauge[int64])
+	require.Len(t, pending.DataPoints, 1)
+	assert.Equal(t, int64(3), pending.DataPoints[0].Value)
+	age := ms["local_msg.oldest_pending_age"].(metricdata.Gauge[float64])
+	require.Len(t, age.DataPoints, 1)
+	assert.Equal(t, float64(60), age.DataPoints[0].Value)
+
+	// 不再负责这张表之后，就不再上报
+	o.DeleteBacklog("db", "local_msgs")
+	ms = collect(t, reader)
+	_, ok := ms["local_msg.pending_msgs"]
+	assert.False(t, ok)
+}
+
+func collect(t *testing.T, reader *sdkmetric.ManualReader) map[string]metricdata.Aggregation {
+	var rm metricdata.ResourceMetrics
+	err := reader.Collect(context.Background(), &rm)
+	require.NoError(t, err)
+	res := make(map[string]metricdata.Aggregation)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			res[m.Name] = m.Data
+		}
+	}
+	return res
+}
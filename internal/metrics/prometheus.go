@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Prometheus 把指标注册到指定的 Registerer 上
+type Prometheus struct {
+	taskExecDuration *prometheus.HistogramVec
+	sendTotal        *prometheus.CounterVec
+	sendDelay        *prometheus.HistogramVec
+	pending          *prometheus.GaugeVec
+	failed           *prometheus.GaugeVec
+	oldestAge        *prometheus.GaugeVec
+}
+
+// NewPrometheus 在 reg 上注册指标
+// 如果 reg 上已经注册过同样的指标，那么会复用已有的，
+// 所以同一个进程里面多个 ShardingService 可以共享同一个 Registerer
+func NewPrometheus(reg prometheus.Registerer) (*Prometheus, error) {
+	p := &Prometheus{}
+	var err error
+	p.taskExecDuration, err = register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "local_msg_async_task_exec_duration_seconds",
+		Help:    "补偿任务执行时间",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"table", "success"}))
+	if err != nil {
+		return nil, err
+	}
+	p.sendTotal, err = register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "local_msg_send_total",
+		Help: "发送消息的结果",
+	}, []string{"topic", "table", "path", "result"}))
+	if err != nil {
+		return nil, err
+	}
+	p.sendDelay, err = register(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "local_msg_send_delay_seconds",
+		Help: "消息从创建到发送成功的时间",
+		// 10ms 到 40 多分钟
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"topic", "table", "path"}))
+	if err != nil {
+		return nil, err
+	}
+	labels := []string{"db", "table"}
+	p.pending, err = register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "local_msg_pending_msgs",
+		Help: "待发送的消息数量，超过统计上限的时候就是统计上限",
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	p.failed, err = register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "local_msg_failed_msgs",
+		Help: "发送失败，不会再重试的消息数量，超过统计上限的时候就是统计上限",
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	p.oldestAge, err = register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "local_msg_oldest_pending_age_seconds",
+		Help: "最久没有被处理的待发送消息，从创建到现在过了多久",
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DefaultPrometheus 注册在 prometheus.DefaultRegisterer 上的实现
+// 注册失败的时候会 panic，和 promauto 的行为一致
+var DefaultPrometheus = sync.OnceValue(func() *Prometheus {
+	p, err := NewPrometheus(prometheus.DefaultRegisterer)
+	if err != nil {
+		panic(err)
+	}
+	return p
+})
+
+func register[T prometheus.Collector](reg prometheus.Registerer, c T) (T, error) {
+	err := reg.Register(c)
+	if err == nil {
+		return c, nil
+	}
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing, nil
+		}
+	}
+	return c, err
+}
+
+func (p *Prometheus) ObserveTaskExec(table string, success bool, duration time.Duration) {
+	p.taskExecDuration.WithLabelValues(table, strconv.FormatBool(success)).Observe(duration.Seconds())
+}
+
+func (p *Prometheus) ObserveSend(topic, table, path, result string, delay time.Duration) {
+	p.sendTotal.WithLabelValues(topic, table, path, result).Inc()
+	if result == ResultSuccess {
+		p.sendDelay.WithLabelValues(topic, table, path).Observe(delay.Seconds())
+	}
+}
+
+func (p *Prometheus) SetBacklog(db, table string, backlog Backlog) {
+	p.pending.WithLabelValues(db, table).Set(float64(backlog.Pending))
+	p.failed.WithLabelValues(db, table).Set(float64(backlog.Failed))
+	p.oldestAge.WithLabelValues(db, table).Set(backlog.OldestAge.Seconds())
+}
+
+func (p *Prometheus) DeleteBacklog(db, table string) {
+	p.pending.DeleteLabelValues(db, table)
+	p.failed.DeleteLabelValues(db, table)
+	p.oldestAge.DeleteLabelValues(db, table)
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestPrometheus(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p1, err := NewPrometheus(reg)
+	require.NoError(t, err)
+	// 同一个 Registerer 上注册两次，不会 panic，而是复用已有的
+	p2, err := NewPrometheus(reg)
+	require.NoError(t, err)
+
+	p1.ObserveTaskExec("local_msgs", true, time.Second)
+	p1.ObserveSend("order_created", "local_msgs", PathImmediate, ResultSuccess, time.Second)
+	p2.ObserveSend("order_created", "local_msgs", PathImmediate, ResultSuccess, time.Second)
+	p2.ObserveSend("order_created", "local_msgs", PathCompensation, ResultTerminal, 0)
+	p1.SetBacklog("db", "local_msgs", Backlog{Pending: 3, Failed: 1, OldestAge: time.Minute})
+
+	mfs := gather(t, reg)
+	assert.Equal(t, uint64(1), mfs["local_msg_async_task_exec_duration_seconds"][0].GetHistogram().GetSampleCount())
+	sends := mfs["local_msg_send_total"]
+	require.Len(t, sends, 2)
+	assert.Equal(t, float64(2), sendCount(sends, PathImmediate, ResultSuccess))
+	assert.Equal(t, float64(1), sendCount(sends, PathCompensation, ResultTerminal))
+	// 只有成功的才会统计延迟
+	delays := mfs["local_msg_send_delay_seconds"]
+	require.Len(t, delays, 1)
+	assert.Equal(t, uint64(2), delays[0].GetHistogram().GetSampleCount())
+	assert.Equal(t, float64(3), mfs["local_msg_pending_msgs"][0].GetGauge().GetValue())
+	assert.Equal(t, float64(1), mfs["local_msg_failed_msgs"][0].GetGauge().GetValue())
+	assert.Equal(t, float64(60), mfs["local_msg_oldest_pending_age_seconds"][0].GetGauge().GetValue())
+
+	p2.DeleteBacklog("db", "local_msgs")
+	mfs = gather(t, reg)
+	assert.Empty(t, mfs["local_msg_pending_msgs"])
+}
+
+func TestNewPrometheus_Conflict(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	// 同名但是标签不同的指标
+	reg.MustRegister(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "local_msg_send_total",
+		Help: "发送消息的结果",
+	}, []string{"topic"}))
+	_, err := NewPrometheus(reg)
+	assert.Error(t, err)
+}
+
+func gather(t *testing.T, reg *prometheus.Registry) map[string][]*dto.Metric {
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	res := make(map[string][]*dto.Metric, len(mfs))
+	for _, mf := range mfs {
+		res[mf.GetName()] = mf.GetMetric()
+	}
+	return res
+}
+
+func sendCount(ms []*dto.Metric, path, result string) float64 {
+	for _, m := range ms {
+		labels := make(map[string]string)
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if labels["path"] == path && labels["result"] == result {
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
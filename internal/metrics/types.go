@@ -0,0 +1,55 @@
+package metrics
+
+import "time"
+
+// Metrics 本地消息表的各种指标，实现必须是并发安全的
+type Metrics interface {
+	// ObserveTaskExec 补偿任务执行一批的时间
+	ObserveTaskExec(table string, success bool, duration time.Duration)
+	// ObserveSend 发送一条消息的结果
+	// path 是消息从哪里发送出去的，result 是发送结果，参考 Path 和 Result 开头的常量
+	// delay 是消息从创建到发送成功的时间，只有发送成功的时候才有意义
+	ObserveSend(topic, table, path, result string, delay time.Duration)
+	// SetBacklog 更新某张表的积压情况
+	SetBacklog(db, table string, backlog Backlog)
+	// DeleteBacklog 当前节点不再负责某张表，不再上报它的积压情况
+	DeleteBacklog(db, table string)
+}
+
+const (
+	// PathImmediate 业务事务提交之后立刻发送
+	PathImmediate = "immediate"
+	// PathCompensation 补偿任务发送
+	PathCompensation = "compensation"
+	// PathManual 通过管理后台之类的手动发送
+	PathManual = "manual"
+)
+
+const (
+	ResultSuccess = "success"
+	// ResultRetryable 发送失败，但是补偿任务还会重试
+	ResultRetryable = "retryable"
+	// ResultTerminal 发送失败，并且达到了最大发送次数，不会再重试了
+	ResultTerminal = "terminal"
+)
+
+// Backlog 某张表的积压情况
+type Backlog struct {
+	// Pending 待发送的消息数量
+	Pending int64
+	// Failed 发送失败，不会再重试的消息数量
+	Failed int64
+	// OldestAge 最久没有被处理的待发送消息从创建到现在过了多久
+	OldestAge time.Duration
+}
+
+// Nop 什么也不做
+type Nop struct{}
+
+func (Nop) ObserveTaskExec(table string, success bool, duration time.Duration) {}
+
+func (Nop) ObserveSend(topic, table, path, result string, delay time.Duration) {}
+
+func (Nop) SetBacklog(db, table string, backlog Backlog) {}
+
+func (Nop) DeleteBacklog(db, table string) {}
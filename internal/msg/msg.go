@@ -7,4 +7,7 @@ type Msg struct {
 	Key     string `json:"key,omitempty"`
 	Topic   string `json:"topic,omitempty"`
 	Content string `json:"content,omitempty"`
+	// Trace 保存消息时候的链路信息（W3C Trace Context），由本地消息表自动填充，
+	// 补偿任务发送的时候会关联到这条链路上，不会发送到消息队列
+	Trace map[string]string `json:"trace,omitempty"`
 }
@@ -0,0 +1,34 @@
+package reshard
+
+import (
+	"github.com/ecodeclub/ekit/bean/option"
+	"log/slog"
+	"time"
+)
+
+// WithBatchSize 每一批从老表中取出来的消息数量
+func WithBatchSize(batchSize int) option.Option[Resharder] {
+	return func(r *Resharder) {
+		r.batchSize = batchSize
+	}
+}
+
+// WithDrainInterval Drain 的时候检测老表的间隔
+func WithDrainInterval(interval time.Duration) option.Option[Resharder] {
+	return func(r *Resharder) {
+		r.interval = interval
+	}
+}
+
+// WithProgress 用于汇报进度，注意它是同步调用的，不要在里面执行耗时操作
+func WithProgress(fn func(p Progress)) option.Option[Resharder] {
+	return func(r *Resharder) {
+		r.progress = fn
+	}
+}
+
+func WithLogger(logger *slog.Logger) option.Option[Resharder] {
+	return func(r *Resharder) {
+		r.logger = logger
+	}
+}
@@ -0,0 +1,278 @@
+package reshard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ecodeclub/ekit/bean/option"
+	"github.com/meoying/local-msg-go/internal/dao"
+	"github.com/meoying/local-msg-go/internal/msg"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"gorm.io/gorm"
+	"log/slog"
+	"time"
+)
+
+var errUnknownDB = errors.New("未知的分库")
+
+// Resharder 扩容（例如说从 2 个库扩容到 4 个库）的时候，用来处理老规则下还没发送出去的消息
+// 它提供了两种做法：
+//  1. Drain：新消息已经按照新规则写入，老表依旧交给补偿任务去发送，
+//     Resharder 只负责等待，直到老表里面的消息被发完，之后你就可以下线老表了
+//  2. Migrate：把老表里面还没有发送的消息复制到新规则下的目标表，由目标表的补偿任务负责发送
+//
+// 两种做法都可以在补偿任务运行的时候执行，也可以反复执行
+type Resharder struct {
+	// 新老规则用到的所有的库，key 是 Dst.DB
+	dbs      map[string]*gorm.DB
+	oldRules sharding.Sharding
+	newRules sharding.Sharding
+	// shardingInfo 从消息中提取出分库分表的信息，也就是 ShardingFunc 的参数
+	// 因为本地消息表里面并没有保存分库分表的信息，所以只能由业务方从消息里面还原
+	shardingInfo func(m msg.Msg) any
+
+	batchSize int
+	// Drain 的时候检测老表的间隔
+	interval time.Duration
+	// 每处理完一批，或者 Drain 每检测一次，都会调用
+	progress func(p Progress)
+	logger   *slog.Logger
+}
+
+// NewResharder 创建一个 Resharder
+// dbs 必须同时包含老规则和新规则用到的库
+func NewResharder(dbs map[string]*gorm.DB,
+	oldRules, newRules sharding.Sharding,
+	shardingInfo func(m msg.Msg) any,
+	opts ...option.Option[Resharder]) *Resharder {
+	r := &Resharder{
+		dbs:          dbs,
+		oldRules:     oldRules,
+		newRules:     newRules,
+		shardingInfo: shardingInfo,
+		batchSize:    100,
+		interval:     time.Second * 10,
+		progress:     func(p Progress) {},
+		logger:       slog.Default(),
+	}
+	option.Apply(r, opts...)
+	return r
+}
+
+// Migrate 把老规则下所有表中还没有发送的消息迁移到新规则下的目标表
+// 单条消息迁移失败不会中断整个过程，只会记录在 Progress.Failed 里面，重新执行 Migrate 即可
+// 返回值是每一张老表的迁移结果
+func (r *Resharder) Migrate(ctx context.Context) ([]Progress, error) {
+	srcs := r.oldRules.EffectiveTablesFunc()
+	res := make([]Progress, 0, len(srcs))
+	for _, src := range srcs {
+		p, err := r.migrateTable(ctx, src)
+		res = append(res, p)
+		if err != nil {
+			return res, fmt.Errorf("迁移 %s.%s 失败 %w", src.DB, src.Table, err)
+		}
+	}
+	return res, nil
+}
+
+func (r *Resharder) migrateTable(ctx context.Context, src sharding.Dst) (Progress, error) {
+	p := Progress{Src: src}
+	db, ok := r.dbs[src.DB]
+	if !ok {
+		return p, fmt.Errorf("%w %s", errUnknownDB, src.DB)
+	}
+	// MsgStatusMigrating 是上一次迁移到一半的消息，要继续完成
+	statuses := []int8{dao.MsgStatusInit, dao.MsgStatusMigrating}
+	err := db.WithContext(ctx).Table(src.Table).
+		Where("status IN ?", statuses).Count(&p.Total).Error
+	if err != nil {
+		return p, err
+	}
+	r.progress(p)
+	// 按照 id 递增的顺序迭代，避免使用 OFFSET，也避免迁移过程中状态变化导致漏掉数据
+	var maxId int64
+	for {
+		var batch []dao.LocalMsg
+		err = db.WithContext(ctx).Table(src.Table).
+			Where("id > ? AND status IN ?", maxId, statuses).
+			Order("id ASC").Limit(r.batchSize).Find(&batch).Error
+		if err != nil {
+			return p, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, m := range batch {
+			maxId = m.Id
+			migrated, err1 := r.migrateMsg(ctx, db, src, m)
+			switch {
+			case err1 != nil:
+				p.Failed++
+				r.logger.Error("迁移消息失败",
+					slog.String("db", src.DB),
+					slog.String("table", src.Table),
+					slog.Int64("id", m.Id),
+					slog.Any("err", err1))
+			case migrated:
+				p.Migrated++
+			default:
+				p.Skipped++
+			}
+		}
+		r.progress(p)
+	}
+	p.Done = true
+	r.progress(p)
+	return p, nil
+}
+
+// migrateMsg 迁移一条消息，返回值 bool 代表是否迁移了
+// 整个过程分成三步：
+//  1. 抢占：将状态从 MsgStatusInit 修改为 MsgStatusMigrating，此后补偿任务就不会再发送这条消息
+//  2. 复制：在目标表中插入一条 MsgStatusInit 的消息，如果目标表已经有了就跳过
+//  3. 完成：将状态从 MsgStatusMigrating 修改为 MsgStatusMigrated
+//
+// 任何一步中断，重新执行的时候都会从 MsgStatusMigrating 继续，所以不会丢消息，也不会重复复制
+func (r *Resharder) migrateMsg(ctx context.Context,
+	db *gorm.DB, src sharding.Dst, m dao.LocalMsg) (bool, error) {
+	var content msg.Msg
+	err := json.Unmarshal(m.Data, &content)
+	if err != nil {
+		return false, fmt.Errorf("提取消息内容失败 %w", err)
+	}
+	dst := r.newRules.ShardingFunc(r.shardingInfo(content))
+	if dst == src {
+		// 新老规则下都在同一张表，不需要迁移
+		return false, nil
+	}
+	dstDB, ok := r.dbs[dst.DB]
+	if !ok {
+		return false, fmt.Errorf("%w %s", errUnknownDB, dst.DB)
+	}
+
+	if m.Status == dao.MsgStatusInit {
+		// 用 utime 作为版本号，如果补偿任务刚好发送过这条消息，那么 utime 就会变化，这里就会抢占失败
+		// 当然，如果补偿任务已经查询出了这条消息，但是还没有发送，那么依旧有可能重复发送
+		// 这种情况下就依赖于消费者的幂等了
+		res := db.WithContext(ctx).Table(src.Table).
+			Where("id = ? AND status = ? AND utime = ?", m.Id, dao.MsgStatusInit, m.Utime).
+			Updates(map[string]any{
+				"status": dao.MsgStatusMigrating,
+			})
+		if res.Error != nil {
+			return false, res.Error
+		}
+		if res.RowsAffected == 0 {
+			// 补偿任务抢先一步，那么就留给下一次迁移
+			return false, nil
+		}
+	}
+
+	// 本地消息表上没有唯一索引，所以用 key + ctime 来判定目标表中是不是已经有了
+	var cnt int64
+	err = dstDB.WithContext(ctx).Table(dst.Table).
+		Where("`key` = ? AND ctime = ?", m.Key, m.Ctime).Count(&cnt).Error
+	if err != nil {
+		return false, err
+	}
+	if cnt == 0 {
+		err = dstDB.WithContext(ctx).Table(dst.Table).Create(&dao.LocalMsg{
+			Key:       m.Key,
+			Data:      m.Data,
+			SendTimes: m.SendTimes,
+			Status:    dao.MsgStatusInit,
+			// 保留原本的时间，这样目标表的补偿任务可以立刻发送
+			Utime: m.Utime,
+			Ctime: m.Ctime,
+		}).Error
+		if err != nil {
+			// 还原，让老表的补偿任务继续发送
+			err1 := db.WithContext(ctx).Table(src.Table).
+				Where("id = ? AND status = ?", m.Id, dao.MsgStatusMigrating).
+				Updates(map[string]any{
+					"status": dao.MsgStatusInit,
+				}).Error
+			if err1 != nil {
+				return false, fmt.Errorf("复制消息失败 %w，还原消息状态也失败 %w", err, err1)
+			}
+			return false, fmt.Errorf("复制消息失败 %w", err)
+		}
+	}
+	res := db.WithContext(ctx).Table(src.Table).
+		Where("id = ? AND status = ?", m.Id, dao.MsgStatusMigrating).
+		Updates(map[string]any{
+			"status": dao.MsgStatusMigrated,
+			"utime":  time.Now().UnixMilli(),
+		})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	// 没有更新到，说明别的迁移过程已经完成了这条消息，不能重复计数
+	return res.RowsAffected > 0, nil
+}
+
+// Drain 等待被下线的老表（在老规则中，但是不在新规则中）中的消息被补偿任务发送完毕
+// 在 Drain 期间，你运行中的 ShardingService 的 EffectiveTablesFunc 必须依旧包含这些老表
+// 当 ctx 过期，或者所有的老表都没有未发送的消息之后返回
+func (r *Resharder) Drain(ctx context.Context) error {
+	retired := r.retiredTables()
+	for {
+		pending := int64(0)
+		for _, src := range retired {
+			p := Progress{Src: src}
+			db, ok := r.dbs[src.DB]
+			if !ok {
+				return fmt.Errorf("%w %s", errUnknownDB, src.DB)
+			}
+			err := db.WithContext(ctx).Table(src.Table).
+				Where("status = ?", dao.MsgStatusInit).Count(&p.Pending).Error
+			if err != nil {
+				return fmt.Errorf("统计 %s.%s 失败 %w", src.DB, src.Table, err)
+			}
+			p.Done = p.Pending == 0
+			pending += p.Pending
+			r.progress(p)
+		}
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// retiredTables 老规则中有，但是新规则中没有的表
+func (r *Resharder) retiredTables() []sharding.Dst {
+	effective := make(map[sharding.Dst]struct{})
+	for _, dst := range r.newRules.EffectiveTablesFunc() {
+		effective[dst] = struct{}{}
+	}
+	var res []sharding.Dst
+	for _, dst := range r.oldRules.EffectiveTablesFunc() {
+		if _, ok := effective[dst]; !ok {
+			res = append(res, dst)
+		}
+	}
+	return res
+}
+
+// Progress 某一张老表的处理进度
+type Progress struct {
+	Src sharding.Dst
+	// 开始迁移的时候，需要迁移的消息总数
+	Total int64
+	// 已经迁移的消息数
+	Migrated int64
+	// 不需要迁移的消息数，包括新老规则下都在同一张表的，以及被补偿任务抢先发送的
+	Skipped int64
+	// 迁移失败的消息数，重新执行 Migrate 即可
+	Failed int64
+	// 尚未发送的消息数，只有 Drain 会设置
+	Pending int64
+	// 这张表已经处理完毕
+	Done bool
+}
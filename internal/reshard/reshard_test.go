@@ -0,0 +1,185 @@
+package reshard
+
+import (
+	"context"
+	"github.com/meoying/local-msg-go/internal/dao"
+	"github.com/meoying/local-msg-go/internal/msg"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"github.com/meoying/local-msg-go/internal/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"strings"
+	"testing"
+	"time"
+)
+
+type ResharderTestSuite struct {
+	test.BaseSuite
+	db00 *gorm.DB
+	db01 *gorm.DB
+	dbs  map[string]*gorm.DB
+}
+
+func (s *ResharderTestSuite) SetupSuite() {
+	db00, err := gorm.Open(mysql.Open("root:root@tcp(localhost:13316)/orders_db_00?charset=utf8mb4&collation=utf8mb4_general_ci&parseTime=True&loc=Local&timeout=1s&readTimeout=3s&writeTimeout=3s"))
+	require.NoError(s.T(), err)
+	db01, err := gorm.Open(mysql.Open("root:root@tcp(localhost:13316)/orders_db_01?charset=utf8mb4&collation=utf8mb4_general_ci&parseTime=True&loc=Local&timeout=1s&readTimeout=3s&writeTimeout=3s"))
+	require.NoError(s.T(), err)
+	s.db00 = db00
+	s.db01 = db01
+	s.dbs = map[string]*gorm.DB{
+		"orders_db_00": db00,
+		"orders_db_01": db01,
+	}
+}
+
+func (s *ResharderTestSuite) TearDownTest() {
+	err := s.db00.Exec("TRUNCATE TABLE local_msgs_tab_00").Error
+	require.NoError(s.T(), err)
+	err = s.db01.Exec("TRUNCATE TABLE local_msgs_tab_01").Error
+	require.NoError(s.T(), err)
+}
+
+// 老规则：所有的消息都在 orders_db_00.local_msgs_tab_00
+// 新规则：key 以 success 结尾的迁移到 orders_db_01.local_msgs_tab_01，其余的留在原地
+func (s *ResharderTestSuite) rules() (sharding.Sharding, sharding.Sharding) {
+	oldDst := sharding.Dst{DB: "orders_db_00", Table: "local_msgs_tab_00"}
+	newDst := sharding.Dst{DB: "orders_db_01", Table: "local_msgs_tab_01"}
+	oldRules := sharding.Sharding{
+		ShardingFunc: func(info any) sharding.Dst {
+			return oldDst
+		},
+		EffectiveTablesFunc: func() []sharding.Dst {
+			return []sharding.Dst{oldDst}
+		},
+	}
+	newRules := sharding.Sharding{
+		ShardingFunc: func(info any) sharding.Dst {
+			if strings.HasSuffix(info.(string), "success") {
+				return newDst
+			}
+			return oldDst
+		},
+		EffectiveTablesFunc: func() []sharding.Dst {
+			return []sharding.Dst{oldDst, newDst}
+		},
+	}
+	return oldRules, newRules
+}
+
+func (s *ResharderTestSuite) TestMigrate() {
+	t := s.T()
+	now := time.Now().UnixMilli()
+	msgs := []dao.LocalMsg{
+		// 需要迁移
+		s.mockMsg(1, now, dao.MsgStatusInit),
+		// 新老规则都在同一张表，不需要迁移
+		s.mockMsg(2, now, dao.MsgStatusInit),
+		// 已经发送成功了
+		s.mockMsg(3, now, dao.MsgStatusSuccess),
+		// 上一次迁移到一半，目标表里面已经有了
+		s.mockMsg(5, now, dao.MsgStatusMigrating),
+	}
+	err := s.db00.Table("local_msgs_tab_00").Create(&msgs).Error
+	require.NoError(t, err)
+	copied := s.mockMsg(5, now, dao.MsgStatusInit)
+	copied.Id = 0
+	err = s.db01.Table("local_msgs_tab_01").Create(&copied).Error
+	require.NoError(t, err)
+
+	oldRules, newRules := s.rules()
+	var reported []Progress
+	r := NewResharder(s.dbs, oldRules, newRules, func(m msg.Msg) any {
+		return m.Key
+	}, WithBatchSize(2), WithProgress(func(p Progress) {
+		reported = append(reported, p)
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	res, err := r.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Progress{
+		{
+			Src:      oldRules.EffectiveTablesFunc()[0],
+			Total:    3,
+			Migrated: 2,
+			Skipped:  1,
+			Done:     true,
+		},
+	}, res)
+	assert.Equal(t, res[0], reported[len(reported)-1])
+
+	var srcMsgs []dao.LocalMsg
+	err = s.db00.Table("local_msgs_tab_00").Order("id ASC").Find(&srcMsgs).Error
+	require.NoError(t, err)
+	statuses := make(map[int64]int8, len(srcMsgs))
+	for _, m := range srcMsgs {
+		statuses[m.Id] = m.Status
+	}
+	assert.Equal(t, map[int64]int8{
+		1: dao.MsgStatusMigrated,
+		2: dao.MsgStatusInit,
+		3: dao.MsgStatusSuccess,
+		5: dao.MsgStatusMigrated,
+	}, statuses)
+
+	var dstMsgs []dao.LocalMsg
+	err = s.db01.Table("local_msgs_tab_01").Order("`key` ASC").Find(&dstMsgs).Error
+	require.NoError(t, err)
+	require.Len(t, dstMsgs, 2)
+	assert.Equal(t, "1_success", dstMsgs[0].Key)
+	assert.Equal(t, dao.MsgStatusInit, dstMsgs[0].Status)
+	assert.Equal(t, now, dstMsgs[0].Utime)
+	assert.Equal(t, "5_success", dstMsgs[1].Key)
+
+	// 再执行一次，不会有任何变化
+	res, err = r.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), res[0].Migrated)
+	var cnt int64
+	err = s.db01.Table("local_msgs_tab_01").Count(&cnt).Error
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), cnt)
+}
+
+func (s *ResharderTestSuite) TestDrain() {
+	t := s.T()
+	oldRules, _ := s.rules()
+	// 新规则把老表整个下线了
+	newRules := sharding.NewNoShard("local_msgs_tab_01")
+	now := time.Now().UnixMilli()
+	m := s.mockMsg(1, now, dao.MsgStatusInit)
+	err := s.db00.Table("local_msgs_tab_00").Create(&m).Error
+	require.NoError(t, err)
+
+	r := NewResharder(s.dbs, oldRules, newRules, func(m msg.Msg) any {
+		return m.Key
+	}, WithDrainInterval(time.Millisecond*100))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	err = r.Drain(ctx)
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// 模拟补偿任务发送成功
+	err = s.db00.Table("local_msgs_tab_00").Where("id = ?", 1).
+		Update("status", dao.MsgStatusSuccess).Error
+	require.NoError(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	err = r.Drain(ctx)
+	cancel()
+	assert.NoError(t, err)
+}
+
+func (s *ResharderTestSuite) mockMsg(id int64, utime int64, status int8) dao.LocalMsg {
+	res := s.MockDAOMsg(id, utime)
+	res.Status = status
+	return res
+}
+
+func TestResharder(t *testing.T) {
+	suite.Run(t, new(ResharderTestSuite))
+}
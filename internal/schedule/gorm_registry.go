@@ -0,0 +1,61 @@
+package schedule
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// GormRegistry 基于关系型数据库的实现，需要额外的 local_msg_nodes 表
+type GormRegistry struct {
+	db *gorm.DB
+}
+
+func NewGormRegistry(db *gorm.DB) *GormRegistry {
+	return &GormRegistry{db: db}
+}
+
+// InitTable 初始化 local_msg_nodes 表
+func (r *GormRegistry) InitTable() error {
+	return r.db.AutoMigrate(&Node{})
+}
+
+func (r *GormRegistry) Heartbeat(ctx context.Context, node string, ttl time.Duration) error {
+	now := time.Now().UnixMilli()
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"expiration", "utime"}),
+	}).Create(&Node{
+		Name:       node,
+		Expiration: now + ttl.Milliseconds(),
+		Utime:      now,
+		Ctime:      now,
+	}).Error
+}
+
+func (r *GormRegistry) Members(ctx context.Context) ([]string, error) {
+	var res []string
+	err := r.db.WithContext(ctx).Model(&Node{}).
+		Where("expiration > ?", time.Now().UnixMilli()).
+		Order("name ASC").Pluck("name", &res).Error
+	return res, err
+}
+
+func (r *GormRegistry) Leave(ctx context.Context, node string) error {
+	return r.db.WithContext(ctx).Where("name = ?", node).Delete(&Node{}).Error
+}
+
+// Node 参与调度的节点
+type Node struct {
+	Id   int64  `gorm:"primaryKey,autoIncrement"`
+	Name string `gorm:"type:VARCHAR(128);uniqueIndex"`
+	// 过期时间，毫秒数
+	Expiration int64 `gorm:"index"`
+	Utime      int64
+	Ctime      int64
+}
+
+func (Node) TableName() string {
+	return "local_msg_nodes"
+}
@@ -0,0 +1,36 @@
+package schedule
+
+import (
+	"github.com/ecodeclub/ekit/bean/option"
+	"log/slog"
+	"time"
+)
+
+// WithNodeName 指定当前节点的名字，默认是一个随机的 UUID
+// 名字在所有节点中必须是唯一的
+func WithNodeName(name string) option.Option[Scheduler] {
+	return func(s *Scheduler) {
+		s.node = name
+	}
+}
+
+// WithHeartbeat interval 是心跳间隔，ttl 是节点过期时间，ttl 必须大于 interval，一般是 interval 的好几倍
+func WithHeartbeat(interval, ttl time.Duration) option.Option[Scheduler] {
+	return func(s *Scheduler) {
+		s.interval = interval
+		s.ttl = ttl
+	}
+}
+
+// WithReplicas 每个节点在哈希环上的虚拟节点数量，所有节点必须一样
+func WithReplicas(replicas int) option.Option[Scheduler] {
+	return func(s *Scheduler) {
+		s.replicas = replicas
+	}
+}
+
+func WithLogger(logger *slog.Logger) option.Option[Scheduler] {
+	return func(s *Scheduler) {
+		s.logger = logger
+	}
+}
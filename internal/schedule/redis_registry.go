@@ -0,0 +1,50 @@
+package schedule
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RedisRegistry 基于 Redis 的实现，所有节点都放在一个 sorted set 里面，score 是过期时间
+type RedisRegistry struct {
+	rdb redis.Cmdable
+	key string
+}
+
+// NewRedisRegistry key 是 sorted set 的 key，不同的业务应该使用不同的 key
+func NewRedisRegistry(rdb redis.Cmdable, key string) *RedisRegistry {
+	return &RedisRegistry{rdb: rdb, key: key}
+}
+
+func (r *RedisRegistry) Heartbeat(ctx context.Context, node string, ttl time.Duration) error {
+	return r.rdb.ZAdd(ctx, r.key, redis.Z{
+		Score:  float64(time.Now().Add(ttl).UnixMilli()),
+		Member: node,
+	}).Err()
+}
+
+func (r *RedisRegistry) Members(ctx context.Context) ([]string, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	// 顺手清理掉已经过期的节点
+	err := r.rdb.ZRemRangeByScore(ctx, r.key, "-inf", now).Err()
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.rdb.ZRangeByScore(ctx, r.key, &redis.ZRangeBy{
+		Min: "(" + now,
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	// 按照 score 排序的结果会随着心跳变化，所以按照名字重新排一下
+	sort.Strings(res)
+	return res, nil
+}
+
+func (r *RedisRegistry) Leave(ctx context.Context, node string) error {
+	return r.rdb.ZRem(ctx, r.key, node).Err()
+}
@@ -0,0 +1,17 @@
+package schedule
+
+import (
+	"context"
+	"time"
+)
+
+// Registry 维护存活的节点。节点需要定时发送心跳，超过 ttl 没有心跳的节点就被认为已经下线了
+// 注意判断节点有没有过期用的都是本地时间，所以各个节点之间的时钟不能相差太多
+type Registry interface {
+	// Heartbeat 注册节点或者延长节点的存活时间
+	Heartbeat(ctx context.Context, node string, ttl time.Duration) error
+	// Members 返回所有存活的节点，按照名字排序
+	Members(ctx context.Context) ([]string, error)
+	// Leave 主动下线，这样别的节点就不需要等到心跳过期才接手
+	Leave(ctx context.Context, node string) error
+}
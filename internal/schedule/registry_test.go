@@ -0,0 +1,86 @@
+package schedule
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// RegistryTestSuite 不同的实现测试是一样的
+type RegistryTestSuite struct {
+	suite.Suite
+	newRegistry func(t *testing.T) Registry
+	registry    Registry
+}
+
+func TestRedisRegistry(t *testing.T) {
+	suite.Run(t, &RegistryTestSuite{
+		newRegistry: func(t *testing.T) Registry {
+			server := miniredis.RunT(t)
+			return NewRedisRegistry(redis.NewClient(&redis.Options{
+				Addr: server.Addr(),
+			}), "local_msg_nodes")
+		},
+	})
+}
+
+func TestGormRegistry(t *testing.T) {
+	suite.Run(t, &RegistryTestSuite{
+		newRegistry: func(t *testing.T) Registry {
+			db, err := gorm.Open(mysql.Open("root:root@tcp(localhost:13316)/local_msg_test?charset=utf8mb4&collation=utf8mb4_general_ci&parseTime=True&loc=Local&timeout=1s&readTimeout=3s&writeTimeout=3s"))
+			require.NoError(t, err)
+			r := NewGormRegistry(db)
+			err = r.InitTable()
+			require.NoError(t, err)
+			err = db.Exec("DELETE FROM local_msg_nodes").Error
+			require.NoError(t, err)
+			return r
+		},
+	})
+}
+
+func (s *RegistryTestSuite) SetupTest() {
+	s.registry = s.newRegistry(s.T())
+}
+
+func (s *RegistryTestSuite) TestRegistry() {
+	t := s.T()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	err := s.registry.Heartbeat(ctx, "node2", time.Minute)
+	require.NoError(t, err)
+	err = s.registry.Heartbeat(ctx, "node1", time.Minute)
+	require.NoError(t, err)
+	// 重复发送心跳
+	err = s.registry.Heartbeat(ctx, "node1", time.Minute)
+	require.NoError(t, err)
+	members, err := s.registry.Members(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"node1", "node2"}, members)
+
+	// 心跳过期
+	err = s.registry.Heartbeat(ctx, "node3", time.Millisecond*100)
+	require.NoError(t, err)
+	members, err = s.registry.Members(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"node1", "node2", "node3"}, members)
+	time.Sleep(time.Millisecond * 200)
+	members, err = s.registry.Members(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"node1", "node2"}, members)
+
+	// 主动下线
+	err = s.registry.Leave(ctx, "node2")
+	require.NoError(t, err)
+	members, err = s.registry.Members(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"node1"}, members)
+}
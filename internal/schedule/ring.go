@@ -0,0 +1,54 @@
+package schedule
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Ring 一致性哈希环。每一个节点在环上有 replicas 个虚拟节点，用于让 key 分布得更加均匀
+// 节点加入或者离开的时候，只有一小部分 key 会换节点
+type Ring struct {
+	hashes []uint32
+	nodes  map[uint32]string
+}
+
+func NewRing(nodes []string, replicas int) *Ring {
+	r := &Ring{
+		hashes: make([]uint32, 0, len(nodes)*replicas),
+		nodes:  make(map[uint32]string, len(nodes)*replicas),
+	}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			// 极小概率出现哈希冲突，这时候保留名字比较小的那个，保证所有节点计算的结果是一样的
+			if old, ok := r.nodes[h]; ok {
+				if old < node {
+					continue
+				}
+			} else {
+				r.hashes = append(r.hashes, h)
+			}
+			r.nodes[h] = node
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	return r
+}
+
+// Get 返回 key 归属的节点，也就是环上顺时针方向的第一个节点。环上没有节点的时候返回空字符串
+func (r *Ring) Get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+	return r.nodes[r.hashes[idx]]
+}
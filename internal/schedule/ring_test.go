@@ -0,0 +1,45 @@
+package schedule
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	keys := make([]string, 0, 3000)
+	for i := 0; i < 3000; i++ {
+		keys = append(keys, fmt.Sprintf("orders_db_%02d.local_msgs_%02d", i/100, i%100))
+	}
+
+	// 没有节点
+	assert.Equal(t, "", NewRing(nil, 100).Get("key"))
+
+	// 节点的顺序不影响结果
+	r1 := NewRing([]string{"node1", "node2", "node3"}, 100)
+	r2 := NewRing([]string{"node3", "node1", "node2"}, 100)
+	cnt := make(map[string]int, 3)
+	for _, key := range keys {
+		owner := r1.Get(key)
+		assert.Equal(t, owner, r2.Get(key))
+		cnt[owner]++
+	}
+	// 大体上是均匀的
+	for _, node := range []string{"node1", "node2", "node3"} {
+		assert.Greater(t, cnt[node], 600, node)
+		assert.Less(t, cnt[node], 1400, node)
+	}
+
+	// 加入一个节点，只有分配给新节点的 key 会换节点
+	r3 := NewRing([]string{"node1", "node2", "node3", "node4"}, 100)
+	moved := 0
+	for _, key := range keys {
+		owner := r3.Get(key)
+		if owner != r1.Get(key) {
+			assert.Equal(t, "node4", owner)
+			moved++
+		}
+	}
+	assert.Greater(t, moved, 0)
+	assert.Less(t, moved, 1200)
+}
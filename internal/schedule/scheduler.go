@@ -0,0 +1,138 @@
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"github.com/ecodeclub/ekit/bean/option"
+	"github.com/google/uuid"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Scheduler 不依赖分布式锁，而是通过一致性哈希把 key 分配给存活的节点
+// 每一个节点定时发送心跳，并且根据当前存活的节点重新计算自己负责的 key：
+// 新分配给自己的 key 就开始执行，不再归属自己的 key 就取消执行
+//
+// 注意在节点加入或者离开的时候，各个节点看到的存活节点可能不一致，
+// 所以在一个心跳周期内，同一个 key 可能会同时在两个节点上执行，也可能暂时没有节点执行
+type Scheduler struct {
+	registry Registry
+	node     string
+	// 心跳间隔，也是重新分配的间隔
+	interval time.Duration
+	// 超过这个时间没有心跳，就认为节点已经下线了
+	ttl time.Duration
+	// 每个节点在哈希环上的虚拟节点数量
+	replicas int
+	logger   *slog.Logger
+}
+
+func NewScheduler(registry Registry, opts ...option.Option[Scheduler]) *Scheduler {
+	s := &Scheduler{
+		registry: registry,
+		node:     uuid.New().String(),
+		interval: time.Second * 5,
+		ttl:      time.Second * 15,
+		replicas: 100,
+		logger:   slog.Default(),
+	}
+	option.Apply(s, opts...)
+	s.logger = s.logger.With(slog.String("node", s.node))
+	return s
+}
+
+// Validate 校验参数是否合法
+func (s *Scheduler) Validate() error {
+	if s.interval <= 0 {
+		return fmt.Errorf("心跳间隔必须大于 0，当前值 %s", s.interval)
+	}
+	if s.ttl <= s.interval {
+		return fmt.Errorf("节点过期时间 %s 必须大于心跳间隔 %s", s.ttl, s.interval)
+	}
+	if s.replicas <= 0 {
+		return fmt.Errorf("虚拟节点数量必须大于 0，当前值 %d", s.replicas)
+	}
+	return nil
+}
+
+// Node 当前节点的名字
+func (s *Scheduler) Node() string {
+	return s.node
+}
+
+// Start 开始调度，直到 ctx 被取消。它会阻塞，并且在返回之前等待所有的 run 返回
+// 调用之前要先通过 Validate 校验参数
+// run 在自己负责的 key 上执行，当 key 不再归属自己，或者 ctx 被取消的时候，run 的 ctx 会被取消
+func (s *Scheduler) Start(ctx context.Context, keys []string, run func(ctx context.Context, key string)) {
+	var wg sync.WaitGroup
+	running := make(map[string]context.CancelFunc, len(keys))
+	defer func() {
+		for _, cancel := range running {
+			cancel()
+		}
+		wg.Wait()
+		// 主动下线，别的节点就可以立刻接手
+		leaveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second*3)
+		defer cancel()
+		if err := s.registry.Leave(leaveCtx, s.node); err != nil {
+			s.logger.Error("节点下线失败", slog.Any("err", err))
+		}
+	}()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		owned := s.owned(ctx, keys)
+		for key, cancel := range running {
+			if !owned[key] {
+				s.logger.Info("key 已经不归属当前节点", slog.String("key", key))
+				cancel()
+				delete(running, key)
+			}
+		}
+		for key := range owned {
+			if _, ok := running[key]; ok {
+				continue
+			}
+			s.logger.Info("开始执行 key", slog.String("key", key))
+			runCtx, cancel := context.WithCancel(ctx)
+			running[key] = cancel
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				run(runCtx, key)
+			}()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// owned 发送心跳，并且计算当前节点负责的 key
+// 任何一步出错都认为自己什么都不负责，因为别的节点可能已经认为自己下线了
+func (s *Scheduler) owned(ctx context.Context, keys []string) map[string]bool {
+	res := make(map[string]bool, len(keys))
+	rctx, cancel := context.WithTimeout(ctx, s.interval)
+	defer cancel()
+	err := s.registry.Heartbeat(rctx, s.node, s.ttl)
+	if err != nil {
+		s.logger.Error("发送心跳失败", slog.Any("err", err))
+		return res
+	}
+	members, err := s.registry.Members(rctx)
+	if err != nil {
+		s.logger.Error("查询存活节点失败", slog.Any("err", err))
+		return res
+	}
+	ring := NewRing(members, s.replicas)
+	for _, key := range keys {
+		if ring.Get(key) == s.node {
+			res[key] = true
+		}
+	}
+	return res
+}
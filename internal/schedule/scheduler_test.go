@@ -0,0 +1,125 @@
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ecodeclub/ekit/bean/option"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	server := miniredis.RunT(t)
+	registry := NewRedisRegistry(redis.NewClient(&redis.Options{
+		Addr: server.Addr(),
+	}), "local_msg_nodes")
+	keys := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("db.table_%02d", i))
+	}
+
+	// 记录每一个 key 正在哪些节点上执行
+	var mutex sync.Mutex
+	running := make(map[string]map[string]bool, len(keys))
+	start := func(ctx context.Context, node string) chan struct{} {
+		s := NewScheduler(registry, WithNodeName(node),
+			WithHeartbeat(time.Millisecond*50, time.Millisecond*200))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.Start(ctx, keys, func(ctx context.Context, key string) {
+				mutex.Lock()
+				if running[key] == nil {
+					running[key] = make(map[string]bool, 2)
+				}
+				running[key][node] = true
+				mutex.Unlock()
+				<-ctx.Done()
+				mutex.Lock()
+				delete(running[key], node)
+				mutex.Unlock()
+			})
+		}()
+		return done
+	}
+	assertRunning := func(nodes ...string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		cnt := make(map[string]int, len(nodes))
+		for _, key := range keys {
+			// 每个 key 只在一个节点上执行
+			if assert.Len(t, running[key], 1, key) {
+				for node := range running[key] {
+					cnt[node]++
+				}
+			}
+		}
+		// 每个节点都分到了 key
+		for _, node := range nodes {
+			assert.Greater(t, cnt[node], 0, node)
+		}
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	done1 := start(ctx1, "node1")
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	done2 := start(ctx2, "node2")
+	time.Sleep(time.Millisecond * 300)
+	assertRunning("node1", "node2")
+
+	// node2 下线，node1 接手全部的 key
+	cancel2()
+	<-done2
+	time.Sleep(time.Millisecond * 150)
+	assertRunning("node1")
+
+	cancel1()
+	<-done1
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, key := range keys {
+		assert.Len(t, running[key], 0, key)
+	}
+}
+
+func TestScheduler_Validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    []option.Option[Scheduler]
+		wantErr string
+	}{
+		{
+			name: "默认参数",
+		},
+		{
+			name:    "心跳间隔为 0",
+			opts:    []option.Option[Scheduler]{WithHeartbeat(0, time.Second)},
+			wantErr: "心跳间隔必须大于 0，当前值 0s",
+		},
+		{
+			name:    "过期时间不大于心跳间隔",
+			opts:    []option.Option[Scheduler]{WithHeartbeat(time.Second, time.Second)},
+			wantErr: "节点过期时间 1s 必须大于心跳间隔 1s",
+		},
+		{
+			name:    "虚拟节点数量为 0",
+			opts:    []option.Option[Scheduler]{WithReplicas(0)},
+			wantErr: "虚拟节点数量必须大于 0，当前值 0",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := NewScheduler(nil, tc.opts...).Validate()
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
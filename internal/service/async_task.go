@@ -5,13 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/IBM/sarama"
-	"github.com/meoying/local-msg-go/internal/dao"
 	dlock "github.com/meoying/local-msg-go/internal/lock"
 	"github.com/meoying/local-msg-go/internal/lock/errs"
 	"github.com/meoying/local-msg-go/internal/msg"
 	"github.com/meoying/local-msg-go/internal/sharding"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 	"log/slog"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,45 +30,79 @@ type AsyncTask struct {
 	batchSize int
 
 	lockClient dlock.Client
+	cfg        AsyncTaskConfig
+	// 业务发送消息失败的时候，会通过它唤醒补偿任务
+	wakeCh chan struct{}
+	// abortCtx 被取消的时候，才会中断正在发送的消息
+	abortCtx context.Context
+	// 正在运行的次数，用于 Shutdown 的时候报告哪些补偿任务没有退出
+	active atomic.Int32
+	health taskHealth
+	// backlog 不为 nil 的时候，负责这张表期间定时统计积压情况
+	backlog   *backlogSampler
+	tracer    trace.Tracer
+	listeners Listener
+}
+
+// wake 唤醒补偿任务，它不会阻塞
+func (task *AsyncTask) wake() {
+	select {
+	case task.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (task *AsyncTask) key() string {
+	return fmt.Sprintf("%s.%s", task.dst.DB, task.dst.Table)
 }
 
 // Start 开启补偿任务。当 ctx 过期或者被取消的时候，就会退出
 func (task *AsyncTask) Start(ctx context.Context) {
-	key := fmt.Sprintf("%s.%s", task.dst.DB, task.dst.Table)
+	key := task.key()
 	task.logger = task.logger.With(slog.String("key", key))
-	interval := time.Minute
 	for {
 		// 每个循环过程就是一次尝试拿到分布式锁之后，不断调度的过程
-		lock, err := task.lockClient.NewLock(ctx, key, interval)
+		lock, err := task.lockClient.NewLock(ctx, key, task.cfg.LockExpiration)
 		if err != nil {
 			task.logger.Error("初始化分布式锁失败，重试",
 				slog.Any("err", err))
+			task.health.recordErr(err)
 			// 暂停一会
-			time.Sleep(interval)
+			if !sleep(ctx, task.cfg.RetryInterval) {
+				return
+			}
 			continue
 		}
 
-		lockCtx, cancel := context.WithTimeout(ctx, time.Second*3)
 		// 没有拿到锁，不管是系统错误，还是锁被人持有，都没有关系
 		// 暂停一段时间之后继续
-		err = lock.Lock(lockCtx)
-		cancel()
+		err = task.lock(ctx, lock)
 
 		if err != nil {
 			if errors.Is(err, errs.ErrLocked) {
 				task.logger.Info("没有抢到分布式锁，此刻正有人持有锁")
 			} else {
 				task.logger.Error("没有抢到分布式锁，系统出现问题", slog.Any("err", err))
+				task.health.recordErr(err)
+			}
+			if !sleep(ctx, task.cfg.RetryInterval) {
+				return
 			}
-			// 10 秒钟是一个比较合适的
-			time.Sleep(interval)
 			continue
 		}
+		lock = &tracedLock{lock: lock, tracer: task.tracer, attrs: dstAttrs(task.dst)}
+		task.listeners.OnLockAcquired(ctx, task.dst)
 		// 开启任务循环
+		task.health.setOwned(true)
 		task.refreshAndLoop(ctx, lock)
+		task.health.setOwned(false)
 		// 只要这个方法返回，就说明你需要释放掉分布式锁，
 		// 比如说因为负载、异常等问题，导致你已经无法继续执行下去了
-		if unErr := lock.Unlock(ctx); unErr != nil {
+		// ctx 可能已经被取消了，但是依旧要释放锁，让别的节点尽快接手
+		unlockCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), task.cfg.LockTimeout)
+		unErr := lock.Unlock(unlockCtx)
+		cancel()
+		if unErr != nil {
 			task.logger.Error("释放分布式锁失败", slog.Any("err", unErr.Error()))
 		}
 		// 从这里退出的时候，要检测一下是不是需要结束了
@@ -78,82 +114,178 @@ func (task *AsyncTask) Start(ctx context.Context) {
 			return
 		default:
 			task.logger.Error("执行补偿任务失败，将执行重试")
-			time.Sleep(interval)
+			if !sleep(ctx, task.cfg.RetryInterval) {
+				return
+			}
 		}
 	}
-	// 开启
 }
 
-// TODO refreshAndLoop 每一个循环里面开一个 span
+// lock 尝试加锁，锁被别人持有不算出错
+func (task *AsyncTask) lock(ctx context.Context, lock dlock.Lock) error {
+	ctx, cancel := context.WithTimeout(ctx, task.cfg.LockTimeout)
+	defer cancel()
+	ctx, span := task.tracer.Start(ctx, "localmsg-lock", trace.WithAttributes(dstAttrs(task.dst)...))
+	err := lock.Lock(ctx)
+	if errors.Is(err, errs.ErrLocked) {
+		span.SetAttributes(attribute.Bool("locked_by_others", true))
+		span.End()
+		return err
+	}
+	if err == nil {
+		span.SetAttributes(attribute.Int64("fencing_token", lock.FencingToken()))
+	}
+	endSpan(span, err)
+	return err
+}
+
 func (task *AsyncTask) refreshAndLoop(ctx context.Context, lock dlock.Lock) {
 	// 这里有两个动作：
 	// 1. 执行异步补偿任务，
 	// 2. 判定要不要让出分布式锁，这里采用一种比较简单的策略，
 	// 3. 即当自身执行出错比较高的时候，就让出分布式锁
 
-	// 连续出现 error 的次数，用于容错、负载均衡
-	errCnt := 0
+	// 后台自动续约，一旦失去了锁，就立刻取消正在执行的任务，包括正在发送的消息
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	batchCtx, cancelBatch := context.WithCancel(task.abortCtx)
+	defer cancelBatch()
+	lost := dlock.AutoRefresh(ctx, lock, task.cfg.RefreshInterval)
+	go func() {
+		if err, ok := <-lost; ok {
+			task.listeners.OnLockLost(ctx, task.dst, err)
+			cancel()
+			cancelBatch()
+		}
+	}()
+
+	defer task.sampleBacklog(ctx)()
+	task.run(ctx, batchCtx, lock.FencingToken())
+}
+
+// StartScheduled 由 schedule.Scheduler 分配给当前节点之后开启补偿任务，不需要分布式锁
+// 当 ctx 被取消，也就是表不再归属当前节点，或者关闭服务的时候，就会退出
+func (task *AsyncTask) StartScheduled(ctx context.Context) {
+	task.health.setOwned(true)
+	defer task.health.setOwned(false)
+	defer task.sampleBacklog(ctx)()
 	for {
-		// 刷新的过期时间应该很短
-		refreshCtx, cancel := context.WithTimeout(ctx, time.Second*3)
-		// 手动控制每一批次循环开始就续约分布式锁
-		// 而后控制每一批次的超时时间，
-		// 这样就可以确保不会出现分布式锁过期，但是任务还在运行的情况
-		err := lock.Refresh(refreshCtx)
-		cancel()
-		if err != nil {
-			slog.Error("分布式锁续约失败，直接返回")
+		task.run(ctx, task.abortCtx, 0)
+		// 连续出错的时候，暂停一会
+		task.health.backoff(task.cfg.RetryInterval)
+		if !sleep(ctx, task.cfg.RetryInterval) {
 			return
 		}
+	}
+}
 
-		cnt, err := task.loop(ctx)
+// sampleBacklog 在后台统计积压情况，直到调用返回的 stop，也就是不再负责这张表
+// stop 会等统计结束，这样补偿任务退出之后就不会再上报了
+func (task *AsyncTask) sampleBacklog(ctx context.Context) (stop func()) {
+	if task.backlog == nil {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		task.backlog.run(ctx, task.db, task.dst)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// run 不断执行补偿任务，直到 ctx 被取消，或者连续出错
+// 每一批消息使用 batchCtx，这样 ctx 被取消的时候，正在发送的这一批依旧可以完成
+// token 是分布式锁的 fencing token，没有的话就是 0
+func (task *AsyncTask) run(ctx, batchCtx context.Context, token int64) {
+	p := newPacer(task.cfg, task.batchSize)
+	// 连续出现 error 的次数，用于容错、负载均衡
+	errCnt := 0
+	for {
+		opts := p.options(token)
+		opts.DB = task.dst.DB
+		cnt, err := task.loop(batchCtx, opts)
+		if errors.Is(err, ErrMigrating) {
+			// 消息被 Resharder 抢占了，由它负责后续的发送，不算补偿任务出错
+			task.logger.Warn("消息正在被迁移，没有更新发送状态", slog.Any("err", err))
+			err = nil
+		}
 		ctxErr := ctx.Err()
 		switch {
 		case errors.Is(ctxErr, context.Canceled), errors.Is(ctxErr, context.DeadlineExceeded):
-			// 这个是最上层用户取消，一般就是关闭服务的时候会触发
+			// 最上层用户取消，一般就是关闭服务的时候会触发
+			// 或者是已经失去了分布式锁
+			return
+		case errors.Is(err, ErrFenced):
+			// 已经有别的节点拿到了分布式锁，没必要再继续了
+			task.health.recordLoop(err, errCnt+1)
+			task.listeners.OnLockLost(ctx, task.dst, err)
 			return
 		case err != nil:
 			// 说明执行出错了，这个时候我们认为可能是偶发性失败，
 			// 也可能是系统高负载引起不可用
 			// 也可能是彻底不可用，我们通过连续 N 次循环都出错来判定是偶发还是非偶发
 			errCnt++
-			// 连续 5 次，基本上可以断定不是偶发性错误了
+			task.health.recordLoop(err, errCnt)
+			// 默认连续 5 次，基本上可以断定不是偶发性错误了
 			// 连续次数越多，越容易避开偶发性错误
-			const threshold = 5
-			if errCnt >= threshold {
-				task.logger.Error("执行任务连续出错，退出循环", slog.Int("threshold", threshold))
+			if errCnt >= task.cfg.ErrThreshold {
+				task.logger.Error("执行任务连续出错，退出循环", slog.Int("threshold", task.cfg.ErrThreshold))
 				return
 			}
 		default:
 			// 重置
 			errCnt = 0
-			// 一条都没有取到。那就说明没数据了，稍微等一下
-			if cnt == 0 {
-				time.Sleep(time.Second)
+			task.health.recordLoop(nil, 0)
+			// 一条都没有取到。那就说明没数据了，等一下，越闲等得越久
+			if wait := p.next(cnt); wait > 0 {
+				task.idle(ctx, p, wait)
 			}
 		}
 	}
 }
 
-func (task *AsyncTask) loop(ctx context.Context) (int, error) {
-	// 假设是 3s 一个循环，这个参数也可以控制
-	loopCtx, cancel := context.WithTimeout(ctx, time.Second*3)
+// idle 空闲的时候等待 wait，期间被唤醒的话就提前返回
+func (task *AsyncTask) idle(ctx context.Context, p *pacer, wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-task.wakeCh:
+		p.wake(task.waitDuration)
+	}
+}
+
+// loop 执行一批，每一批都是一个独立的 span
+func (task *AsyncTask) loop(ctx context.Context, opts ExecOptions) (int, error) {
+	loopCtx, cancel := context.WithTimeout(ctx, task.cfg.LoopTimeout)
 	defer cancel()
-	return task.executor.Exec(loopCtx, task.db, task.dst.Table)
+	loopCtx, span := task.tracer.Start(loopCtx, "localmsg-loop", trace.WithAttributes(dstAttrs(task.dst)...),
+		trace.WithAttributes(
+			attribute.Int("batch_size", opts.BatchSize),
+			attribute.Int("concurrency", opts.Concurrency),
+			attribute.Int64("fencing_token", opts.Token),
+		))
+	cnt, err := task.executor.Exec(loopCtx, task.db, task.dst.Table, opts)
+	span.SetAttributes(attribute.Int("cnt", cnt))
+	endSpan(span, err)
+	return cnt, err
 }
 
-func (task *AsyncTask) findSuspendMsg(ctx context.Context,
-	offset, limit int) ([]dao.LocalMsg, error) {
-	now := time.Now().UnixMilli()
-	utime := now - task.waitDuration.Milliseconds()
-	var res []dao.LocalMsg
-	// 这不用检测重试次数，因为重试次数达到了的话，状态会修改
-	err := task.db.WithContext(ctx).
-		// 考虑到分库分表的问题，这里需要指定表名
-		Table(task.dst.Table).
-		Where("status=? AND utime < ?", dao.MsgStatusInit, utime).
-		Limit(limit).Offset(offset).Find(&res).Error
-	return res, err
+// sleep 暂停 d，返回 false 说明 ctx 已经被取消了
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
 }
 
 func newSaramaProducerMsg(m msg.Msg) *sarama.ProducerMessage {
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"fmt"
+	"time"
+)
+
+// AsyncTaskConfig 补偿任务的各种时间参数
+type AsyncTaskConfig struct {
+	// LockExpiration 分布式锁的过期时间，节点崩溃之后，最长要过这么久别的节点才能接手
+	LockExpiration time.Duration
+	// LockTimeout 单次加锁的超时时间
+	LockTimeout time.Duration
+	// RefreshInterval 自动续约的间隔，连续 3 次续约失败就认为失去了锁，
+	// 所以它必须小于 LockExpiration 的三分之一
+	RefreshInterval time.Duration
+	// RetryInterval 没有抢到分布式锁，或者连续出错之后，要过这么久才会再次尝试
+	RetryInterval time.Duration
+	// LoopTimeout 每一批消息的超时时间，必须小于 LockExpiration
+	LoopTimeout time.Duration
+	// IdleInterval 一条消息都没有取到的时候，要过这么久才会取下一批
+	// 连续没有取到的时候，间隔会指数增长，直到 MaxIdleInterval
+	IdleInterval time.Duration
+	// MaxIdleInterval 空闲的时候最长的等待间隔，不能小于 IdleInterval
+	MaxIdleInterval time.Duration
+	// MaxBatchSize 积压的时候批次大小会翻倍增长，直到 MaxBatchSize
+	// 小于 ShardingService.BatchSize 的时候，批次大小不会增长
+	MaxBatchSize int
+	// MaxConcurrency 并发发送的时候，一批消息最多同时有多少个 goroutine 在发送
+	MaxConcurrency int
+	// ErrThreshold 连续出错多少次之后，就让出分布式锁
+	ErrThreshold int
+}
+
+// DefaultAsyncTaskConfig 默认的参数，可以在这个基础上修改
+func DefaultAsyncTaskConfig() AsyncTaskConfig {
+	return AsyncTaskConfig{
+		LockExpiration:  time.Minute,
+		LockTimeout:     time.Second * 3,
+		RefreshInterval: time.Second * 10,
+		RetryInterval:   time.Minute,
+		LoopTimeout:     time.Second * 3,
+		IdleInterval:    time.Second,
+		MaxIdleInterval: time.Second * 10,
+		MaxBatchSize:    100,
+		MaxConcurrency:  20,
+		ErrThreshold:    5,
+	}
+}
+
+// Validate 校验参数是否合法
+func (c AsyncTaskConfig) Validate() error {
+	durations := []struct {
+		name string
+		val  time.Duration
+	}{
+		{name: "LockExpiration", val: c.LockExpiration},
+		{name: "LockTimeout", val: c.LockTimeout},
+		{name: "RefreshInterval", val: c.RefreshInterval},
+		{name: "RetryInterval", val: c.RetryInterval},
+		{name: "LoopTimeout", val: c.LoopTimeout},
+		{name: "IdleInterval", val: c.IdleInterval},
+		{name: "MaxIdleInterval", val: c.MaxIdleInterval},
+	}
+	for _, d := range durations {
+		if d.val <= 0 {
+			return fmt.Errorf("%s 必须大于 0，当前值 %s", d.name, d.val)
+		}
+	}
+	if c.ErrThreshold <= 0 {
+		return fmt.Errorf("ErrThreshold 必须大于 0，当前值 %d", c.ErrThreshold)
+	}
+	if c.MaxConcurrency <= 0 {
+		return fmt.Errorf("MaxConcurrency 必须大于 0，当前值 %d", c.MaxConcurrency)
+	}
+	if c.MaxBatchSize < 0 {
+		return fmt.Errorf("MaxBatchSize 不能小于 0，当前值 %d", c.MaxBatchSize)
+	}
+	if c.MaxIdleInterval < c.IdleInterval {
+		return fmt.Errorf("MaxIdleInterval %s 不能小于 IdleInterval %s", c.MaxIdleInterval, c.IdleInterval)
+	}
+	if c.LockTimeout >= c.LockExpiration {
+		return fmt.Errorf("LockTimeout %s 必须小于 LockExpiration %s", c.LockTimeout, c.LockExpiration)
+	}
+	if c.LoopTimeout >= c.LockExpiration {
+		return fmt.Errorf("LoopTimeout %s 必须小于 LockExpiration %s", c.LoopTimeout, c.LockExpiration)
+	}
+	if c.RefreshInterval*3 >= c.LockExpiration {
+		return fmt.Errorf("RefreshInterval %s 必须小于 LockExpiration %s 的三分之一",
+			c.RefreshInterval, c.LockExpiration)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"github.com/meoying/local-msg-go/internal/metrics"
+	"github.com/meoying/local-msg-go/internal/schedule"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAsyncTaskConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		cfg     func() AsyncTaskConfig
+		wantErr string
+	}{
+		{
+			name: "默认参数",
+			cfg:  DefaultAsyncTaskConfig,
+		},
+		{
+			name: "时间不能为 0",
+			cfg: func() AsyncTaskConfig {
+				cfg := DefaultAsyncTaskConfig()
+				cfg.IdleInterval = 0
+				return cfg
+			},
+			wantErr: "IdleInterval 必须大于 0，当前值 0s",
+		},
+		{
+			name: "ErrThreshold 不能为 0",
+			cfg: func() AsyncTaskConfig {
+				cfg := DefaultAsyncTaskConfig()
+				cfg.ErrThreshold = 0
+				return cfg
+			},
+			wantErr: "ErrThreshold 必须大于 0，当前值 0",
+		},
+		{
+			name: "MaxConcurrency 不能为 0",
+			cfg: func() AsyncTaskConfig {
+				cfg := DefaultAsyncTaskConfig()
+				cfg.MaxConcurrency = 0
+				return cfg
+			},
+			wantErr: "MaxConcurrency 必须大于 0，当前值 0",
+		},
+		{
+			name: "最大空闲间隔太短",
+			cfg: func() AsyncTaskConfig {
+				cfg := DefaultAsyncTaskConfig()
+				cfg.MaxIdleInterval = time.Millisecond * 500
+				return cfg
+			},
+			wantErr: "MaxIdleInterval 500ms 不能小于 IdleInterval 1s",
+		},
+		{
+			name: "加锁超时时间太长",
+			cfg: func() AsyncTaskConfig {
+				cfg := DefaultAsyncTaskConfig()
+				cfg.LockTimeout = time.Minute
+				return cfg
+			},
+			wantErr: "LockTimeout 1m0s 必须小于 LockExpiration 1m0s",
+		},
+		{
+			name: "批次超时时间太长",
+			cfg: func() AsyncTaskConfig {
+				cfg := DefaultAsyncTaskConfig()
+				cfg.LoopTimeout = time.Minute * 2
+				return cfg
+			},
+			wantErr: "LoopTimeout 2m0s 必须小于 LockExpiration 1m0s",
+		},
+		{
+			name: "续约间隔太长",
+			cfg: func() AsyncTaskConfig {
+				cfg := DefaultAsyncTaskConfig()
+				cfg.RefreshInterval = time.Second * 20
+				return cfg
+			},
+			wantErr: "RefreshInterval 20s 必须小于 LockExpiration 1m0s 的三分之一",
+		},
+		{
+			name: "快速故障转移",
+			cfg: func() AsyncTaskConfig {
+				cfg := DefaultAsyncTaskConfig()
+				cfg.LockExpiration = time.Second * 10
+				cfg.RefreshInterval = time.Second * 3
+				cfg.RetryInterval = time.Second * 5
+				return cfg
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg().Validate()
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestShardingService_StartAsyncTask(t *testing.T) {
+	dst := sharding.Dst{DB: "db", Table: "hot_table"}
+	hot := DefaultAsyncTaskConfig()
+	hot.LoopTimeout = time.Minute * 2
+	svc := NewShardingService(nil, nil, nil, sharding.Sharding{
+		EffectiveTablesFunc: func() []sharding.Dst {
+			return []sharding.Dst{{DB: "db", Table: "cold_table"}, dst}
+		},
+	}, WithTableAsyncTaskConfig(dst, hot))
+	// 某张表的参数不合法，所有的补偿任务都不会开启
+	err := svc.StartAsyncTask(context.Background())
+	assert.EqualError(t, err, "补偿任务参数不合法 db.hot_table: LoopTimeout 2m0s 必须小于 LockExpiration 1m0s")
+}
+
+func TestShardingService_StartAsyncTask_Scheduler(t *testing.T) {
+	svc := NewShardingService(nil, nil, nil, sharding.NewNoShard("local_msgs"),
+		WithPartitionScheduler(schedule.NewScheduler(nil, schedule.WithHeartbeat(0, time.Second))))
+	err := svc.StartAsyncTask(context.Background())
+	assert.EqualError(t, err, "调度参数不合法: 心跳间隔必须大于 0，当前值 0s")
+}
+
+func TestShardingService_StartAsyncTask_BacklogMetrics(t *testing.T) {
+	testCases := []struct {
+		name     string
+		interval time.Duration
+		maxCount int
+		wantErr  string
+	}{
+		{
+			name:     "统计间隔为 0",
+			maxCount: 100,
+			wantErr:  "积压监控参数不合法: 统计间隔必须大于 0，当前值 0s",
+		},
+		{
+			name:     "统计数量的上限为 0",
+			interval: time.Second,
+			wantErr:  "积压监控参数不合法: 统计数量的上限必须大于 0，当前值 0",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := NewShardingService(nil, nil, nil, sharding.NewNoShard("local_msgs"),
+				WithBacklogMetrics(tc.interval, tc.maxCount), WithMetrics(metrics.Nop{}))
+			err := svc.StartAsyncTask(context.Background())
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
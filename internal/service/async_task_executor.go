@@ -2,9 +2,13 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ecodeclub/ekit/slice"
 	"github.com/meoying/local-msg-go/internal/dao"
+	"github.com/meoying/local-msg-go/internal/metrics"
+	"github.com/meoying/local-msg-go/internal/sharding"
 	"golang.org/x/sync/errgroup"
 	"gorm.io/gorm"
 	"log/slog"
@@ -13,11 +17,35 @@ import (
 
 // Executor 补偿任务执行器
 type Executor interface {
-	Exec(ctx context.Context, db *gorm.DB, table string) (int, error)
+	// Exec 执行一批，返回取到的消息数量
+	Exec(ctx context.Context, db *gorm.DB, table string, opts ExecOptions) (int, error)
 }
 
+// ExecOptions 补偿任务会根据积压情况调整每一批的参数
+type ExecOptions struct {
+	// Token 补偿任务持有的分布式锁的 fencing token，没有的话就是 0
+	Token int64
+	// BatchSize 这一批最多取多少条消息，为 0 的时候使用 ShardingService.BatchSize
+	BatchSize int
+	// Concurrency 最多同时有多少个 goroutine 在发送，为 0 的时候不限制
+	Concurrency int
+	// DB 表所在的逻辑库，用于通知 Listener
+	DB string
+}
+
+// sendOptions 补偿任务发送消息
+func (opts ExecOptions) sendOptions(table string) sendOptions {
+	return sendOptions{
+		dst:   sharding.Dst{DB: opts.DB, Table: table},
+		token: opts.Token,
+		path:  metrics.PathCompensation,
+	}
+}
+
+// findSuspendMsg 按照 utime 升序，也就是最久没有被处理的消息优先，可以走 status, utime 联合索引
+// 处理过的消息的 utime 会被更新，所以不需要翻页，每一批都从头开始取就可以
 func findSuspendMsg(ctx context.Context, db *gorm.DB, waitDuration time.Duration, table string,
-	offset, limit int) ([]dao.LocalMsg, error) {
+	limit int) ([]dao.LocalMsg, error) {
 	now := time.Now().UnixMilli()
 	utime := now - waitDuration.Milliseconds()
 	var res []dao.LocalMsg
@@ -26,7 +54,7 @@ func findSuspendMsg(ctx context.Context, db *gorm.DB, waitDuration time.Duration
 		// 考虑到分库分表的问题，这里需要指定表名
 		Table(table).
 		Where("status=? AND utime < ?", dao.MsgStatusInit, utime).
-		Limit(limit).Offset(offset).Find(&res).Error
+		Order("utime ASC").Limit(limit).Find(&res).Error
 	return res, err
 }
 
@@ -43,25 +71,44 @@ func NewCurMsgExecutor(svc *ShardingService) *CurMsgExecutor {
 	}
 }
 
-func (c *CurMsgExecutor) Exec(ctx context.Context, db *gorm.DB, table string) (int, error) {
-	data, err := findSuspendMsg(ctx, db, c.svc.WaitDuration, table, 0, c.svc.BatchSize)
+func (c *CurMsgExecutor) Exec(ctx context.Context, db *gorm.DB, table string, opts ExecOptions) (int, error) {
+	data, err := c.svc.findSuspendMsg(ctx, db, table, c.svc.batchSize(opts))
 	if err != nil {
 		c.logger.Error("查询数据失败", slog.String("err", err.Error()))
 		return 0, fmt.Errorf("查询数据失败 %w", err)
 	}
 	c.logger.Debug("找到数据", slog.Int("cnt", len(data)))
 	var eg errgroup.Group
-	for _, m := range data {
+	if opts.Concurrency > 0 {
+		eg.SetLimit(opts.Concurrency)
+	}
+	sent := len(data)
+	for i, m := range data {
 		shadow := m
+		// 在开启 goroutine 之前就申请，这样所有补偿任务的 goroutine 数量也是受限的
+		release, err1 := c.svc.limiter.acquire(ctx, msgTopic(&shadow), 1)
+		if err1 != nil {
+			sent = i
+			if limited(err1) {
+				// 一般是这一批超时了，剩下的等下一批，不算出错
+				c.logger.Debug("等待发送限制超时", slog.Int("sent", sent))
+				break
+			}
+			eg.Go(func() error {
+				return fmt.Errorf("等待发送限制失败 %w", err1)
+			})
+			break
+		}
 		eg.Go(func() error {
-			err1 := c.svc.sendMsg(ctx, db, &shadow, table)
+			defer release()
+			err1 := c.svc.sendMsg(ctx, db, &shadow, opts.sendOptions(table))
 			if err1 != nil {
 				err1 = fmt.Errorf("发送消息失败 %w", err1)
 			}
 			return err1
 		})
 	}
-	return len(data), eg.Wait()
+	return sent, eg.Wait()
 }
 
 // BatchMsgExecutor 批量发送消息
@@ -77,18 +124,66 @@ func NewBatchMsgExecutor(svc *ShardingService) *BatchMsgExecutor {
 	}
 }
 
-func (b *BatchMsgExecutor) Exec(ctx context.Context, db *gorm.DB, table string) (int, error) {
-	data, err := findSuspendMsg(ctx, db, b.svc.WaitDuration, table, 0, b.svc.BatchSize)
+func (b *BatchMsgExecutor) Exec(ctx context.Context, db *gorm.DB, table string, opts ExecOptions) (int, error) {
+	data, err := b.svc.findSuspendMsg(ctx, db, table, b.svc.batchSize(opts))
 	if err != nil {
 		b.logger.Error("查询数据失败", slog.String("err", err.Error()))
 		return 0, fmt.Errorf("查询数据失败 %w", err)
 	}
 	b.logger.Debug("找到数据", slog.Int("cnt", len(data)))
-	err = b.svc.sendMsgs(ctx, db, getMsgs(data), table)
+	dmsgs := getMsgs(data)
+	n, release, err := b.acquire(ctx, dmsgs)
+	if err != nil {
+		return 0, fmt.Errorf("等待发送限制失败 %w", err)
+	}
+	if n == 0 {
+		// 这一批超时了，等下一批，不算出错
+		b.logger.Debug("等待发送限制超时")
+		return 0, nil
+	}
+	defer release()
+	err = b.svc.sendMsgs(ctx, db, dmsgs[:n], opts.sendOptions(table))
 	if err != nil {
 		return 0, fmt.Errorf("发送消息失败 %w", err)
 	}
-	return len(data), nil
+	return n, nil
+}
+
+// acquire 按照 topic 申请整批消息的发送名额，返回拿到了名额的消息数量
+// 截止时间之前拿不到整批的名额的时候，减半之后再试，剩下的消息留给下一批
+func (b *BatchMsgExecutor) acquire(ctx context.Context, dmsgs []*dao.LocalMsg) (int, func(), error) {
+	for n := len(dmsgs); n > 0; n /= 2 {
+		cnts := make(map[string]int, 1)
+		for _, dmsg := range dmsgs[:n] {
+			cnts[msgTopic(dmsg)]++
+		}
+		release, err := b.svc.limiter.acquireBatch(ctx, cnts)
+		switch {
+		case err == nil:
+			return n, release, nil
+		case !limited(err):
+			return 0, nil, err
+		case ctx.Err() != nil:
+			// 已经等到了截止时间，减半也没有用了
+			return 0, nil, nil
+		}
+	}
+	return 0, nil, nil
+}
+
+// limited 等待发送限制的时候到了这一批的截止时间，或者被取消了
+func limited(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// msgTopic 从消息内容中提取 topic，提取失败的时候返回空字符串，
+// 此时只受全局的发送限制，后面发送的时候会再报错
+func msgTopic(dmsg *dao.LocalMsg) string {
+	var m struct {
+		Topic string
+	}
+	_ = json.Unmarshal(dmsg.Data, &m)
+	return m.Topic
 }
 
 func getMsgs(dmsgs []dao.LocalMsg)[]*dao.LocalMsg{
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"time"
+)
+
+// pacer 根据上一批的结果，调整下一批的大小和间隔
+// 1. 一条消息都没有取到的时候，间隔从 IdleInterval 开始指数增长，直到 MaxIdleInterval
+// 2. 取满了一批，说明积压比较多，批次大小翻倍，直到 MaxBatchSize；没有取满就逐步减回去
+// 3. 业务发送消息失败的时候会唤醒，等到这条消息可以补偿的时候，立刻取下一批
+type pacer struct {
+	cfg       AsyncTaskConfig
+	baseBatch int
+
+	batchSize int
+	idle      time.Duration
+	// 有消息会在这个时间点之后可以补偿，零值说明没有
+	due time.Time
+}
+
+func newPacer(cfg AsyncTaskConfig, batchSize int) *pacer {
+	return &pacer{
+		cfg:       cfg,
+		baseBatch: batchSize,
+		batchSize: batchSize,
+		idle:      cfg.IdleInterval,
+	}
+}
+
+func (p *pacer) options(token int64) ExecOptions {
+	return ExecOptions{
+		Token:       token,
+		BatchSize:   p.batchSize,
+		Concurrency: min(p.batchSize, p.cfg.MaxConcurrency),
+	}
+}
+
+// next 根据这一批取到的消息数量，返回要等多久才取下一批
+func (p *pacer) next(cnt int) time.Duration {
+	now := time.Now()
+	if !p.due.IsZero() && !now.Before(p.due) {
+		// 这一批已经包含了唤醒时候的那条消息
+		p.due = time.Time{}
+	}
+	if cnt > 0 {
+		p.idle = p.cfg.IdleInterval
+		if cnt >= p.batchSize {
+			p.batchSize = min(p.batchSize*2, max(p.cfg.MaxBatchSize, p.baseBatch))
+		} else {
+			p.batchSize = max(p.batchSize/2, p.baseBatch)
+		}
+		return 0
+	}
+	p.batchSize = p.baseBatch
+	wait := p.idle
+	p.idle = min(p.idle*2, p.cfg.MaxIdleInterval)
+	if !p.due.IsZero() {
+		wait = min(wait, p.due.Sub(now))
+	}
+	return wait
+}
+
+// wake 有消息刚刚发送失败了，它要过了 waitDuration 才可以补偿
+func (p *pacer) wake(waitDuration time.Duration) {
+	// 稍微多等一点，避免因为时间精度问题取不到
+	due := time.Now().Add(waitDuration + time.Millisecond*10)
+	if p.due.IsZero() || due.Before(p.due) {
+		p.due = due
+	}
+	p.idle = p.cfg.IdleInterval
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	cfg := DefaultAsyncTaskConfig()
+	cfg.IdleInterval = time.Second
+	cfg.MaxIdleInterval = time.Second * 4
+	cfg.MaxBatchSize = 40
+	cfg.MaxConcurrency = 15
+	p := newPacer(cfg, 10)
+	assert.Equal(t, ExecOptions{Token: 3, BatchSize: 10, Concurrency: 10}, p.options(3))
+
+	// 一直取满，批次翻倍，直到 MaxBatchSize
+	assert.Equal(t, time.Duration(0), p.next(10))
+	assert.Equal(t, 20, p.batchSize)
+	assert.Equal(t, time.Duration(0), p.next(20))
+	assert.Equal(t, 40, p.batchSize)
+	assert.Equal(t, time.Duration(0), p.next(40))
+	assert.Equal(t, 40, p.batchSize)
+	assert.Equal(t, ExecOptions{BatchSize: 40, Concurrency: 15}, p.options(0))
+
+	// 没有取满，逐步减回去
+	assert.Equal(t, time.Duration(0), p.next(5))
+	assert.Equal(t, 20, p.batchSize)
+	assert.Equal(t, time.Duration(0), p.next(5))
+	assert.Equal(t, 10, p.batchSize)
+	assert.Equal(t, time.Duration(0), p.next(5))
+	assert.Equal(t, 10, p.batchSize)
+
+	// 空闲的时候，间隔指数增长，直到 MaxIdleInterval
+	assert.Equal(t, time.Second, p.next(0))
+	assert.Equal(t, time.Second*2, p.next(0))
+	assert.Equal(t, time.Second*4, p.next(0))
+	assert.Equal(t, time.Second*4, p.next(0))
+
+	// 取到了消息，间隔恢复
+	p.next(1)
+	assert.Equal(t, time.Second, p.next(0))
+}
+
+func TestPacer_Wake(t *testing.T) {
+	cfg := DefaultAsyncTaskConfig()
+	cfg.IdleInterval = time.Second
+	cfg.MaxIdleInterval = time.Minute
+	p := newPacer(cfg, 10)
+	for i := 0; i < 5; i++ {
+		p.next(0)
+	}
+	// 唤醒之后，最多等到消息可以补偿的时候
+	p.wake(time.Millisecond * 100)
+	wait := p.next(0)
+	assert.True(t, wait <= time.Millisecond*110, wait)
+	assert.True(t, wait > 0, wait)
+
+	// 过了之后，就不再受唤醒影响了
+	time.Sleep(wait)
+	assert.Equal(t, time.Second*2, p.next(0))
+	assert.True(t, p.due.IsZero())
+}
+
+// MaxBatchSize 比 BatchSize 小的时候，批次大小不会增长
+func TestPacer_SmallMaxBatchSize(t *testing.T) {
+	cfg := DefaultAsyncTaskConfig()
+	cfg.MaxBatchSize = 0
+	p := newPacer(cfg, 10)
+	p.next(10)
+	assert.Equal(t, 10, p.batchSize)
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/meoying/local-msg-go/internal/dao"
+	"github.com/meoying/local-msg-go/internal/metrics"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"gorm.io/gorm"
+	"log/slog"
+	"time"
+)
+
+// backlogSampler 负责某张表的补偿任务定时统计积压情况
+// 只有负责这张表的节点才会统计，失去这张表的时候会删除对应的指标，避免多个节点上报
+type backlogSampler struct {
+	interval time.Duration
+	// 统计数量的上限
+	maxCount int
+	metrics  metrics.Metrics
+	logger   *slog.Logger
+}
+
+// WithBacklogMetrics 负责某张表的补偿任务每隔 interval 统计一次积压情况：
+// 待发送的消息数量、发送失败的消息数量，以及最久没有被处理的待发送消息的年龄
+// 数量最多统计到 maxCount，避免积压严重的时候扫描太多数据
+// 没有使用 WithMetrics 的时候，注册在 prometheus.DefaultRegisterer 上
+// interval 和 maxCount 都必须大于 0，在 StartAsyncTask 的时候校验
+func WithBacklogMetrics(interval time.Duration, maxCount int) ShardingServiceOpt {
+	return func(service *ShardingService) {
+		service.backlog = &backlogSampler{
+			interval: interval,
+			maxCount: maxCount,
+			logger:   service.Logger,
+		}
+	}
+}
+
+// Validate 校验参数是否合法
+func (b *backlogSampler) Validate() error {
+	if b.interval <= 0 {
+		return fmt.Errorf("统计间隔必须大于 0，当前值 %s", b.interval)
+	}
+	if b.maxCount <= 0 {
+		return fmt.Errorf("统计数量的上限必须大于 0，当前值 %d", b.maxCount)
+	}
+	return nil
+}
+
+// run 定时统计，直到 ctx 被取消
+func (b *backlogSampler) run(ctx context.Context, db *gorm.DB, dst sharding.Dst) {
+	msgDAO := dao.NewMsgDAO(db)
+	defer b.metrics.DeleteBacklog(dst.DB, dst.Table)
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		b.sample(ctx, msgDAO, dst)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *backlogSampler) sample(ctx context.Context, msgDAO *dao.MsgDAO, dst sharding.Dst) {
+	ctx, cancel := context.WithTimeout(ctx, b.interval)
+	defer cancel()
+	pending, err := msgDAO.Count(ctx, dst.Table, dao.MsgStatusInit, b.maxCount)
+	if err != nil {
+		b.logger.Error("统计待发送消息失败", slog.Any("err", err))
+		return
+	}
+	failed, err := msgDAO.Count(ctx, dst.Table, dao.MsgStatusFail, b.maxCount)
+	if err != nil {
+		b.logger.Error("统计发送失败消息失败", slog.Any("err", err))
+		return
+	}
+	var age time.Duration
+	oldest, err := msgDAO.OldestPending(ctx, dst.Table)
+	switch {
+	case err == nil:
+		age = time.Since(time.UnixMilli(oldest.Ctime))
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		b.logger.Error("查询最久没有被处理的消息失败", slog.Any("err", err))
+		return
+	}
+	b.metrics.SetBacklog(dst.DB, dst.Table, metrics.Backlog{
+		Pending:   pending,
+		Failed:    failed,
+		OldestAge: age,
+	})
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"sync"
+	"time"
+)
+
+// Health 补偿任务的健康状况
+type Health struct {
+	// Started 是否已经开启了补偿任务
+	Started bool
+	// Stopping 是否已经开始关闭补偿任务
+	Stopping bool
+	Tasks    []TaskHealth
+}
+
+// Ready 补偿任务已经开启，并且没有在关闭
+func (h Health) Ready() bool {
+	return h.Started && !h.Stopping
+}
+
+// Live 没有卡住的补偿任务
+func (h Health) Live() bool {
+	for _, t := range h.Tasks {
+		if t.Stalled {
+			return false
+		}
+	}
+	return true
+}
+
+// TaskHealth 某张表的补偿任务的健康状况
+type TaskHealth struct {
+	Dst sharding.Dst
+	// Owned 当前节点是否负责这张表，也就是持有分布式锁，或者被 Scheduler 分配给了当前节点
+	Owned bool
+	// LastLoopTime 上一次执行完一批的时间，不管成功还是失败
+	LastLoopTime time.Time
+	// LastSuccessTime 上一次成功执行完一批的时间
+	LastSuccessTime time.Time
+	// ErrCnt 连续出错的次数，达到 AsyncTaskConfig.ErrThreshold 之后会让出分布式锁
+	ErrCnt int
+	// LastErr 最近一次出错的原因，包括执行出错和加锁出错
+	LastErr     string
+	LastErrTime time.Time
+	// Stalled 负责这张表，但是很久都没有执行完一批，可能卡住了
+	Stalled bool
+}
+
+// taskHealth 补偿任务在运行过程中记录自己的状况
+type taskHealth struct {
+	mu sync.RWMutex
+	TaskHealth
+	// ownedTime 开始负责这张表的时间
+	ownedTime time.Time
+	// backoffUntil 连续出错之后暂停到这个时间，暂停期间不算卡住
+	backoffUntil time.Time
+}
+
+func (h *taskHealth) setOwned(owned bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Owned = owned
+	if owned {
+		h.ErrCnt = 0
+		h.ownedTime = time.Now()
+	}
+}
+
+// recordLoop 记录执行完一批的结果，errCnt 是连续出错的次数
+func (h *taskHealth) recordLoop(err error, errCnt int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.LastLoopTime = now
+	h.ErrCnt = errCnt
+	if err == nil {
+		h.LastSuccessTime = now
+		return
+	}
+	h.LastErr = err.Error()
+	h.LastErrTime = now
+}
+
+// backoff 记录接下来要暂停 d，暂停是主动的，不应该让存活探针失败
+func (h *taskHealth) backoff(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.backoffUntil = time.Now().Add(d)
+}
+
+// recordErr 记录加锁之类的，和执行一批无关的错误
+func (h *taskHealth) recordErr(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.LastErr = err.Error()
+	h.LastErrTime = time.Now()
+}
+
+// snapshot stallAfter 是多久没有执行完一批就认为卡住了
+func (h *taskHealth) snapshot(dst sharding.Dst, stallAfter time.Duration) TaskHealth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	res := h.TaskHealth
+	res.Dst = dst
+	if res.Owned {
+		last := h.ownedTime
+		if res.LastLoopTime.After(last) {
+			last = res.LastLoopTime
+		}
+		if h.backoffUntil.After(last) {
+			last = h.backoffUntil
+		}
+		res.Stalled = time.Since(last) > stallAfter
+	}
+	return res
+}
+
+// stallAfter 空闲的时候最多等 MaxIdleInterval，每一批最多执行 LoopTimeout，
+// 两倍的时间都没有执行完一批，基本可以断定卡住了
+func (task *AsyncTask) stallAfter() time.Duration {
+	return (task.cfg.LoopTimeout + task.cfg.MaxIdleInterval) * 2
+}
+
+// Health 返回补偿任务的健康状况，只包含当前节点的视角
+func (svc *ShardingService) Health() Health {
+	l := &svc.lifecycle
+	l.mu.Lock()
+	res := Health{
+		Started:  l.started,
+		Stopping: l.stopping,
+	}
+	tasks := l.tasks
+	l.mu.Unlock()
+	res.Tasks = make([]TaskHealth, 0, len(tasks))
+	for _, task := range tasks {
+		res.Tasks = append(res.Tasks, task.health.snapshot(task.dst, task.stallAfter()))
+	}
+	return res
+}
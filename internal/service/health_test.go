@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardingService_Health(t *testing.T) {
+	lockClient := &fakeLockClient{}
+	svc := NewShardingService(nil, nil, lockClient, sharding.NewNoShard("local_msgs"))
+	cfg := DefaultAsyncTaskConfig()
+	cfg.LoopTimeout = time.Millisecond * 100
+	cfg.IdleInterval = time.Millisecond * 10
+	cfg.MaxIdleInterval = time.Millisecond * 10
+	cfg.ErrThreshold = 1000000
+	svc.taskCfg = cfg
+	executor := &scriptExecutor{release: make(chan struct{})}
+	defer close(executor.release)
+	svc.executor = executor
+
+	h := svc.Health()
+	assert.False(t, h.Ready())
+	assert.True(t, h.Live())
+
+	require.NoError(t, svc.Start(context.Background()))
+	assert.Eventually(t, func() bool {
+		h = svc.Health()
+		return len(h.Tasks) == 1 && h.Tasks[0].ErrCnt >= 2
+	}, time.Second, time.Millisecond*10)
+	assert.True(t, h.Ready())
+	assert.True(t, h.Live())
+	task := h.Tasks[0]
+	assert.Equal(t, sharding.Dst{Table: "local_msgs"}, task.Dst)
+	assert.True(t, task.Owned)
+	assert.Equal(t, "mock error", task.LastErr)
+	assert.False(t, task.LastLoopTime.IsZero())
+
+	// 恢复之后，连续出错次数清零
+	executor.ok.Store(true)
+	assert.Eventually(t, func() bool {
+		task = svc.Health().Tasks[0]
+		return task.ErrCnt == 0 && !task.LastSuccessTime.IsZero()
+	}, time.Second, time.Millisecond*10)
+
+	// 卡住了
+	executor.stuck.Store(true)
+	assert.Eventually(t, func() bool {
+		return !svc.Health().Live()
+	}, time.Second*2, time.Millisecond*50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_ = svc.Shutdown(ctx)
+	h = svc.Health()
+	assert.False(t, h.Ready())
+}
+
+// scriptExecutor 一开始返回错误，ok 之后正常执行，stuck 之后无视超时一直阻塞到 release
+type scriptExecutor struct {
+	ok      atomic.Bool
+	stuck   atomic.Bool
+	release chan struct{}
+}
+
+func (s *scriptExecutor) Exec(ctx context.Context, db *gorm.DB, table string, opts ExecOptions) (int, error) {
+	if s.stuck.Load() {
+		<-s.release
+	}
+	if s.ok.Load() {
+		return 0, nil
+	}
+	return 0, errors.New("mock error")
+}
+
+func TestTaskHealth_Stalled(t *testing.T) {
+	stallAfter := time.Millisecond * 50
+	h := &taskHealth{}
+	h.setOwned(true)
+	assert.False(t, h.snapshot(sharding.Dst{}, stallAfter).Stalled)
+
+	// 暂停期间不算卡住，哪怕暂停的时间比 stallAfter 长
+	h.backoff(time.Millisecond * 200)
+	time.Sleep(time.Millisecond * 100)
+	assert.False(t, h.snapshot(sharding.Dst{}, stallAfter).Stalled)
+
+	// 暂停结束之后还是没有执行完一批，就是卡住了
+	time.Sleep(time.Millisecond * 200)
+	assert.True(t, h.snapshot(sharding.Dst{}, stallAfter).Stalled)
+
+	h.recordLoop(nil, 0)
+	assert.False(t, h.snapshot(sharding.Dst{}, stallAfter).Stalled)
+}
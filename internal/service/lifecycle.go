@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// ErrStarted 一个 ShardingService 只能开启一次补偿任务
+var ErrStarted = errors.New("补偿任务已经开启过了")
+
+// ShutdownError 到了截止时间，依旧有补偿任务没有退出
+// 这些补偿任务正在发送的消息会被中断，它们持有的分布式锁会在中断之后释放，
+// 如果释放失败，那么别的节点要等到分布式锁过期才能接手
+type ShutdownError struct {
+	// Unfinished 没有退出的补偿任务对应的表
+	Unfinished []sharding.Dst
+	Err        error
+}
+
+func (e *ShutdownError) Error() string {
+	tables := make([]string, 0, len(e.Unfinished))
+	for _, dst := range e.Unfinished {
+		tables = append(tables, dst.DB+"."+dst.Table)
+	}
+	return fmt.Sprintf("补偿任务没有及时退出 %s: %s", strings.Join(tables, ", "), e.Err)
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// lifecycle 记录开启的补偿任务，用于 Shutdown
+type lifecycle struct {
+	mu      sync.Mutex
+	started bool
+	// stopping 已经调用了 Shutdown
+	stopping bool
+	// stop 让补偿任务不再取新的一批消息
+	stop context.CancelFunc
+	// abort 中断正在发送的消息
+	abort context.CancelFunc
+	wg    sync.WaitGroup
+	tasks []*AsyncTask
+}
+
+// Start 开启补偿任务，参数不合法的时候返回 error，并且不会开启任何补偿任务
+// 和 StartAsyncTask 不同的是，ctx 被取消的时候，补偿任务只是不再取新的一批消息，
+// 正在发送的消息依旧会发送完并且更新状态。要等待补偿任务退出，使用 Shutdown
+func (svc *ShardingService) Start(ctx context.Context) error {
+	return svc.start(ctx, true)
+}
+
+// Shutdown 关闭补偿任务：
+// 1. 不再取新的一批消息，也不再抢分布式锁；
+// 2. 等待正在发送的消息发送完，并且更新完状态；
+// 3. 释放所有的分布式锁。
+// 如果 ctx 过期的时候还有补偿任务没有退出，就中断它们，并且返回 *ShutdownError
+func (svc *ShardingService) Shutdown(ctx context.Context) error {
+	l := &svc.lifecycle
+	l.mu.Lock()
+	if !l.started {
+		l.mu.Unlock()
+		return nil
+	}
+	l.stopping = true
+	stop, abort, tasks := l.stop, l.abort, l.tasks
+	l.mu.Unlock()
+
+	stop()
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		abort()
+		return nil
+	case <-ctx.Done():
+	}
+	var unfinished []sharding.Dst
+	for _, task := range tasks {
+		if task.active.Load() > 0 {
+			unfinished = append(unfinished, task.dst)
+		}
+	}
+	abort()
+	return &ShutdownError{Unfinished: unfinished, Err: ctx.Err()}
+}
+
+// start drain 为 true 的时候，ctx 被取消不会中断正在发送的消息，只有 Shutdown 超时才会
+func (svc *ShardingService) start(ctx context.Context, drain bool) error {
+	dsts := svc.Sharding.EffectiveTablesFunc()
+	cfgs := make([]AsyncTaskConfig, 0, len(dsts))
+	for _, dst := range dsts {
+		cfg := svc.taskCfg
+		if tableCfg, ok := svc.tableTaskCfgs[dst]; ok {
+			cfg = tableCfg
+		}
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("补偿任务参数不合法 %s.%s: %w", dst.DB, dst.Table, err)
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	if svc.scheduler != nil {
+		if err := svc.scheduler.Validate(); err != nil {
+			return fmt.Errorf("调度参数不合法: %w", err)
+		}
+	}
+	if svc.backlog != nil {
+		if err := svc.backlog.Validate(); err != nil {
+			return fmt.Errorf("积压监控参数不合法: %w", err)
+		}
+	}
+	limiter, err := newSendLimiter(svc.sendLimit, svc.topicSendLimits)
+	if err != nil {
+		return err
+	}
+
+	l := &svc.lifecycle
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.started {
+		return ErrStarted
+	}
+	l.started = true
+	svc.limiter = limiter
+
+	abortCtx := ctx
+	if drain {
+		abortCtx = context.WithoutCancel(ctx)
+	}
+	abortCtx, l.abort = context.WithCancel(abortCtx)
+	ctx, l.stop = context.WithCancel(ctx)
+
+	tasks := make(map[string]*AsyncTask)
+	var keys []string
+	for i, dst := range dsts {
+		task := &AsyncTask{
+			waitDuration: svc.WaitDuration,
+			executor:     svc.executor,
+			db:           svc.DBs[dst.DB],
+			dst:          dst,
+			batchSize:    svc.BatchSize,
+			logger:       svc.Logger,
+			lockClient:   svc.LockClient,
+			cfg:          cfgs[i],
+			wakeCh:       make(chan struct{}, 1),
+			abortCtx:     abortCtx,
+			backlog:      svc.backlog,
+			tracer:       svc.tracer,
+			listeners:    svc.listeners,
+		}
+		svc.tasks.Store(dst, task)
+		l.tasks = append(l.tasks, task)
+		if svc.scheduler == nil {
+			task.active.Add(1)
+			l.wg.Add(1)
+			go func() {
+				defer l.wg.Done()
+				defer task.active.Add(-1)
+				task.Start(ctx)
+			}()
+			continue
+		}
+		key := task.key()
+		task.logger = task.logger.With(slog.String("key", key))
+		tasks[key] = task
+		keys = append(keys, key)
+	}
+	if svc.scheduler != nil {
+		// Scheduler 会等所有的补偿任务退出之后再返回
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			svc.scheduler.Start(ctx, keys, func(ctx context.Context, key string) {
+				task := tasks[key]
+				task.active.Add(1)
+				defer task.active.Add(-1)
+				task.StartScheduled(ctx)
+			})
+		}()
+	}
+	return nil
+}
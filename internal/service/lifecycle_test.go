@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"errors"
+	dlock "github.com/meoying/local-msg-go/internal/lock"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardingService_Shutdown(t *testing.T) {
+	testCases := []struct {
+		name string
+		// 每一批要执行多久
+		execDuration time.Duration
+		timeout      time.Duration
+
+		wantUnfinished []sharding.Dst
+		// 正在执行的那一批有没有执行完
+		wantFinished bool
+	}{
+		{
+			name:         "等待正在执行的一批",
+			execDuration: time.Millisecond * 200,
+			timeout:      time.Second,
+			wantFinished: true,
+		},
+		{
+			name:           "超时",
+			execDuration:   time.Second * 2,
+			timeout:        time.Millisecond * 200,
+			wantUnfinished: []sharding.Dst{{Table: "local_msgs"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			executor := &blockingExecutor{duration: tc.execDuration, started: make(chan struct{})}
+			lockClient := &fakeLockClient{}
+			svc := NewShardingService(nil, nil, lockClient, sharding.NewNoShard("local_msgs"))
+			svc.executor = executor
+			require.NoError(t, svc.Start(context.Background()))
+			assert.ErrorIs(t, svc.Start(context.Background()), ErrStarted)
+			<-executor.started
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			err := svc.Shutdown(ctx)
+			if tc.wantUnfinished == nil {
+				require.NoError(t, err)
+				// 只执行了一批，并且分布式锁已经释放了
+				assert.Equal(t, int32(1), executor.cnt.Load())
+				assert.Equal(t, int32(1), lockClient.unlocked.Load())
+			} else {
+				var shutdownErr *ShutdownError
+				require.ErrorAs(t, err, &shutdownErr)
+				assert.Equal(t, tc.wantUnfinished, shutdownErr.Unfinished)
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+			}
+			// 被中断的一批也会很快退出，并且释放分布式锁
+			assert.Eventually(t, func() bool {
+				return lockClient.unlocked.Load() == 1
+			}, time.Second, time.Millisecond*10)
+			assert.Equal(t, tc.wantFinished, executor.finished.Load())
+		})
+	}
+}
+
+// 旧的 StartAsyncTask 在 ctx 取消的时候会中断正在执行的一批
+func TestShardingService_StartAsyncTask_Cancel(t *testing.T) {
+	executor := &blockingExecutor{duration: time.Second * 2, started: make(chan struct{})}
+	lockClient := &fakeLockClient{}
+	svc := NewShardingService(nil, nil, lockClient, sharding.NewNoShard("local_msgs"))
+	svc.executor = executor
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, svc.StartAsyncTask(ctx))
+	<-executor.started
+	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second)
+	defer shutdownCancel()
+	require.NoError(t, svc.Shutdown(shutdownCtx))
+	assert.False(t, executor.finished.Load())
+	assert.Equal(t, int32(1), lockClient.unlocked.Load())
+}
+
+// blockingExecutor 每一批都执行 duration
+type blockingExecutor struct {
+	duration time.Duration
+	started  chan struct{}
+	once     sync.Once
+	cnt      atomic.Int32
+	finished atomic.Bool
+}
+
+func (b *blockingExecutor) Exec(ctx context.Context, db *gorm.DB, table string, opts ExecOptions) (int, error) {
+	b.cnt.Add(1)
+	b.once.Do(func() {
+		close(b.started)
+	})
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(b.duration):
+		b.finished.Store(true)
+		return 1, nil
+	}
+}
+
+type fakeLockClient struct {
+	unlocked atomic.Int32
+}
+
+func (f *fakeLockClient) NewLock(ctx context.Context, key string, expiration time.Duration) (dlock.Lock, error) {
+	return &fakeLock{client: f}, nil
+}
+
+type fakeLock struct {
+	client *fakeLockClient
+}
+
+func (f *fakeLock) Lock(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeLock) Unlock(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return errors.New("ctx 已经被取消了")
+	}
+	f.client.unlocked.Add(1)
+	return nil
+}
+
+func (f *fakeLock) Refresh(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeLock) FencingToken() int64 {
+	return 0
+}
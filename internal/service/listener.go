@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"github.com/meoying/local-msg-go/internal/dao"
+	"github.com/meoying/local-msg-go/internal/metrics"
+	"github.com/meoying/local-msg-go/internal/msg"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"log/slog"
+	"time"
+)
+
+// Listener 监听本地消息表的各种事件，例如说发送失败的时候告警，或者发送成功之后更新业务状态
+// 回调是同步执行的，所以不要在里面执行耗时的操作，也不要 panic
+// 只关心部分事件的话，可以组合 NopListener
+type Listener interface {
+	// OnSaved 消息保存成功。
+	// 通过 ExecTx 保存的时候，事务已经提交了；通过 SaveMsg 保存的时候，事务还可能会回滚
+	// 通过 SaveMsg 保存的时候，evt.Dst 是 tx 实际写入的表，tx 不是从 DBs 中开启的时候 evt.Dst.DB 为空
+	OnSaved(ctx context.Context, evt MsgEvent)
+	// OnSent 消息发送成功
+	OnSent(ctx context.Context, evt MsgEvent)
+	// OnSendFailed 消息发送失败，之后补偿任务还会重试，evt.SendTimes 是已经发送的次数
+	OnSendFailed(ctx context.Context, evt MsgEvent)
+	// OnDead 消息发送失败，并且达到了最大发送次数，不会再重试了
+	OnDead(ctx context.Context, evt MsgEvent)
+	// OnLockAcquired 补偿任务拿到了 dst 的分布式锁，开始负责这张表
+	OnLockAcquired(ctx context.Context, dst sharding.Dst)
+	// OnLockLost 补偿任务续约失败，或者发现别的节点已经拿到了分布式锁
+	OnLockLost(ctx context.Context, dst sharding.Dst, err error)
+}
+
+// MsgEvent 消息相关的事件
+type MsgEvent struct {
+	Dst sharding.Dst
+	Id  int64
+	Msg msg.Msg
+	// Path 消息从哪里发送出去的，参考 metrics 包里面 Path 开头的常量。保存消息的时候为空
+	Path string
+	// SendTimes 包括这一次在内，已经发送了多少次
+	SendTimes int
+	Ctime     time.Time
+	// Err 发送失败的原因
+	Err error
+}
+
+func newMsgEvent(dmsg *dao.LocalMsg, m msg.Msg, opts sendOptions) MsgEvent {
+	return MsgEvent{
+		Dst:       opts.dst,
+		Id:        dmsg.Id,
+		Msg:       m,
+		Path:      opts.path,
+		SendTimes: dmsg.SendTimes,
+		Ctime:     time.UnixMilli(dmsg.Ctime),
+	}
+}
+
+// WithListener 注册事件监听者，可以注册多个，按照注册的顺序调用
+func WithListener(l Listener) ShardingServiceOpt {
+	return func(service *ShardingService) {
+		service.listeners = append(service.listeners, l)
+	}
+}
+
+// NopListener 什么也不做，用于组合
+type NopListener struct{}
+
+func (NopListener) OnSaved(ctx context.Context, evt MsgEvent) {}
+
+func (NopListener) OnSent(ctx context.Context, evt MsgEvent) {}
+
+func (NopListener) OnSendFailed(ctx context.Context, evt MsgEvent) {}
+
+func (NopListener) OnDead(ctx context.Context, evt MsgEvent) {}
+
+func (NopListener) OnLockAcquired(ctx context.Context, dst sharding.Dst) {}
+
+func (NopListener) OnLockLost(ctx context.Context, dst sharding.Dst, err error) {}
+
+// listeners 按照顺序调用每一个 Listener
+type listeners []Listener
+
+func (ls listeners) OnSaved(ctx context.Context, evt MsgEvent) {
+	for _, l := range ls {
+		l.OnSaved(ctx, evt)
+	}
+}
+
+func (ls listeners) OnSent(ctx context.Context, evt MsgEvent) {
+	for _, l := range ls {
+		l.OnSent(ctx, evt)
+	}
+}
+
+func (ls listeners) OnSendFailed(ctx context.Context, evt MsgEvent) {
+	for _, l := range ls {
+		l.OnSendFailed(ctx, evt)
+	}
+}
+
+func (ls listeners) OnDead(ctx context.Context, evt MsgEvent) {
+	for _, l := range ls {
+		l.OnDead(ctx, evt)
+	}
+}
+
+func (ls listeners) OnLockAcquired(ctx context.Context, dst sharding.Dst) {
+	for _, l := range ls {
+		l.OnLockAcquired(ctx, dst)
+	}
+}
+
+func (ls listeners) OnLockLost(ctx context.Context, dst sharding.Dst, err error) {
+	for _, l := range ls {
+		l.OnLockLost(ctx, dst, err)
+	}
+}
+
+// logListener 记录发送失败和失去分布式锁的日志
+type logListener struct {
+	NopListener
+	logger *slog.Logger
+}
+
+func (l logListener) OnSendFailed(ctx context.Context, evt MsgEvent) {
+	l.logSendFailed(evt)
+}
+
+func (l logListener) OnDead(ctx context.Context, evt MsgEvent) {
+	l.logSendFailed(evt)
+}
+
+func (l logListener) logSendFailed(evt MsgEvent) {
+	l.logger.Error("发送消息失败",
+		slog.String("topic", evt.Msg.Topic),
+		slog.String("key", evt.Msg.Key),
+		slog.Int("send_times", evt.SendTimes),
+		slog.Any("err", evt.Err),
+	)
+}
+
+func (l logListener) OnLockLost(ctx context.Context, dst sharding.Dst, err error) {
+	l.logger.Error("失去分布式锁，取消任务",
+		slog.String("key", dst.DB+"."+dst.Table),
+		slog.Any("err", err))
+}
+
+// metricsListener 统计每一条消息的发送结果
+type metricsListener struct {
+	NopListener
+	metrics metrics.Metrics
+}
+
+func (m metricsListener) OnSent(ctx context.Context, evt MsgEvent) {
+	m.metrics.ObserveSend(evt.Msg.Topic, evt.Dst.Table, evt.Path, metrics.ResultSuccess, time.Since(evt.Ctime))
+}
+
+func (m metricsListener) OnSendFailed(ctx context.Context, evt MsgEvent) {
+	m.metrics.ObserveSend(evt.Msg.Topic, evt.Dst.Table, evt.Path, metrics.ResultRetryable, 0)
+}
+
+func (m metricsListener) OnDead(ctx context.Context, evt MsgEvent) {
+	m.metrics.ObserveSend(evt.Msg.Topic, evt.Dst.Table, evt.Path, metrics.ResultTerminal, 0)
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"errors"
+	dlock "github.com/meoying/local-msg-go/internal/lock"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardingService_LockEvents(t *testing.T) {
+	listener := &lockListener{lost: make(chan error, 1)}
+	executor := &blockingExecutor{duration: time.Millisecond * 10, started: make(chan struct{})}
+	lockErr := errors.New("续约失败")
+	cfg := DefaultAsyncTaskConfig()
+	cfg.RefreshInterval = time.Millisecond * 10
+	svc := NewShardingService(nil, nil, &lostLockClient{err: lockErr},
+		sharding.NewNoShard("local_msgs"), WithListener(listener), WithAsyncTaskConfig(cfg))
+	svc.executor = executor
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, svc.StartAsyncTask(ctx))
+
+	select {
+	case err := <-listener.lost:
+		assert.Equal(t, lockErr, err)
+	case <-time.After(time.Second):
+		t.Fatal("没有收到失去分布式锁的事件")
+	}
+	cancel()
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	assert.Contains(t, listener.acquired, sharding.Dst{Table: "local_msgs"})
+}
+
+func TestListeners(t *testing.T) {
+	var calls []string
+	ls := listeners{
+		&funcListener{onSent: func(evt MsgEvent) { calls = append(calls, "first") }},
+		NopListener{},
+		&funcListener{onSent: func(evt MsgEvent) { calls = append(calls, "second") }},
+	}
+	ls.OnSent(context.Background(), MsgEvent{})
+	ls.OnDead(context.Background(), MsgEvent{})
+	// 按照注册的顺序调用
+	assert.Equal(t, []string{"first", "second"}, calls)
+}
+
+type funcListener struct {
+	NopListener
+	onSent func(evt MsgEvent)
+}
+
+func (f *funcListener) OnSent(ctx context.Context, evt MsgEvent) {
+	f.onSent(evt)
+}
+
+type lockListener struct {
+	NopListener
+	mu       sync.Mutex
+	acquired []sharding.Dst
+	lost     chan error
+}
+
+func (l *lockListener) OnLockAcquired(ctx context.Context, dst sharding.Dst) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.acquired = append(l.acquired, dst)
+}
+
+func (l *lockListener) OnLockLost(ctx context.Context, dst sharding.Dst, err error) {
+	select {
+	case l.lost <- err:
+	default:
+	}
+}
+
+// lostLockClient 拿到的锁马上就会续约失败
+type lostLockClient struct {
+	fakeLockClient
+	err error
+}
+
+func (l *lostLockClient) NewLock(ctx context.Context, key string, expiration time.Duration) (dlock.Lock, error) {
+	return &lostLock{fakeLock: fakeLock{client: &l.fakeLockClient}, err: l.err}, nil
+}
+
+type lostLock struct {
+	fakeLock
+	err error
+}
+
+func (l *lostLock) Refresh(ctx context.Context) error {
+	return l.err
+}
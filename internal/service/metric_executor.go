@@ -2,36 +2,28 @@ package service
 
 import (
 	"context"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/meoying/local-msg-go/internal/metrics"
 	"gorm.io/gorm"
-	"strconv"
 	"time"
 )
 
+// MetricExecutor 统计补偿任务每一批的执行时间
 type MetricExecutor struct {
-	executor         Executor
-	TaskExecDuration *prometheus.HistogramVec
+	executor Executor
+	metrics  metrics.Metrics
 }
 
-func NewMetricExecutor(executor Executor) *MetricExecutor {
+func NewMetricExecutor(executor Executor, m metrics.Metrics) *MetricExecutor {
 	return &MetricExecutor{
 		executor: executor,
-		TaskExecDuration: promauto.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "local_msg_async_task_exec_duration_seconds",
-				Help:    "补偿任务执行时间",
-				Buckets: prometheus.DefBuckets,
-			},
-			[]string{"table", "success"}, // 标签:表名
-		),
+		metrics:  m,
 	}
 }
 
-func (m *MetricExecutor) Exec(ctx context.Context, db *gorm.DB, table string) (int, error) {
+func (m *MetricExecutor) Exec(ctx context.Context, db *gorm.DB, table string, opts ExecOptions) (int, error) {
 	start := time.Now()
-	cnt, err := m.executor.Exec(ctx, db, table)
+	cnt, err := m.executor.Exec(ctx, db, table, opts)
 	// 记录执行时间
-	m.TaskExecDuration.WithLabelValues(table, strconv.FormatBool(err == nil)).Observe(time.Since(start).Seconds())
+	m.metrics.ObserveTaskExec(table, err == nil, time.Since(start))
 	return cnt, err
 }
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+	"slices"
+)
+
+// SendLimitConfig 补偿任务发送消息的限制，同一个 ShardingService 的所有补偿任务共享
+// 在消息队列故障恢复之后，大量积压的消息会同时重试，用它来保护消息队列和数据库
+type SendLimitConfig struct {
+	// MaxInFlight 同时最多有多少条消息在发送，0 表示不限制
+	MaxInFlight int
+	// Rate 每秒最多发送多少条消息，0 表示不限制
+	Rate float64
+	// Burst 允许的突发数量，0 的时候和 Rate 一致（至少为 1）
+	Burst int
+}
+
+// Validate 校验参数是否合法
+func (c SendLimitConfig) Validate() error {
+	if c.MaxInFlight < 0 {
+		return fmt.Errorf("MaxInFlight 不能小于 0，当前值 %d", c.MaxInFlight)
+	}
+	if c.Rate < 0 {
+		return fmt.Errorf("Rate 不能小于 0，当前值 %v", c.Rate)
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("Burst 不能小于 0，当前值 %d", c.Burst)
+	}
+	return nil
+}
+
+// limiter 同时限制并发数和速率，零值不做任何限制
+type limiter struct {
+	sem  *semaphore.Weighted
+	size int64
+	rl   *rate.Limiter
+}
+
+func newLimiter(cfg SendLimitConfig) *limiter {
+	l := &limiter{}
+	if cfg.MaxInFlight > 0 {
+		l.size = int64(cfg.MaxInFlight)
+		l.sem = semaphore.NewWeighted(l.size)
+	}
+	if cfg.Rate > 0 {
+		burst := cfg.Burst
+		if burst == 0 {
+			burst = max(int(cfg.Rate), 1)
+		}
+		l.rl = rate.NewLimiter(rate.Limit(cfg.Rate), burst)
+	}
+	return l
+}
+
+// acquire 申请发送 n 条消息，返回的 release 必须在发送完成之后调用
+// ctx 被取消，或者截止时间之前拿不到名额的时候，返回的 error 是 context.Canceled 或者 context.DeadlineExceeded
+func (l *limiter) acquire(ctx context.Context, n int) (func(), error) {
+	release := func() {}
+	if l.sem != nil {
+		// 一次申请的数量超过了上限的话，就只占满上限，否则会永远阻塞
+		w := min(int64(n), l.size)
+		if err := l.sem.Acquire(ctx, w); err != nil {
+			return nil, err
+		}
+		release = func() { l.sem.Release(w) }
+	}
+	if l.rl != nil {
+		// WaitN 不允许超过 burst，所以分几次等
+		for left := n; left > 0; {
+			cur := min(left, l.rl.Burst())
+			if err := l.rl.WaitN(ctx, cur); err != nil {
+				release()
+				if ctx.Err() == nil {
+					// 截止时间之前等不到的话，WaitN 会立刻返回，而不是等到截止时间
+					err = fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+				}
+				return nil, err
+			}
+			left -= cur
+		}
+	}
+	return release, nil
+}
+
+// sendLimiter 全局的限制，加上可选的按照 topic 的限制
+type sendLimiter struct {
+	global *limiter
+	topics map[string]*limiter
+}
+
+func newSendLimiter(global *SendLimitConfig, topics map[string]SendLimitConfig) (*sendLimiter, error) {
+	if global == nil && len(topics) == 0 {
+		return nil, nil
+	}
+	res := &sendLimiter{topics: make(map[string]*limiter, len(topics))}
+	if global != nil {
+		if err := global.Validate(); err != nil {
+			return nil, fmt.Errorf("发送限制参数不合法: %w", err)
+		}
+		res.global = newLimiter(*global)
+	}
+	for topic, cfg := range topics {
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("发送限制参数不合法 topic %s: %w", topic, err)
+		}
+		res.topics[topic] = newLimiter(cfg)
+	}
+	return res, nil
+}
+
+// acquire 申请向 topic 发送 n 条消息
+// sendLimiter 为 nil 的时候不做任何限制
+func (s *sendLimiter) acquire(ctx context.Context, topic string, n int) (func(), error) {
+	return s.acquireBatch(ctx, map[string]int{topic: n})
+}
+
+// acquireBatch 一次申请向多个 topic 发送消息的名额，cnts 是每个 topic 的消息数量
+// 先按照 topic 的字典序申请 topic 的，再一次性申请全局的，
+// 这样所有人申请的顺序都是一致的，两批消息不会各自占着一个 topic 等对方的 topic，
+// 也不会占着全局的名额等某个 topic
+// sendLimiter 为 nil 的时候不做任何限制
+func (s *sendLimiter) acquireBatch(ctx context.Context, cnts map[string]int) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	releases := make([]func(), 0, len(cnts)+1)
+	releaseAll := func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+	total := 0
+	topics := make([]string, 0, len(cnts))
+	for topic, cnt := range cnts {
+		topics = append(topics, topic)
+		total += cnt
+	}
+	slices.Sort(topics)
+	for _, topic := range topics {
+		l, ok := s.topics[topic]
+		if !ok {
+			continue
+		}
+		release, err := l.acquire(ctx, cnts[topic])
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	if s.global != nil {
+		release, err := s.global.acquire(ctx, total)
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	return releaseAll, nil
+}
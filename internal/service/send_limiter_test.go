@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSendLimiter_MaxInFlight(t *testing.T) {
+	l, err := newSendLimiter(&SendLimitConfig{MaxInFlight: 3},
+		map[string]SendLimitConfig{"slow_topic": {MaxInFlight: 1}})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name  string
+		topic string
+		want  int64
+	}{
+		{name: "全局限制", topic: "normal_topic", want: 3},
+		{name: "topic 限制", topic: "slow_topic", want: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var cur, peak atomic.Int64
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				release, err := l.acquire(context.Background(), tc.topic, 1)
+				require.NoError(t, err)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer release()
+					n := cur.Add(1)
+					for {
+						old := peak.Load()
+						if n <= old || peak.CompareAndSwap(old, n) {
+							break
+						}
+					}
+					time.Sleep(time.Millisecond * 10)
+					cur.Add(-1)
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, tc.want, peak.Load())
+		})
+	}
+}
+
+func TestSendLimiter_Rate(t *testing.T) {
+	l, err := newSendLimiter(&SendLimitConfig{Rate: 100, Burst: 10}, nil)
+	require.NoError(t, err)
+	start := time.Now()
+	// 一开始可以突发 10 条，剩下的 20 条至少要 200ms
+	for i := 0; i < 3; i++ {
+		release, err := l.acquire(context.Background(), "topic", 10)
+		require.NoError(t, err)
+		release()
+	}
+	assert.True(t, time.Since(start) >= time.Millisecond*180, time.Since(start))
+
+	// 截止时间之前等不到的时候立刻返回，并且可以当作超时处理
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err = l.acquire(ctx, "topic", 10)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NoError(t, ctx.Err())
+}
+
+func TestSendLimiter_Acquire(t *testing.T) {
+	l, err := newSendLimiter(&SendLimitConfig{MaxInFlight: 2},
+		map[string]SendLimitConfig{"topic": {MaxInFlight: 5}})
+	require.NoError(t, err)
+
+	// 一次申请超过上限的时候，不会永远阻塞
+	release, err := l.acquire(context.Background(), "topic", 10)
+	require.NoError(t, err)
+
+	// 全局名额被占满了，超时之后 topic 的名额要还回去
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err = l.acquire(ctx, "topic", 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	release()
+	release, err = l.acquire(context.Background(), "topic", 2)
+	require.NoError(t, err)
+	release()
+
+	// 没有任何限制
+	var nilLimiter *sendLimiter
+	release, err = nilLimiter.acquire(context.Background(), "topic", 100)
+	require.NoError(t, err)
+	release()
+}
+
+func TestSendLimiter_AcquireBatch(t *testing.T) {
+	l, err := newSendLimiter(&SendLimitConfig{MaxInFlight: 10},
+		map[string]SendLimitConfig{"topic_a": {MaxInFlight: 1}, "topic_b": {MaxInFlight: 1}})
+	require.NoError(t, err)
+
+	// 两批消息都包含 topic_a 和 topic_b，不会各自占着一个 topic 等对方
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				release, err := l.acquireBatch(ctx, map[string]int{"topic_a": 1, "topic_b": 2})
+				if !assert.NoError(t, err) {
+					return
+				}
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 全局的名额一次性按照整批的数量申请
+	release, err := l.acquireBatch(context.Background(), map[string]int{"topic_a": 1, "topic_c": 9})
+	require.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err = l.acquire(timeoutCtx, "topic_b", 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	release()
+}
+
+func TestShardingService_StartAsyncTask_SendLimit(t *testing.T) {
+	svc := NewShardingService(nil, nil, nil, sharding.Sharding{
+		EffectiveTablesFunc: func() []sharding.Dst {
+			return []sharding.Dst{{DB: "db", Table: "local_msgs"}}
+		},
+	}, WithSendLimit(SendLimitConfig{Rate: 100}),
+		WithTopicSendLimit("topic", SendLimitConfig{MaxInFlight: -1}))
+	err := svc.StartAsyncTask(context.Background())
+	assert.EqualError(t, err, "发送限制参数不合法 topic topic: MaxInFlight 不能小于 0，当前值 -1")
+}
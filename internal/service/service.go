@@ -14,6 +14,6 @@ type Service struct {
 
 func (svc *Service) ExecTx(ctx context.Context,
 	biz func(tx *gorm.DB) (msg.Msg, error)) error {
-	db := svc.DBs[""]
-	return svc.execTx(ctx, db, biz, "")
+	// 不分库分表的时候，ShardingFunc 不关心参数
+	return svc.execTx(ctx, svc.Sharding.ShardingFunc(nil), biz)
 }
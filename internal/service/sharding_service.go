@@ -8,7 +8,9 @@ import (
 	"github.com/ecodeclub/ekit/slice"
 	"github.com/meoying/local-msg-go/internal/dao"
 	dlock "github.com/meoying/local-msg-go/internal/lock"
+	"github.com/meoying/local-msg-go/internal/metrics"
 	"github.com/meoying/local-msg-go/internal/msg"
+	"github.com/meoying/local-msg-go/internal/schedule"
 	"github.com/meoying/local-msg-go/internal/sharding"
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
@@ -16,7 +18,8 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 	"log/slog"
-	"strings"
+	"slices"
+	"sync"
 	"time"
 )
 
@@ -39,11 +42,48 @@ type ShardingService struct {
 	BatchSize int
 
 	LockClient dlock.Client
+	// 补偿任务的时间参数，tableTaskCfgs 是针对某张表的
+	taskCfg       AsyncTaskConfig
+	tableTaskCfgs map[sharding.Dst]AsyncTaskConfig
+	// 正在运行的补偿任务，业务发送消息失败的时候用来唤醒对应的补偿任务
+	tasks sync.Map
+	// scheduler 不为 nil 的时候，补偿任务不再抢分布式锁，而是由它来分配
+	scheduler *schedule.Scheduler
+	// 补偿任务发送消息的限制，在 StartAsyncTask 的时候创建
+	sendLimit       *SendLimitConfig
+	topicSendLimits map[string]SendLimitConfig
+	limiter         *sendLimiter
+	// metrics 上报指标，没有开启任何指标的时候是 metrics.Nop
+	metrics metrics.Metrics
+	// execMetrics 统计补偿任务每一批的执行时间
+	execMetrics bool
+	// sendMetrics 统计每一条消息的发送结果
+	sendMetrics bool
+	// 不为 nil 的时候，补偿任务会定时统计积压情况
+	backlog *backlogSampler
+	// listeners 通过 WithListener 注册的，加上内置的日志和指标
+	listeners listeners
+	// notifySaved 内置的 listener 不关心 OnSaved，没有用户注册的 listener 的时候，SaveMsg 不需要构造事件
+	notifySaved bool
+	// 补偿任务的生命周期，参考 Start 和 Shutdown
+	lifecycle lifecycle
+	// fencing 为 true 的时候，补偿任务更新消息状态的时候会带上分布式锁的 fencing token
+	fencing bool
+	// retriedBy 为 true 的时候，手动重试会把操作人记录在 retried_by 列上
+	retriedBy bool
 
 	Logger *slog.Logger
 	tracer trace.Tracer
 }
 
+// ErrFenced 更新消息状态的时候发现消息已经被持有更大的 fencing token 的节点处理过了
+// 也就是说当前节点已经失去了分布式锁，只是自己还不知道
+var ErrFenced = errors.New("消息已经被新的分布式锁持有者处理过")
+
+// ErrMigrating 更新消息状态的时候发现消息已经被 Resharder 抢占，正在或者已经迁移到新的表
+// 此时消息已经发送出去了，新表中的那一条还会再发送一次
+var ErrMigrating = errors.New("消息正在被迁移到新的分库分表")
+
 func NewShardingService(
 	dbs map[string]*gorm.DB,
 	producer sarama.SyncProducer,
@@ -58,6 +98,7 @@ func NewShardingService(
 		BatchSize:    10,
 		Logger:       slog.Default(),
 		LockClient:   lockClient,
+		taskCfg:      DefaultAsyncTaskConfig(),
 		tracer:       otel.Tracer("localmsg"),
 	}
 	// 默认为并发发送
@@ -65,6 +106,8 @@ func NewShardingService(
 	for _, opt := range opts {
 		opt(svc)
 	}
+	svc.initMetrics()
+	svc.initListeners()
 	return svc
 }
 
@@ -74,55 +117,170 @@ func WithBatchExecutor() ShardingServiceOpt {
 	}
 }
 
+// WithMetricExecutor 统计补偿任务每一批的执行时间
+// 没有使用 WithMetrics 的时候，注册在 prometheus.DefaultRegisterer 上
 func WithMetricExecutor() ShardingServiceOpt {
 	return func(service *ShardingService) {
-		service.executor = NewMetricExecutor(service.executor)
+		service.execMetrics = true
 	}
 }
 
-type ShardingServiceOpt func(service *ShardingService)
+// WithSendMetrics 按照 topic、表和发送路径统计发送结果，
+// 以及消息从创建到发送成功的时间
+// 没有使用 WithMetrics 的时候，注册在 prometheus.DefaultRegisterer 上
+func WithSendMetrics() ShardingServiceOpt {
+	return func(service *ShardingService) {
+		service.sendMetrics = true
+	}
+}
+
+// WithMetrics 指定上报指标的实现，例如 metrics.NewPrometheus 或者 metrics.NewOTel
+// 同时开启补偿任务执行时间和发送结果的指标。积压情况需要定时统计，依旧需要 WithBacklogMetrics
+func WithMetrics(m metrics.Metrics) ShardingServiceOpt {
+	return func(service *ShardingService) {
+		service.metrics = m
+		service.execMetrics = true
+		service.sendMetrics = true
+	}
+}
+
+// WithFencing 补偿任务在更新消息状态的时候带上分布式锁的 fencing token，
+// 这样已经失去分布式锁的节点就没办法再修改消息的状态了。
+// 本地消息表需要额外的 fencing_token 列，参考 .scripts/mysql/init.sql
+// 注意分布式锁的实现必须支持 fencing token，否则这个选项没有任何效果
+func WithFencing() ShardingServiceOpt {
+	return func(service *ShardingService) {
+		service.fencing = true
+	}
+}
+
+// WithRetriedBy 手动重试的时候把操作人记录在消息的 retried_by 列上。
+// 本地消息表需要额外的 retried_by 列，参考 .scripts/mysql/init.sql，
+// 没有这一列的时候不要使用这个选项，否则消息发送之后更新状态会失败
+func WithRetriedBy() ShardingServiceOpt {
+	return func(service *ShardingService) {
+		service.retriedBy = true
+	}
+}
+
+// WithPartitionScheduler 补偿任务不再通过分布式锁来抢占表，
+// 而是由 scheduler 通过一致性哈希把表分配给存活的节点，这样每个节点负责的表是均匀的
+// 此时 LockClient 不会被使用
+func WithPartitionScheduler(scheduler *schedule.Scheduler) ShardingServiceOpt {
+	return func(service *ShardingService) {
+		service.scheduler = scheduler
+	}
+}
+
+// WithAsyncTaskConfig 修改所有补偿任务的时间参数，在 StartAsyncTask 的时候校验
+func WithAsyncTaskConfig(cfg AsyncTaskConfig) ShardingServiceOpt {
+	return func(service *ShardingService) {
+		service.taskCfg = cfg
+	}
+}
 
-func (svc *ShardingService) StartAsyncTask(ctx context.Context) {
-	for _, dst := range svc.Sharding.EffectiveTablesFunc() {
-		task := AsyncTask{
-			waitDuration: svc.WaitDuration,
-			executor:     svc.executor,
-			db:           svc.DBs[dst.DB],
-			dst:          dst,
-			batchSize:    svc.BatchSize,
-			logger:       svc.Logger,
-			lockClient:   svc.LockClient,
+// WithTableAsyncTaskConfig 修改某张表的补偿任务的时间参数，比如说热点表需要更快的节奏
+// 没有指定的表使用 WithAsyncTaskConfig 的参数
+func WithTableAsyncTaskConfig(dst sharding.Dst, cfg AsyncTaskConfig) ShardingServiceOpt {
+	return func(service *ShardingService) {
+		if service.tableTaskCfgs == nil {
+			service.tableTaskCfgs = make(map[sharding.Dst]AsyncTaskConfig)
 		}
-		go func() {
-			task.Start(ctx)
-		}()
+		service.tableTaskCfgs[dst] = cfg
 	}
 }
 
+// WithSendLimit 限制所有补偿任务加起来的发送并发数和速率，
+// 避免消息队列故障恢复之后，大量积压的消息同时重试压垮消息队列和数据库
+// 业务自己发送消息的时候不受限制
+func WithSendLimit(cfg SendLimitConfig) ShardingServiceOpt {
+	return func(service *ShardingService) {
+		service.sendLimit = &cfg
+	}
+}
+
+// WithTopicSendLimit 限制补偿任务向某个 topic 发送消息的并发数和速率
+// 同时也受 WithSendLimit 的限制
+func WithTopicSendLimit(topic string, cfg SendLimitConfig) ShardingServiceOpt {
+	return func(service *ShardingService) {
+		if service.topicSendLimits == nil {
+			service.topicSendLimits = make(map[string]SendLimitConfig)
+		}
+		service.topicSendLimits[topic] = cfg
+	}
+}
+
+type ShardingServiceOpt func(service *ShardingService)
+
+// StartAsyncTask 开启补偿任务，参数不合法的时候返回 error，并且不会开启任何补偿任务
+// ctx 被取消的时候，正在发送的消息也会被中断。如果需要优雅退出，使用 Start 和 Shutdown
+func (svc *ShardingService) StartAsyncTask(ctx context.Context) error {
+	return svc.start(ctx, false)
+}
+
 // SendMsg 发送消息
 func (svc *ShardingService) SendMsg(ctx context.Context, db, table string, msg msg.Msg) error {
 	dmsg := svc.newDmsg(msg)
-	return svc.sendMsg(ctx, svc.DBs[db], dmsg, table)
+	return svc.sendMsg(ctx, svc.DBs[db], dmsg, sendOptions{
+		dst:  sharding.Dst{DB: db, Table: table},
+		path: metrics.PathManual,
+	})
+}
+
+// Resend 重新发送已经保存的消息，并且更新这条消息的发送次数和状态
+// 发送失败并且达到最大发送次数的时候，消息依旧是发送失败的状态
+// 使用了 WithRetriedBy 并且 operator 不为空的时候，会记录到 retried_by 列上
+func (svc *ShardingService) Resend(ctx context.Context, db, table string, dmsg *dao.LocalMsg, operator string) error {
+	so := sendOptions{
+		dst:  sharding.Dst{DB: db, Table: table},
+		path: metrics.PathManual,
+	}
+	if svc.retriedBy && operator != "" {
+		so.extra = map[string]any{"retried_by": operator}
+	}
+	return svc.sendMsg(ctx, svc.DBs[db], dmsg, so)
 }
 
 // SaveMsg 手动保存接口, tx 必须是你的本地事务
 func (svc *ShardingService) SaveMsg(tx *gorm.DB, shardingInfo any, msg msg.Msg) error {
+	injectTrace(tx.Statement.Context, &msg)
 	dmsg := svc.newDmsg(msg)
-	return tx.Create(&dmsg).Error
+	res := tx.Create(&dmsg)
+	if res.Error == nil && svc.notifySaved {
+		// 使用实际写入的表，而不是再执行一次分库分表，两者可能不一样
+		dst := sharding.Dst{DB: svc.dbName(tx), Table: res.Statement.Table}
+		svc.listeners.OnSaved(tx.Statement.Context, newMsgEvent(dmsg, msg, sendOptions{dst: dst}))
+	}
+	return res.Error
+}
+
+// dbName 找到 tx 是从 DBs 中的哪个数据库开启的，找不到的时候返回空字符串
+// 开启事务的时候 gorm 会复制 Config，所以只能比较底层的连接池
+func (svc *ShardingService) dbName(tx *gorm.DB) string {
+	for name, db := range svc.DBs {
+		if db.Config.ConnPool == tx.Config.ConnPool {
+			return name
+		}
+	}
+	return ""
 }
 
 func (svc *ShardingService) execTx(ctx context.Context,
-	db *gorm.DB,
+	dst sharding.Dst,
 	biz func(tx *gorm.DB) (msg.Msg, error),
-	table string,
 ) error {
+	db := svc.DBs[dst.DB]
+	table := dst.Table
 	ctx, businessSpan := svc.tracer.Start(ctx, "localMsg-span")
 	defer businessSpan.End() // 假设 BizLogic 是进行业务逻辑执行的函数
 	var dmsg *dao.LocalMsg
+	var m msg.Msg
 	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		_, bizSpan := svc.tracer.Start(ctx, "biz-transaction")
 		defer bizSpan.End()
-		m, err := biz(tx)
+		var err error
+		m, err = biz(tx)
+		injectTrace(ctx, &m)
 		dmsg = svc.newDmsg(m)
 		// 通过 key 可以将业务和这里可观测性数据关联在一起
 		bizSpan.SetAttributes(attribute.String("key", dmsg.Key))
@@ -133,9 +291,12 @@ func (svc *ShardingService) execTx(ctx context.Context,
 	})
 
 	if err == nil {
-		err1 := svc.sendMsg(ctx, db, dmsg, table)
+		svc.listeners.OnSaved(ctx, newMsgEvent(dmsg, m, sendOptions{dst: dst}))
+		err1 := svc.sendMsg(ctx, db, dmsg, sendOptions{dst: dst, path: metrics.PathImmediate})
 		if err1 != nil {
 			slog.Error("发送消息出现问题", slog.Any("error", err1))
+			// 让补偿任务在这条消息可以补偿的时候立刻处理
+			svc.wake(dst)
 		}
 	}
 	return err
@@ -149,19 +310,59 @@ func (svc *ShardingService) ExecTx(ctx context.Context,
 	shardingInfo any,
 	biz func(tx *gorm.DB) (msg.Msg, error)) error {
 	dst := svc.Sharding.ShardingFunc(shardingInfo)
-	db := svc.DBs[dst.DB]
-	return svc.execTx(ctx, db, biz, dst.Table)
+	return svc.execTx(ctx, dst, biz)
+}
+
+// wake 唤醒 dst 对应的补偿任务。如果补偿任务不在当前节点上运行，那么什么也不会发生
+func (svc *ShardingService) wake(dst sharding.Dst) {
+	if task, ok := svc.tasks.Load(dst); ok {
+		task.(*AsyncTask).wake()
+	}
+}
+
+// batchSize 每一批的大小，补偿任务会根据积压情况调整
+func (svc *ShardingService) batchSize(opts ExecOptions) int {
+	if opts.BatchSize > 0 {
+		return opts.BatchSize
+	}
+	return svc.BatchSize
 }
 
+// sendOptions 发送消息的时候需要的额外信息
+type sendOptions struct {
+	// dst 消息所在的表
+	dst sharding.Dst
+	// token 是补偿任务持有的分布式锁的 fencing token，不是补偿任务的时候为 0
+	token int64
+	// path 是消息从哪里发送出去的，用于统计
+	path string
+	// extra 和发送结果一起更新到消息上的字段
+	extra map[string]any
+}
+
+// sendMsg 发送消息并且更新消息状态
 func (svc *ShardingService) sendMsg(ctx context.Context,
-	db *gorm.DB, dmsg *dao.LocalMsg, table string) error {
-	ctx, sendSpan := svc.tracer.Start(ctx, "localmsg-sending")
-	defer sendSpan.End()
-	sendSpan.SetAttributes(attribute.String("key", dmsg.Key))
+	db *gorm.DB, dmsg *dao.LocalMsg, so sendOptions) (err error) {
+	table, token, path := so.dst.Table, so.token, so.path
 	var msg msg.Msg
-	err := json.Unmarshal(dmsg.Data, &msg)
-	if err != nil {
-		return fmt.Errorf("提取消息内容失败 %w", err)
+	unmarshalErr := json.Unmarshal(dmsg.Data, &msg)
+	// 补偿的时候关联到保存消息时候的链路，立刻发送的时候本来就在同一条链路上
+	opts := []trace.SpanStartOption{trace.WithAttributes(
+		attribute.String("key", dmsg.Key),
+		attribute.String("table", table),
+		attribute.String("topic", msg.Topic),
+		attribute.String("path", path),
+		attribute.Int("send_times", dmsg.SendTimes),
+	)}
+	if link, ok := traceLink(msg); ok && path != metrics.PathImmediate {
+		opts = append(opts, trace.WithLinks(link))
+	}
+	ctx, sendSpan := svc.tracer.Start(ctx, "localmsg-sending", opts...)
+	defer func() {
+		endSpan(sendSpan, err)
+	}()
+	if unmarshalErr != nil {
+		return fmt.Errorf("提取消息内容失败 %w", unmarshalErr)
 	}
 	// 发送消息
 	_, _, err = svc.Producer.SendMessage(newSaramaProducerMsg(msg))
@@ -172,33 +373,50 @@ func (svc *ShardingService) sendMsg(ctx context.Context,
 		"status":     dao.MsgStatusInit,
 	}
 	if err != nil {
-		svc.Logger.Error("发送消息失败",
-			slog.String("topic", msg.Topic),
-			slog.String("key", msg.Key),
-			slog.Int("send_times", times),
-		)
 		if times >= svc.MaxTimes {
 			fields["status"] = dao.MsgStatusFail
 		}
 	} else {
 		fields["status"] = dao.MsgStatusSuccess
 	}
+	for k, v := range so.extra {
+		fields[k] = v
+	}
+	// Updates 会把新的字段写回 dmsg，通知的时候要用发送之前的
+	sent := *dmsg
 
-	err1 := db.WithContext(ctx).Model(dmsg).Table(table).
-		Where("id=?", dmsg.Id).
-		Updates(fields).Error
-	if err1 != nil {
+	updateCtx, updateSpan := svc.tracer.Start(ctx, "localmsg-update", trace.WithAttributes(
+		attribute.String("table", table),
+		attribute.Int("status", int(fields["status"].(int8))),
+	))
+	res := svc.fence(db.WithContext(updateCtx).Model(dmsg).Table(table).
+		Where("id=? AND status NOT IN ?", dmsg.Id, migratingStatuses), fields, token).
+		Updates(fields)
+	if res.Error != nil {
+		endSpan(updateSpan, res.Error)
 		return fmt.Errorf("发送消息但是更新消息失败 %w, 发送结果 %w, topic %s, key %s",
-			err1, err, msg.Topic, msg.Key)
+			res.Error, err, msg.Topic, msg.Key)
+	}
+	if res.RowsAffected == 0 {
+		updateErr := svc.checkUpdated(updateCtx, db, table, []int64{dmsg.Id}, 0, token)
+		if updateErr != nil {
+			endSpan(updateSpan, updateErr)
+			return fmt.Errorf("%w, 发送结果 %w, topic %s, key %s", updateErr, err, msg.Topic, msg.Key)
+		}
 	}
+	updateSpan.End()
+	// 状态更新成功之后才通知，否则消息之后还会被发送，通知的结果也就不准确了
+	svc.notifySend(ctx, &sent, msg, so, err)
 	return err
 }
 
 func (svc *ShardingService) sendMsgs(ctx context.Context,
-	db *gorm.DB, dmsgs []*dao.LocalMsg, table string) error {
+	db *gorm.DB, dmsgs []*dao.LocalMsg, so sendOptions) (err error) {
+	table, token, path := so.dst.Table, so.token, so.path
 	msgs := make([]msg.Msg, 0, len(dmsgs))
 	// 这个方法的前提是发送到同一个topic
 	var topic string
+	links := make([]trace.Link, 0, len(dmsgs))
 	for _, dmsg := range dmsgs {
 		var msg msg.Msg
 		err := json.Unmarshal(dmsg.Data, &msg)
@@ -207,11 +425,24 @@ func (svc *ShardingService) sendMsgs(ctx context.Context,
 		}
 		topic = msg.Topic
 		msgs = append(msgs, msg)
+		if link, ok := traceLink(msg); ok {
+			links = append(links, link)
+		}
 	}
+	ctx, sendSpan := svc.tracer.Start(ctx, "localmsg-sending-batch", trace.WithAttributes(
+		attribute.String("table", table),
+		attribute.String("topic", topic),
+		attribute.String("path", path),
+		attribute.Int("batch_size", len(dmsgs)),
+	), trace.WithLinks(links...))
+	defer func() {
+		endSpan(sendSpan, err)
+	}()
 	// 发送消息
-	err := svc.Producer.SendMessages(slice.Map(msgs, func(idx int, src msg.Msg) *sarama.ProducerMessage {
+	sendErr := svc.Producer.SendMessages(slice.Map(msgs, func(idx int, src msg.Msg) *sarama.ProducerMessage {
 		return newSaramaProducerMsg(src)
 	}))
+	err = sendErr
 
 	failMsgs := make([]*dao.LocalMsg, 0)
 	initMsgs := make([]*dao.LocalMsg, 0)
@@ -246,37 +477,81 @@ func (svc *ShardingService) sendMsgs(ctx context.Context,
 		successMsgs = dmsgs
 	}
 	if len(successMsgs) > 0 {
-		err = svc.updateMsgs(ctx, db, successMsgs, successFields, topic, table)
+		err = svc.updateMsgs(ctx, db, successMsgs, successFields, topic, table, token)
 		if err != nil {
 			return err
 		}
+		svc.notifySends(ctx, dmsgs, msgs, successMsgs, so, nil)
 	}
 	if len(failMsgs) > 0 {
-
-		// TODO 用一个独立的 counter 来记录出现了补偿任务补发最终失败的情况
-
-		svc.Logger.Error("发送消息失败",
-			slog.String("topic", topic),
-			slog.String("keys", svc.getKeyStr(successMsgs)),
-		)
-		err = svc.updateMsgs(ctx, db, failMsgs, failFields, topic, table)
+		err = svc.updateMsgs(ctx, db, failMsgs, failFields, topic, table, token)
 		if err != nil {
 			return err
 		}
+		svc.notifySends(ctx, dmsgs, msgs, failMsgs, so, sendErr)
 	}
 	if len(initMsgs) > 0 {
-		svc.Logger.Error("发送消息失败",
-			slog.String("topic", topic),
-			slog.String("keys", svc.getKeyStr(successMsgs)),
-		)
-		err = svc.updateMsgs(ctx, db, initMsgs, initFields, topic, table)
+		err = svc.updateMsgs(ctx, db, initMsgs, initFields, topic, table, token)
 		if err != nil {
 			return err
 		}
+		svc.notifySends(ctx, dmsgs, msgs, initMsgs, so, sendErr)
 	}
 	return nil
 }
 
+// notifySend 根据发送结果通知 listeners，dmsg 是发送之前的状态
+// notifySends 通知 updated 中的消息的发送结果，msgs 是 dmsgs 对应的消息内容。
+// 和 sendMsg 一样，只有状态更新成功之后才通知
+func (svc *ShardingService) notifySends(ctx context.Context, dmsgs []*dao.LocalMsg, msgs []msg.Msg,
+	updated []*dao.LocalMsg, so sendOptions, err error) {
+	for i, dmsg := range dmsgs {
+		if slices.Contains(updated, dmsg) {
+			svc.notifySend(ctx, dmsg, msgs[i], so, err)
+		}
+	}
+}
+
+func (svc *ShardingService) notifySend(ctx context.Context, dmsg *dao.LocalMsg, m msg.Msg, so sendOptions, err error) {
+	evt := newMsgEvent(dmsg, m, so)
+	evt.SendTimes = dmsg.SendTimes + 1
+	evt.Err = err
+	switch {
+	case err == nil:
+		svc.listeners.OnSent(ctx, evt)
+	case evt.SendTimes >= svc.MaxTimes:
+		svc.listeners.OnDead(ctx, evt)
+	default:
+		svc.listeners.OnSendFailed(ctx, evt)
+	}
+}
+
+// initListeners 内置的日志和指标排在用户注册的 listener 前面
+func (svc *ShardingService) initListeners() {
+	svc.notifySaved = len(svc.listeners) > 0
+	builtin := listeners{logListener{logger: svc.Logger}}
+	if svc.sendMetrics {
+		builtin = append(builtin, metricsListener{metrics: svc.metrics})
+	}
+	svc.listeners = append(builtin, svc.listeners...)
+}
+
+// initMetrics 所有的选项都生效之后，确定上报指标的实现
+func (svc *ShardingService) initMetrics() {
+	if svc.metrics == nil {
+		svc.metrics = metrics.Nop{}
+		if svc.execMetrics || svc.sendMetrics || svc.backlog != nil {
+			svc.metrics = metrics.DefaultPrometheus()
+		}
+	}
+	if svc.backlog != nil {
+		svc.backlog.metrics = svc.metrics
+	}
+	if svc.execMetrics {
+		svc.executor = NewMetricExecutor(svc.executor, svc.metrics)
+	}
+}
+
 // 部分失败获取消息
 func (svc *ShardingService) getPartitionMsgs(dmsgs []*dao.LocalMsg, errMsgs sarama.ProducerErrors) ([]*dao.LocalMsg, []*dao.LocalMsg, []*dao.LocalMsg, error) {
 	failMsgs := make([]*dao.LocalMsg, 0, len(errMsgs))
@@ -319,17 +594,71 @@ func (svc *ShardingService) getFailMsgs(dmsgs []*dao.LocalMsg) ([]*dao.LocalMsg,
 	return failMsgs, initMsgs
 }
 
-func (svc *ShardingService) updateMsgs(ctx context.Context, db *gorm.DB, dmsgs []*dao.LocalMsg, fieldMap map[string]any, topic, table string) error {
-	err1 := db.WithContext(ctx).Model(&dao.LocalMsg{}).Table(table).
-		Where("`key` in ?", svc.getKeys(dmsgs)).
-		Updates(fieldMap).Error
-	if err1 != nil {
+func (svc *ShardingService) updateMsgs(ctx context.Context, db *gorm.DB, dmsgs []*dao.LocalMsg, fieldMap map[string]any, topic, table string, token int64) (err error) {
+	ctx, span := svc.tracer.Start(ctx, "localmsg-update", trace.WithAttributes(
+		attribute.String("table", table),
+		attribute.Int("status", int(fieldMap["status"].(int8))),
+		attribute.Int("batch_size", len(dmsgs)),
+	))
+	defer func() {
+		endSpan(span, err)
+	}()
+	// key 不一定是唯一的，必须按照 id 更新，否则会更新到别的消息，RowsAffected 也就没办法用来判断是否被 fence 了
+	ids := svc.getIds(dmsgs)
+	res := svc.fence(db.WithContext(ctx).Model(&dao.LocalMsg{}).Table(table).
+		Where("id IN ? AND status NOT IN ?", ids, migratingStatuses), fieldMap, token).
+		Updates(fieldMap)
+	if res.Error != nil {
 		return fmt.Errorf("发送消息但是更新消息失败 %w, topic %s, keys %s",
-			err1, topic, svc.getKeys(dmsgs))
+			res.Error, topic, svc.getKeys(dmsgs))
+	}
+	if res.RowsAffected < int64(len(dmsgs)) {
+		err = svc.checkUpdated(ctx, db, table, ids, res.RowsAffected, token)
+		if err != nil {
+			return fmt.Errorf("%w, topic %s, keys %s", err, topic, svc.getKeys(dmsgs))
+		}
 	}
 	return nil
 }
 
+// migratingStatuses 被 Resharder 抢占之后的状态，补偿任务和手动重试都不能再覆盖
+var migratingStatuses = []int8{dao.MsgStatusMigrating, dao.MsgStatusMigrated}
+
+// checkUpdated 在按照 id 更新的行数不够的时候，判断是消息被 Resharder 抢占了，还是被 fence 了
+// 两种情况都有的时候优先返回 ErrFenced，因为这意味着当前节点已经失去了分布式锁
+func (svc *ShardingService) checkUpdated(ctx context.Context, db *gorm.DB,
+	table string, ids []int64, affected int64, token int64) error {
+	var migrating int64
+	err := db.WithContext(ctx).Model(&dao.LocalMsg{}).Table(table).
+		Where("id IN ? AND status IN ?", ids, migratingStatuses).
+		Count(&migrating).Error
+	if err != nil {
+		return fmt.Errorf("查询消息是否正在迁移失败 %w", err)
+	}
+	switch {
+	case svc.fenced(token) && affected+migrating < int64(len(ids)):
+		return ErrFenced
+	case migrating > 0:
+		return ErrMigrating
+	default:
+		return nil
+	}
+}
+
+// fenced 是否需要校验 fencing token。只有补偿任务才会带上 token
+func (svc *ShardingService) fenced(token int64) bool {
+	return svc.fencing && token > 0
+}
+
+// fence 只有消息上的 fencing token 不比自己的大，才能更新成功，同时将消息上的 token 更新为自己的
+func (svc *ShardingService) fence(db *gorm.DB, fields map[string]any, token int64) *gorm.DB {
+	if !svc.fenced(token) {
+		return db
+	}
+	fields["fencing_token"] = token
+	return db.Where("fencing_token <= ?", token)
+}
+
 func (svc *ShardingService) newDmsg(msg msg.Msg) *dao.LocalMsg {
 	val, _ := json.Marshal(msg)
 	now := time.Now().UnixMilli()
@@ -343,13 +672,6 @@ func (svc *ShardingService) newDmsg(msg msg.Msg) *dao.LocalMsg {
 	}
 }
 
-func (svc *ShardingService) getKeyStr(dmsgs []*dao.LocalMsg) string {
-	keyList := slice.Map(dmsgs, func(idx int, src *dao.LocalMsg) string {
-		return src.Key
-	})
-	return strings.Join(keyList, ",")
-}
-
 func (svc *ShardingService) getIds(dmsgs []*dao.LocalMsg) []int64 {
 	ids := slice.Map(dmsgs, func(idx int, src *dao.LocalMsg) int64 {
 		return src.Id
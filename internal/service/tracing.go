@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"github.com/meoying/local-msg-go/internal/dao"
+	dlock "github.com/meoying/local-msg-go/internal/lock"
+	"github.com/meoying/local-msg-go/internal/msg"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// 保存链路信息的格式是固定的，不依赖于全局的 propagator，
+// 这样就算业务没有设置全局的 propagator，补偿任务也能关联到原本的链路
+var traceCarrier = propagation.TraceContext{}
+
+// WithTracerProvider 指定创建 span 的 TracerProvider，默认使用全局的
+func WithTracerProvider(tp trace.TracerProvider) ShardingServiceOpt {
+	return func(service *ShardingService) {
+		service.tracer = tp.Tracer("localmsg")
+	}
+}
+
+// injectTrace 把 ctx 中的链路信息保存到消息里面
+func injectTrace(ctx context.Context, m *msg.Msg) {
+	carrier := propagation.MapCarrier{}
+	traceCarrier.Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		m.Trace = carrier
+	}
+}
+
+// traceLink 返回消息保存时候的链路，没有的话返回 false
+func traceLink(m msg.Msg) (trace.Link, bool) {
+	if len(m.Trace) == 0 {
+		return trace.Link{}, false
+	}
+	ctx := traceCarrier.Extract(context.Background(), propagation.MapCarrier(m.Trace))
+	link := trace.LinkFromContext(ctx)
+	return link, link.SpanContext.IsValid()
+}
+
+func dstAttrs(dst sharding.Dst) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("db", dst.DB),
+		attribute.String("table", dst.Table),
+	}
+}
+
+// endSpan 结束 span，err 不为 nil 的时候记录下来
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// findSuspendMsg 带上 span 的 findSuspendMsg
+func (svc *ShardingService) findSuspendMsg(ctx context.Context, db *gorm.DB,
+	table string, limit int) ([]dao.LocalMsg, error) {
+	ctx, span := svc.tracer.Start(ctx, "localmsg-find-suspend", trace.WithAttributes(
+		attribute.String("table", table),
+		attribute.Int("batch_size", limit),
+	))
+	res, err := findSuspendMsg(ctx, db, svc.WaitDuration, table, limit)
+	span.SetAttributes(attribute.Int("cnt", len(res)))
+	endSpan(span, err)
+	return res, err
+}
+
+// tracedLock 给分布式锁的续约和释放加上 span
+// 加锁在 AsyncTask 里面处理，因为要区分锁被别人持有和系统错误
+type tracedLock struct {
+	lock   dlock.Lock
+	tracer trace.Tracer
+	attrs  []attribute.KeyValue
+}
+
+func (l *tracedLock) Lock(ctx context.Context) error {
+	return l.lock.Lock(ctx)
+}
+
+func (l *tracedLock) Refresh(ctx context.Context) error {
+	ctx, span := l.tracer.Start(ctx, "localmsg-lock-refresh", trace.WithAttributes(l.attrs...))
+	err := l.lock.Refresh(ctx)
+	endSpan(span, err)
+	return err
+}
+
+func (l *tracedLock) Unlock(ctx context.Context) error {
+	ctx, span := l.tracer.Start(ctx, "localmsg-unlock", trace.WithAttributes(l.attrs...))
+	err := l.lock.Unlock(ctx)
+	endSpan(span, err)
+	return err
+}
+
+func (l *tracedLock) FencingToken() int64 {
+	return l.lock.FencingToken()
+}
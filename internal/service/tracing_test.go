@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"github.com/meoying/local-msg-go/internal/msg"
+	"github.com/meoying/local-msg-go/internal/sharding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"time"
+)
+
+func TestAsyncTask_Spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	executor := &blockingExecutor{duration: time.Millisecond * 10, started: make(chan struct{})}
+	svc := NewShardingService(nil, nil, &fakeLockClient{},
+		sharding.NewNoShard("local_msgs"), WithTracerProvider(tp))
+	svc.executor = executor
+	require.NoError(t, svc.Start(context.Background()))
+	<-executor.started
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, svc.Shutdown(ctx))
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"localmsg-lock", "localmsg-loop", "localmsg-unlock"} {
+		span, ok := spans[name]
+		require.True(t, ok, name)
+		assert.Contains(t, span.Attributes(), attribute.String("table", "local_msgs"), name)
+	}
+	assert.Contains(t, spans["localmsg-loop"].Attributes(), attribute.Int("batch_size", 10))
+	assert.Contains(t, spans["localmsg-loop"].Attributes(), attribute.Int("cnt", 1))
+}
+
+func TestTraceLink(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "biz")
+	defer span.End()
+
+	var m msg.Msg
+	injectTrace(ctx, &m)
+	link, ok := traceLink(m)
+	require.True(t, ok)
+	assert.Equal(t, span.SpanContext().TraceID(), link.SpanContext.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(), link.SpanContext.SpanID())
+
+	// 没有链路信息的时候，什么也不保存
+	m = msg.Msg{}
+	injectTrace(context.Background(), &m)
+	assert.Nil(t, m.Trace)
+	_, ok = traceLink(m)
+	assert.False(t, ok)
+}
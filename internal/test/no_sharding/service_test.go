@@ -7,15 +7,21 @@ import (
 	"github.com/IBM/sarama"
 	lmsg "github.com/meoying/local-msg-go"
 	"github.com/meoying/local-msg-go/internal/dao"
+	"github.com/meoying/local-msg-go/internal/service"
+	"github.com/meoying/local-msg-go/internal/sharding"
 	"github.com/meoying/local-msg-go/internal/test"
 	"github.com/meoying/local-msg-go/internal/test/mocks"
 	"github.com/meoying/local-msg-go/mockbiz/noshardin_order"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/mock/gomock"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"sync"
 	"testing"
 	"time"
 )
@@ -109,7 +115,8 @@ func (s *OrderServiceTestSuite) TestAsyncTask() {
 	// 五秒钟可以确保所有的数据都处理完，但是 msg5 时间还不到
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	svc.StartAsyncTask(ctx)
+	err = svc.StartAsyncTask(ctx)
+	require.NoError(s.T(), err)
 	// 等过期
 	<-ctx.Done()
 
@@ -141,6 +148,527 @@ func (s *OrderServiceTestSuite) TestAsyncTask() {
 	s.AssertMsg(msg6, msgs[5])
 }
 
+// 测试补偿任务带上 fencing token 更新消息
+func (s *OrderServiceTestSuite) TestFencing() {
+	t := s.T()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 老的表可能没有 fencing_token 列
+	if !s.db.Migrator().HasColumn("local_msgs", "fencing_token") {
+		err := s.db.WithContext(ctx).
+			Exec("ALTER TABLE local_msgs ADD COLUMN fencing_token BIGINT NOT NULL DEFAULT 0").Error
+		require.NoError(t, err)
+	}
+	now := time.Now().UnixMilli()
+	msg1 := s.MockDAOMsg(1, now-(time.Second*11).Milliseconds())
+	err := s.db.WithContext(ctx).Create(&msg1).Error
+	require.NoError(t, err)
+	// 已经被 token 为 5 的节点处理过了
+	err = s.db.WithContext(ctx).Table("local_msgs").Where("id = ?", 1).
+		Update("fencing_token", 5).Error
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	producer.EXPECT().SendMessage(gomock.Any()).Return(1, 1, nil).Times(2)
+	listener := &recordListener{}
+	svc, err := lmsg.NewDefaultService(s.db, producer, service.WithFencing(), lmsg.WithListener(listener))
+	require.NoError(t, err)
+	svc.WaitDuration = time.Second * 10
+	executor := service.NewCurMsgExecutor(svc.ShardingService)
+
+	// token 比消息上的小，说明自己已经失去了锁
+	_, err = executor.Exec(ctx, s.db, "local_msgs", service.ExecOptions{Token: 3})
+	assert.ErrorIs(t, err, service.ErrFenced)
+	// 状态没有更新成功，不能当作发送成功
+	assert.Empty(t, listener.sent)
+	var dmsg dao.LocalMsg
+	err = s.db.WithContext(ctx).Where("id = ?", 1).First(&dmsg).Error
+	require.NoError(t, err)
+	s.AssertMsg(msg1, dmsg)
+
+	cnt, err := executor.Exec(ctx, s.db, "local_msgs", service.ExecOptions{Token: 7})
+	require.NoError(t, err)
+	assert.Equal(t, 1, cnt)
+	assert.Len(t, listener.sent, 1)
+	dmsg = dao.LocalMsg{}
+	err = s.db.WithContext(ctx).Where("id = ?", 1).First(&dmsg).Error
+	require.NoError(t, err)
+	msg1.Status = dao.MsgStatusSuccess
+	msg1.SendTimes = 1
+	s.AssertMsg(msg1, dmsg)
+	var token int64
+	err = s.db.WithContext(ctx).Table("local_msgs").Where("id = ?", 1).
+		Select("fencing_token").Scan(&token).Error
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), token)
+}
+
+// 测试批量发送的时候带上 fencing token 更新消息，key 相同的别的消息不能影响判断
+func (s *OrderServiceTestSuite) TestBatchFencing() {
+	t := s.T()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if !s.db.Migrator().HasColumn("local_msgs", "fencing_token") {
+		err := s.db.WithContext(ctx).
+			Exec("ALTER TABLE local_msgs ADD COLUMN fencing_token BIGINT NOT NULL DEFAULT 0").Error
+		require.NoError(t, err)
+	}
+	now := time.Now().UnixMilli()
+	msg1 := s.MockDAOMsg(1, now-(time.Second*11).Milliseconds())
+	// 和 msg1 的 key 相同，已经发送成功了，并且没有 fencing token
+	msg2 := s.MockDAOMsg(2, now-(time.Second*11).Milliseconds())
+	msg2.Key = msg1.Key
+	msg2.Status = dao.MsgStatusSuccess
+	err := s.db.WithContext(ctx).Create([]dao.LocalMsg{msg1, msg2}).Error
+	require.NoError(t, err)
+	err = s.db.WithContext(ctx).Table("local_msgs").Where("id = ?", 1).
+		Update("fencing_token", 5).Error
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	producer.EXPECT().SendMessages(gomock.Any()).Return(nil)
+	listener := &recordListener{}
+	svc, err := lmsg.NewDefaultService(s.db, producer, service.WithFencing(), lmsg.WithListener(listener))
+	require.NoError(t, err)
+	svc.WaitDuration = time.Second * 10
+	executor := service.NewBatchMsgExecutor(svc.ShardingService)
+
+	_, err = executor.Exec(ctx, s.db, "local_msgs", service.ExecOptions{Token: 3})
+	assert.ErrorIs(t, err, service.ErrFenced)
+	var msgs []dao.LocalMsg
+	err = s.db.WithContext(ctx).Order("id ASC").Find(&msgs).Error
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	s.AssertMsg(msg1, msgs[0])
+	s.AssertMsg(msg2, msgs[1])
+	assert.Empty(t, listener.sent)
+}
+
+// 测试补偿任务发送的过程中，消息被 Resharder 抢占了，更新状态的时候不能覆盖 MsgStatusMigrating
+func (s *OrderServiceTestSuite) TestMigratingRace() {
+	t := s.T()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	now := time.Now().UnixMilli()
+	msg1 := s.MockDAOMsg(1, now-(time.Second*12).Milliseconds())
+	// 按照 utime 排序，msg1 先被取出来
+	msg2 := s.MockDAOMsg(2, now-(time.Second*11).Milliseconds())
+	err := s.db.WithContext(ctx).Create([]dao.LocalMsg{msg1, msg2}).Error
+	require.NoError(t, err)
+
+	// 发送的时候模拟 Resharder 把消息从 MsgStatusInit 抢占为 MsgStatusMigrating
+	migrate := func(ids ...int64) {
+		err := s.db.WithContext(ctx).Table("local_msgs").Where("id IN ?", ids).
+			Update("status", dao.MsgStatusMigrating).Error
+		require.NoError(t, err)
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	producer.EXPECT().SendMessage(gomock.Any()).DoAndReturn(func(pmsg *sarama.ProducerMessage) (int32, int64, error) {
+		migrate(1)
+		return 1, 1, nil
+	})
+	producer.EXPECT().SendMessages(gomock.Any()).DoAndReturn(func(pmsgs []*sarama.ProducerMessage) error {
+		migrate(2)
+		return nil
+	})
+	listener := &recordListener{}
+	svc, err := lmsg.NewDefaultService(s.db, producer, lmsg.WithListener(listener))
+	require.NoError(t, err)
+	svc.WaitDuration = time.Second * 10
+
+	_, err = service.NewCurMsgExecutor(svc.ShardingService).
+		Exec(ctx, s.db, "local_msgs", service.ExecOptions{BatchSize: 1})
+	assert.ErrorIs(t, err, service.ErrMigrating)
+	_, err = service.NewBatchMsgExecutor(svc.ShardingService).
+		Exec(ctx, s.db, "local_msgs", service.ExecOptions{BatchSize: 1})
+	assert.ErrorIs(t, err, service.ErrMigrating)
+
+	var msgs []dao.LocalMsg
+	err = s.db.WithContext(ctx).Order("id ASC").Find(&msgs).Error
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	for _, m := range msgs {
+		assert.Equal(t, dao.MsgStatusMigrating, m.Status)
+		assert.Equal(t, 0, m.SendTimes)
+	}
+	assert.Empty(t, listener.sent)
+}
+
+// 测试发送限制很紧的时候，每一批只能发送一部分，但是不算补偿任务出错
+func (s *OrderServiceTestSuite) TestSendLimitErrThreshold() {
+	testCases := []struct {
+		name string
+		opts []lmsg.ShardingServiceOpt
+	}{
+		{name: "并发发送"},
+		{name: "批量发送", opts: []lmsg.ShardingServiceOpt{service.WithBatchExecutor()}},
+	}
+	for _, tc := range testCases {
+		s.Run(tc.name, func() {
+			t := s.T()
+			defer s.TearDownTest()
+			now := time.Now().UnixMilli()
+			msgs := make([]dao.LocalMsg, 0, 10)
+			for i := int64(1); i <= 10; i++ {
+				msgs = append(msgs, s.MockDAOMsg(i, now-(time.Second*11).Milliseconds()))
+			}
+			err := s.db.Create(&msgs).Error
+			require.NoError(t, err)
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			producer := mocks.NewMockSyncProducer(ctrl)
+			producer.EXPECT().SendMessage(gomock.Any()).Return(1, 1, nil).AnyTimes()
+			producer.EXPECT().SendMessages(gomock.Any()).Return(nil).AnyTimes()
+			cfg := lmsg.DefaultAsyncTaskConfig()
+			// 出错一次就会让出分布式锁，并且很久之后才会重试
+			cfg.ErrThreshold = 1
+			// 每秒 5 条，一批 10 条的话 500ms 内肯定发不完
+			cfg.LoopTimeout = time.Millisecond * 500
+			cfg.IdleInterval = time.Millisecond * 100
+			cfg.MaxIdleInterval = time.Millisecond * 100
+			opts := append([]lmsg.ShardingServiceOpt{
+				lmsg.WithAsyncTaskConfig(cfg),
+				lmsg.WithSendLimit(lmsg.SendLimitConfig{Rate: 5, Burst: 1}),
+			}, tc.opts...)
+			svc, err := lmsg.NewDefaultService(s.db, producer, opts...)
+			require.NoError(t, err)
+			svc.WaitDuration = time.Second * 10
+			svc.BatchSize = 10
+			err = svc.Start(context.Background())
+			require.NoError(t, err)
+
+			assert.Eventually(t, func() bool {
+				var cnt int64
+				err := s.db.Model(&dao.LocalMsg{}).
+					Where("status = ?", dao.MsgStatusSuccess).Count(&cnt).Error
+				return err == nil && cnt == 10
+			}, time.Second*5, time.Millisecond*100)
+			for _, task := range svc.Health().Tasks {
+				assert.Equal(t, 0, task.ErrCnt)
+				assert.Empty(t, task.LastErr)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			err = svc.Shutdown(ctx)
+			require.NoError(t, err)
+		})
+	}
+}
+
+// 测试积压情况的指标
+func (s *OrderServiceTestSuite) TestBacklogMetrics() {
+	t := s.T()
+	now := time.Now()
+	msgs := []dao.LocalMsg{
+		// 最久没有被处理的待发送消息，创建于一个小时之前，刚刚重试过一次
+		s.MockDAOMsg(1, now.Add(-time.Minute).UnixMilli()),
+		s.MockDAOMsg(2, now.UnixMilli()),
+		s.MockDAOMsg(3, now.UnixMilli()),
+		s.MockDAOMsg(4, now.UnixMilli()),
+		s.MockDAOMsg(5, now.UnixMilli()),
+	}
+	msgs[0].Ctime = now.Add(-time.Hour).UnixMilli()
+	msgs[3].Status = dao.MsgStatusFail
+	msgs[4].Status = dao.MsgStatusSuccess
+	err := s.db.Create(&msgs).Error
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	svc, err := lmsg.NewDefaultService(s.db, producer,
+		service.WithBacklogMetrics(time.Millisecond*100, 100))
+	require.NoError(t, err)
+	// 不让补偿任务发送消息
+	svc.WaitDuration = time.Hour
+	err = svc.Start(context.Background())
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return backlogMetric("local_msg_pending_msgs") == 3
+	}, time.Second*3, time.Millisecond*100)
+	assert.Equal(t, float64(1), backlogMetric("local_msg_failed_msgs"))
+	age := backlogMetric("local_msg_oldest_pending_age_seconds")
+	assert.True(t, age >= time.Hour.Seconds() && age < (time.Hour+time.Minute).Seconds(), age)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err = svc.Shutdown(ctx)
+	require.NoError(t, err)
+	// 不再负责这张表之后，就不再上报
+	assert.Equal(t, float64(-1), backlogMetric("local_msg_pending_msgs"))
+}
+
+// backlogMetric 返回 local_msgs 表的积压指标，没有的话返回 -1
+func backlogMetric(name string) float64 {
+	return metricValue(name, map[string]string{"table": "local_msgs"})
+}
+
+// metricValue 返回标签符合 labels 的指标的值，直方图返回的是样本数量，没有的话返回 -1
+func metricValue(name string, labels map[string]string) float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return -1
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			matched := 0
+			for _, label := range m.GetLabel() {
+				if v, ok := labels[label.GetName()]; ok && v == label.GetValue() {
+					matched++
+				}
+			}
+			if matched != len(labels) {
+				continue
+			}
+			switch {
+			case m.GetGauge() != nil:
+				return m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				return m.GetCounter().GetValue()
+			case m.GetHistogram() != nil:
+				return float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return -1
+}
+
+// 测试发送结果的指标
+func (s *OrderServiceTestSuite) TestSendMetrics() {
+	t := s.T()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	now := time.Now().UnixMilli()
+	msgs := []dao.LocalMsg{
+		// 补偿成功
+		s.MockDAOMsg(1, now-(time.Second*11).Milliseconds()),
+		// 补偿失败，还会重试
+		s.MockDAOMsg(2, now-(time.Second*11).Milliseconds()),
+		// 补偿失败，不会再重试了
+		s.MockDAOMsg(4, now-(time.Second*11).Milliseconds()),
+	}
+	msgs[2].SendTimes = 2
+	err := s.db.WithContext(ctx).Create(&msgs).Error
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	producer.EXPECT().SendMessage(gomock.Any()).DoAndReturn(func(pmsg *sarama.ProducerMessage) (int32, int64, error) {
+		data := []byte(pmsg.Key.(sarama.StringEncoder))
+		if bytes.Contains(data, []byte("success")) {
+			return 1, 1, nil
+		}
+		return 0, 0, errors.New("mock error")
+	}).Times(4)
+	svc, err := lmsg.NewDefaultService(s.db, producer, service.WithSendMetrics())
+	require.NoError(t, err)
+	svc.WaitDuration = time.Second * 10
+	svc.MaxTimes = 3
+
+	count := func(path, result string) float64 {
+		return max(metricValue("local_msg_send_total", map[string]string{
+			"topic": "order_created", "table": "local_msgs", "path": path, "result": result,
+		}), 0)
+	}
+	delayCount := func(path string) float64 {
+		return max(metricValue("local_msg_send_delay_seconds", map[string]string{
+			"topic": "order_created", "table": "local_msgs", "path": path,
+		}), 0)
+	}
+	before := map[string]float64{
+		"compensation_success":   count("compensation", "success"),
+		"compensation_retryable": count("compensation", "retryable"),
+		"compensation_terminal":  count("compensation", "terminal"),
+		"immediate_success":      count("immediate", "success"),
+		"compensation_delay":     delayCount("compensation"),
+		"immediate_delay":        delayCount("immediate"),
+	}
+
+	executor := service.NewCurMsgExecutor(svc.ShardingService)
+	_, err = executor.Exec(ctx, s.db, "local_msgs", service.ExecOptions{})
+	assert.Error(t, err)
+	err = svc.ExecTx(ctx, func(tx *gorm.DB) (lmsg.Msg, error) {
+		return lmsg.Msg{Key: "immediate_success", Topic: "order_created"}, nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, before["compensation_success"]+1, count("compensation", "success"))
+	assert.Equal(t, before["compensation_retryable"]+1, count("compensation", "retryable"))
+	assert.Equal(t, before["compensation_terminal"]+1, count("compensation", "terminal"))
+	assert.Equal(t, before["immediate_success"]+1, count("immediate", "success"))
+	// 只有发送成功的才会统计延迟
+	assert.Equal(t, before["compensation_delay"]+1, delayCount("compensation"))
+	assert.Equal(t, before["immediate_delay"]+1, delayCount("immediate"))
+}
+
+// 测试补偿任务发送消息的时候，关联到保存消息时候的链路
+func (s *OrderServiceTestSuite) TestTraceLink() {
+	t := s.T()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	// 立刻发送失败，补偿成功
+	producer.EXPECT().SendMessage(gomock.Any()).Return(int32(0), int64(0), errors.New("mock error"))
+	producer.EXPECT().SendMessage(gomock.Any()).Return(int32(1), int64(1), nil)
+	svc, err := lmsg.NewDefaultService(s.db, producer, service.WithTracerProvider(tp))
+	require.NoError(t, err)
+	svc.WaitDuration = 0
+
+	bizCtx, bizSpan := tp.Tracer("test").Start(ctx, "create-order")
+	err = svc.ExecTx(bizCtx, func(tx *gorm.DB) (lmsg.Msg, error) {
+		return lmsg.Msg{Key: "trace_link", Topic: "order_created"}, nil
+	})
+	bizSpan.End()
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 10)
+	executor := service.NewCurMsgExecutor(svc.ShardingService)
+	cnt, err := executor.Exec(ctx, s.db, "local_msgs", service.ExecOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, cnt)
+
+	var sendings []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "localmsg-sending" {
+			sendings = append(sendings, span)
+		}
+	}
+	require.Len(t, sendings, 2)
+	// 立刻发送的时候，就在业务的链路上
+	assert.Equal(t, bizSpan.SpanContext().TraceID(), sendings[0].SpanContext().TraceID())
+	assert.Empty(t, sendings[0].Links())
+	// 补偿的时候是新的链路，关联到业务的链路上
+	assert.NotEqual(t, bizSpan.SpanContext().TraceID(), sendings[1].SpanContext().TraceID())
+	require.Len(t, sendings[1].Links(), 1)
+	assert.Equal(t, bizSpan.SpanContext().TraceID(), sendings[1].Links()[0].SpanContext.TraceID())
+}
+
+// 测试保存和发送消息的时候通知 Listener
+func (s *OrderServiceTestSuite) TestListener() {
+	t := s.T()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	now := time.Now().UnixMilli()
+	msgs := []dao.LocalMsg{
+		// 补偿成功
+		s.MockDAOMsg(1, now-(time.Second*11).Milliseconds()),
+		// 补偿失败，还会重试
+		s.MockDAOMsg(2, now-(time.Second*11).Milliseconds()),
+		// 补偿失败，不会再重试了
+		s.MockDAOMsg(4, now-(time.Second*11).Milliseconds()),
+	}
+	msgs[2].SendTimes = 2
+	err := s.db.WithContext(ctx).Create(&msgs).Error
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	producer.EXPECT().SendMessage(gomock.Any()).DoAndReturn(func(pmsg *sarama.ProducerMessage) (int32, int64, error) {
+		data := []byte(pmsg.Key.(sarama.StringEncoder))
+		if bytes.Contains(data, []byte("success")) {
+			return 1, 1, nil
+		}
+		return 0, 0, errors.New("mock error")
+	}).Times(4)
+	listener := &recordListener{}
+	svc, err := lmsg.NewDefaultService(s.db, producer, lmsg.WithListener(listener))
+	require.NoError(t, err)
+	svc.WaitDuration = time.Second * 10
+	svc.MaxTimes = 3
+
+	executor := service.NewCurMsgExecutor(svc.ShardingService)
+	_, err = executor.Exec(ctx, s.db, "local_msgs", service.ExecOptions{})
+	assert.Error(t, err)
+	err = svc.ExecTx(ctx, func(tx *gorm.DB) (lmsg.Msg, error) {
+		return lmsg.Msg{Key: "immediate_success", Topic: "order_created"}, nil
+	})
+	require.NoError(t, err)
+	// SaveMsg 使用实际写入的表
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return svc.SaveMsg(tx, nil, lmsg.Msg{Key: "saved", Topic: "order_created"})
+	})
+	require.NoError(t, err)
+
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	require.Len(t, listener.saved, 2)
+	assert.Equal(t, "immediate_success", listener.saved[0].Msg.Key)
+	assert.Equal(t, "local_msgs", listener.saved[0].Dst.Table)
+	assert.NotZero(t, listener.saved[0].Id)
+	assert.Equal(t, "saved", listener.saved[1].Msg.Key)
+	assert.Equal(t, sharding.Dst{Table: "local_msgs"}, listener.saved[1].Dst)
+
+	sent := make(map[string]lmsg.MsgEvent, len(listener.sent))
+	for _, evt := range listener.sent {
+		sent[evt.Msg.Key] = evt
+	}
+	require.Len(t, sent, 2)
+	assert.Equal(t, "compensation", sent["1_success"].Path)
+	assert.Equal(t, 1, sent["1_success"].SendTimes)
+	assert.Equal(t, "immediate", sent["immediate_success"].Path)
+
+	require.Len(t, listener.failed, 1)
+	assert.Equal(t, "2_fail", listener.failed[0].Msg.Key)
+	assert.Equal(t, 1, listener.failed[0].SendTimes)
+	assert.Error(t, listener.failed[0].Err)
+
+	require.Len(t, listener.dead, 1)
+	assert.Equal(t, "4_fail", listener.dead[0].Msg.Key)
+	assert.Equal(t, 3, listener.dead[0].SendTimes)
+}
+
+type recordListener struct {
+	lmsg.NopListener
+	mu     sync.Mutex
+	saved  []lmsg.MsgEvent
+	sent   []lmsg.MsgEvent
+	failed []lmsg.MsgEvent
+	dead   []lmsg.MsgEvent
+}
+
+func (r *recordListener) OnSaved(ctx context.Context, evt lmsg.MsgEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.saved = append(r.saved, evt)
+}
+
+func (r *recordListener) OnSent(ctx context.Context, evt lmsg.MsgEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, evt)
+}
+
+func (r *recordListener) OnSendFailed(ctx context.Context, evt lmsg.MsgEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed = append(r.failed, evt)
+}
+
+func (r *recordListener) OnDead(ctx context.Context, evt lmsg.MsgEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dead = append(r.dead, evt)
+}
+
 func (s *OrderServiceTestSuite) TestCreateOrder() {
 	testCases := []struct {
 		name string
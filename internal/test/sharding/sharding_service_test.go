@@ -11,6 +11,7 @@ import (
 	"github.com/meoying/local-msg-go/internal/dao"
 	dlock "github.com/meoying/local-msg-go/internal/lock"
 	glock "github.com/meoying/local-msg-go/internal/lock/gorm"
+	"github.com/meoying/local-msg-go/internal/schedule"
 	"github.com/meoying/local-msg-go/internal/service"
 	"github.com/meoying/local-msg-go/internal/sharding"
 	"github.com/meoying/local-msg-go/internal/test"
@@ -265,7 +266,8 @@ func (s *OrderServiceTestSuite) TestAsyncTask() {
 	// 五秒钟可以确保所有的数据都处理完，但是 msg5 时间还不到
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	svc.StartAsyncTask(ctx)
+	err := svc.StartAsyncTask(ctx)
+	require.NoError(s.T(), err)
 	// 等过期
 	<-ctx.Done()
 
@@ -378,7 +380,8 @@ func (s *OrderServiceTestSuite) TestBatchAsyncTask() {
 	// 五秒钟可以确保所有的数据都处理完，但是 msg5 时间还不到
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	svc.StartAsyncTask(ctx)
+	err := svc.StartAsyncTask(ctx)
+	require.NoError(s.T(), err)
 	// 等过期
 	<-ctx.Done()
 
@@ -415,6 +418,69 @@ func (s *OrderServiceTestSuite) TestBatchAsyncTask() {
 	}
 }
 
+// 测试不依赖分布式锁，而是通过一致性哈希来分配表
+func (s *OrderServiceTestSuite) TestPartitionAsyncTask() {
+	now := time.Now().UnixMilli()
+	// 会取出来，并且发送成功
+	msg1 := s.MockDAOMsg(1, now-(time.Second*11).Milliseconds())
+	// 会取出来，但是发送失败
+	msg2 := s.MockDAOMsg(2, now-(time.Second*11).Milliseconds())
+	msg2.SendTimes = 2
+	for _, dst := range s.rules.EffectiveTablesFunc() {
+		db := s.dbs[dst.DB]
+		err := db.Table(dst.Table).Create([]dao.LocalMsg{msg1, msg2}).Error
+		require.NoError(s.T(), err)
+	}
+
+	ctrl := gomock.NewController(s.T())
+	defer ctrl.Finish()
+	producer := mocks.NewMockSyncProducer(ctrl)
+	producer.EXPECT().SendMessage(gomock.Any()).DoAndReturn(func(pmsg *sarama.ProducerMessage) (int32, int64, error) {
+		data := []byte(pmsg.Key.(sarama.StringEncoder))
+		if bytes.Contains(data, []byte("success")) {
+			return 1, 1, nil
+		}
+		return 0, 0, errors.New("mock error")
+	}).AnyTimes()
+
+	registry, err := lmsg.NewGormRegistry(s.db00)
+	require.NoError(s.T(), err)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	// 两个节点分摊四张表
+	for _, node := range []string{"node1", "node2"} {
+		scheduler := lmsg.NewPartitionScheduler(registry,
+			schedule.WithNodeName(node),
+			schedule.WithHeartbeat(time.Millisecond*100, time.Millisecond*500))
+		svc := lmsg.NewDefaultShardingService(s.dbs,
+			producer,
+			nil,
+			s.rules,
+			service.WithPartitionScheduler(scheduler))
+		svc.WaitDuration = time.Second * 10
+		svc.MaxTimes = 3
+		err = svc.StartAsyncTask(ctx)
+		require.NoError(s.T(), err)
+	}
+	<-ctx.Done()
+
+	for _, dst := range s.rules.EffectiveTablesFunc() {
+		newCtx, newCancel := context.WithTimeout(context.Background(), time.Second*3)
+		var msgs []dao.LocalMsg
+		db := s.dbs[dst.DB]
+		err = db.WithContext(newCtx).
+			Table(dst.Table).Order("id ASC").Find(&msgs).Error
+		newCancel()
+		require.NoError(s.T(), err)
+		msg1.Status = dao.MsgStatusSuccess
+		msg1.SendTimes = 1
+		s.AssertMsg(msg1, msgs[0])
+		msg2.Status = dao.MsgStatusFail
+		msg2.SendTimes = 3
+		s.AssertMsg(msg2, msgs[1])
+	}
+}
+
 func TestShardingService(t *testing.T) {
 	suite.Run(t, new(OrderServiceTestSuite))
 }
@@ -0,0 +1,16 @@
+package lmsg
+
+import "github.com/meoying/local-msg-go/internal/service"
+
+// Listener 监听本地消息表的事件，通过 WithListener 注册
+type Listener = service.Listener
+
+type MsgEvent = service.MsgEvent
+
+// NopListener 组合它之后，只需要实现关心的事件
+type NopListener = service.NopListener
+
+// WithListener 注册事件监听者，可以注册多个，按照注册的顺序调用
+func WithListener(l Listener) ShardingServiceOpt {
+	return service.WithListener(l)
+}
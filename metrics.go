@@ -0,0 +1,41 @@
+package lmsg
+
+import (
+	"github.com/meoying/local-msg-go/internal/metrics"
+	"github.com/meoying/local-msg-go/internal/service"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	"time"
+)
+
+// Metrics 可以自己实现，接入别的监控系统
+type Metrics = metrics.Metrics
+
+// MetricsBacklog 某张表的积压情况，自己实现 Metrics 的时候使用
+type MetricsBacklog = metrics.Backlog
+
+// WithMetrics 指定上报指标的实现，同时开启补偿任务执行时间和发送结果的指标
+func WithMetrics(m Metrics) ShardingServiceOpt {
+	return service.WithMetrics(m)
+}
+
+// NewPrometheusMetrics 把指标注册到 reg 上，配合 WithMetrics 使用
+// reg 上已经注册过的话会复用，所以多个服务可以共享同一个 Registerer
+func NewPrometheusMetrics(reg prometheus.Registerer) (Metrics, error) {
+	return metrics.NewPrometheus(reg)
+}
+
+// NewOTelMetrics 使用 OpenTelemetry 的 meter 上报指标，配合 WithMetrics 使用
+func NewOTelMetrics(meter metric.Meter) (Metrics, error) {
+	return metrics.NewOTel(meter)
+}
+
+// WithBacklogMetrics 负责某张表的补偿任务每隔 interval 统计一次积压情况，数量最多统计到 maxCount
+func WithBacklogMetrics(interval time.Duration, maxCount int) ShardingServiceOpt {
+	return service.WithBacklogMetrics(interval, maxCount)
+}
+
+// WithSendMetrics 按照 topic、表和发送路径统计发送结果，以及消息从创建到发送成功的时间
+func WithSendMetrics() ShardingServiceOpt {
+	return service.WithSendMetrics()
+}
@@ -0,0 +1,44 @@
+package lmsg
+
+import (
+	"github.com/ecodeclub/ekit/bean/option"
+	"github.com/meoying/local-msg-go/internal/msg"
+	"github.com/meoying/local-msg-go/internal/reshard"
+	"gorm.io/gorm"
+	"log/slog"
+	"time"
+)
+
+type Resharder = reshard.Resharder
+
+// ReshardProgress 迁移进度，见 WithReshardProgress
+type ReshardProgress = reshard.Progress
+
+// NewResharder 扩容的时候使用，用于处理老规则下还没有发送的消息
+// shardingInfo 需要从消息中还原出分库分表的信息
+func NewResharder(dbs map[string]*gorm.DB,
+	oldRules, newRules Sharding,
+	shardingInfo func(m msg.Msg) any,
+	opts ...option.Option[Resharder]) *Resharder {
+	return reshard.NewResharder(dbs, oldRules, newRules, shardingInfo, opts...)
+}
+
+// WithReshardBatchSize 每一批从老表中取出来的消息数量
+func WithReshardBatchSize(batchSize int) option.Option[Resharder] {
+	return reshard.WithBatchSize(batchSize)
+}
+
+// WithReshardDrainInterval Drain 的时候检测老表的间隔
+func WithReshardDrainInterval(interval time.Duration) option.Option[Resharder] {
+	return reshard.WithDrainInterval(interval)
+}
+
+// WithReshardProgress 用于汇报进度，注意它是同步调用的，不要在里面执行耗时操作
+func WithReshardProgress(fn func(p ReshardProgress)) option.Option[Resharder] {
+	return reshard.WithProgress(fn)
+}
+
+// WithReshardLogger 设置 Resharder 的日志
+func WithReshardLogger(logger *slog.Logger) option.Option[Resharder] {
+	return reshard.WithLogger(logger)
+}
@@ -0,0 +1,62 @@
+package lmsg
+
+import (
+	"github.com/ecodeclub/ekit/bean/option"
+	"github.com/meoying/local-msg-go/internal/schedule"
+	"github.com/meoying/local-msg-go/internal/service"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"log/slog"
+	"time"
+)
+
+type PartitionScheduler = schedule.Scheduler
+
+// PartitionRegistry 维护存活的节点，可以自己实现，例如说基于 etcd 或者 ZooKeeper
+type PartitionRegistry = schedule.Registry
+
+// NewPartitionScheduler 通过一致性哈希把表分配给存活的节点，而不是让所有节点去抢分布式锁
+// 配合 WithPartitionScheduler 使用
+func NewPartitionScheduler(registry PartitionRegistry,
+	opts ...option.Option[PartitionScheduler]) *PartitionScheduler {
+	return schedule.NewScheduler(registry, opts...)
+}
+
+// WithPartitionScheduler 补偿任务不再通过分布式锁来抢占表，而是由 scheduler 分配
+func WithPartitionScheduler(scheduler *PartitionScheduler) ShardingServiceOpt {
+	return service.WithPartitionScheduler(scheduler)
+}
+
+// WithSchedulerNodeName 当前节点的名字，在所有节点中必须是唯一的，默认是一个随机的 UUID
+func WithSchedulerNodeName(name string) option.Option[PartitionScheduler] {
+	return schedule.WithNodeName(name)
+}
+
+// WithSchedulerHeartbeat interval 是心跳间隔，ttl 是节点过期时间，ttl 应该是 interval 的好几倍
+func WithSchedulerHeartbeat(interval, ttl time.Duration) option.Option[PartitionScheduler] {
+	return schedule.WithHeartbeat(interval, ttl)
+}
+
+// WithSchedulerReplicas 每个节点在哈希环上的虚拟节点数量，所有节点必须一样
+func WithSchedulerReplicas(replicas int) option.Option[PartitionScheduler] {
+	return schedule.WithReplicas(replicas)
+}
+
+func WithSchedulerLogger(logger *slog.Logger) option.Option[PartitionScheduler] {
+	return schedule.WithLogger(logger)
+}
+
+// NewGormRegistry 节点的心跳保存在数据库中，需要额外的 local_msg_nodes 表
+func NewGormRegistry(db *gorm.DB) (PartitionRegistry, error) {
+	registry := schedule.NewGormRegistry(db)
+	err := registry.InitTable()
+	if err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// NewRedisRegistry 节点的心跳保存在 Redis 中
+func NewRedisRegistry(rdb redis.Cmdable, key string) PartitionRegistry {
+	return schedule.NewRedisRegistry(rdb, key)
+}
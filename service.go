@@ -9,6 +9,9 @@ import (
 	"gorm.io/gorm"
 )
 
+// ShardingServiceOpt 创建 service 的时候的选项，例如 WithPartitionScheduler
+type ShardingServiceOpt = service.ShardingServiceOpt
+
 // NewDefaultService 都是默认配置，所有的本地消息都在一张表里面
 // 在调度的时候，会使用一张表来实现分布式锁
 func NewDefaultService(
@@ -35,8 +38,57 @@ func NewDefaultService(
 func NewDefaultShardingService(dbs map[string]*gorm.DB,
 	producer sarama.SyncProducer,
 	lockClient dlock.Client,
-	sharding sharding.Sharding,opts ...service.ShardingServiceOpt) *service.ShardingService {
+	sharding Sharding,opts ...service.ShardingServiceOpt) *service.ShardingService {
 	return service.NewShardingService(dbs, producer, lockClient, sharding,opts...)
 }
 
 
+
+// WithFencing 补偿任务在更新消息状态的时候带上分布式锁的 fencing token，
+// 本地消息表需要额外的 fencing_token 列。分布式锁不支持 fencing token 的时候没有任何效果
+func WithFencing() ShardingServiceOpt {
+	return service.WithFencing()
+}
+
+// SendLimitConfig 补偿任务发送消息的并发数和速率限制
+type SendLimitConfig = service.SendLimitConfig
+
+// WithSendLimit 限制所有补偿任务加起来的发送并发数和速率
+func WithSendLimit(cfg SendLimitConfig) ShardingServiceOpt {
+	return service.WithSendLimit(cfg)
+}
+
+// WithTopicSendLimit 限制补偿任务向某个 topic 发送消息的并发数和速率，同时也受 WithSendLimit 的限制
+func WithTopicSendLimit(topic string, cfg SendLimitConfig) ShardingServiceOpt {
+	return service.WithTopicSendLimit(topic, cfg)
+}
+
+// ShutdownError Shutdown 到了截止时间，依旧有补偿任务没有退出，可以通过 errors.As 判断
+type ShutdownError = service.ShutdownError
+
+// WithRetriedBy 手动重试的时候把操作人记录在消息的 retried_by 列上，本地消息表需要额外的 retried_by 列
+func WithRetriedBy() ShardingServiceOpt {
+	return service.WithRetriedBy()
+}
+
+// ErrMigrating 消息发送之后，发现它已经被 Resharder 抢占了，此时不会再更新它的状态
+var ErrMigrating = service.ErrMigrating
+
+// AsyncTaskConfig 补偿任务的各种时间参数，在 DefaultAsyncTaskConfig 的基础上修改
+type AsyncTaskConfig = service.AsyncTaskConfig
+
+// DefaultAsyncTaskConfig 默认的补偿任务参数
+func DefaultAsyncTaskConfig() AsyncTaskConfig {
+	return service.DefaultAsyncTaskConfig()
+}
+
+// WithAsyncTaskConfig 修改所有补偿任务的时间参数，在 StartAsyncTask 或者 Start 的时候校验
+func WithAsyncTaskConfig(cfg AsyncTaskConfig) ShardingServiceOpt {
+	return service.WithAsyncTaskConfig(cfg)
+}
+
+// WithTableAsyncTaskConfig 修改某张表的补偿任务的时间参数，比如说热点表需要更快的节奏
+// 没有指定的表使用 WithAsyncTaskConfig 的参数
+func WithTableAsyncTaskConfig(dst ShardingDst, cfg AsyncTaskConfig) ShardingServiceOpt {
+	return service.WithTableAsyncTaskConfig(dst, cfg)
+}
@@ -0,0 +1,11 @@
+package lmsg
+
+import (
+	"github.com/meoying/local-msg-go/internal/service"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTracerProvider 指定创建 span 的 TracerProvider，默认使用全局的
+func WithTracerProvider(tp trace.TracerProvider) ShardingServiceOpt {
+	return service.WithTracerProvider(tp)
+}
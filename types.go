@@ -1,6 +1,20 @@
 package lmsg
 
-import "github.com/meoying/local-msg-go/internal/msg"
+import (
+	"github.com/meoying/local-msg-go/internal/msg"
+	"github.com/meoying/local-msg-go/internal/sharding"
+)
 
 // Msg 导出这个类型
 type Msg = msg.Msg
+
+// Sharding 分库分表规则
+type Sharding = sharding.Sharding
+
+// ShardingDst 消息所在的库和表
+type ShardingDst = sharding.Dst
+
+// NewNoShard 没有分库分表的时候使用，所有的消息都在 table 中
+func NewNoShard(table string) Sharding {
+	return sharding.NewNoShard(table)
+}